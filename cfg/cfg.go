@@ -2,11 +2,14 @@ package cfg
 
 import (
 	"bytes"
+	"cmp"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
 type (
@@ -14,9 +17,14 @@ type (
 		Credentials Credentials `json:"-"`
 		User        User        `json:"user"`
 		Preferences Preferences `json:"preferences"`
+		Session     string      `json:"-"`
+		// SystemPrompt is the content of the system prompt file of a project, which is added to the base system prompt
+		SystemPrompt string `json:"-"`
 	}
 	Credentials struct {
-		APIKey string
+		APIKey          string
+		OpenAIAPIKey    string
+		AnthropicAPIKey string
 	}
 	User struct {
 		Location    string `json:"location"`
@@ -33,7 +41,8 @@ var (
 )
 
 // Read returns configuration data based on the contents environment variables and a config file
-// in the specified app directory. If the file does not exist, it is created
+// in the specified app directory. If the file does not exist, it is created. Credentials are not validated
+// as which are required depends on the provider in use
 func Read(appDir string) (Config, error) {
 	if err := os.MkdirAll(appDir, 0755); err != nil {
 		return Config{}, fmt.Errorf("unable to create config file directory: %s: %w", appDir, err)
@@ -69,10 +78,9 @@ func Read(appDir string) (Config, error) {
 	}
 
 	config.Credentials.APIKey = os_Getenv("GEMINI_API_KEY")
-
-	if config.Credentials.APIKey == "" {
-		return Config{}, fmt.Errorf("unable to read the gemini-api-key from the GEMINI_API_KEY environment variable")
-	}
+	config.Credentials.OpenAIAPIKey = os_Getenv("OPENAI_API_KEY")
+	config.Credentials.AnthropicAPIKey = os_Getenv("ANTHROPIC_API_KEY")
+	config.Session = os_Getenv("GEN_SESSION")
 
 	return config, nil
 }
@@ -103,3 +111,76 @@ func Save(user User, preferences Preferences, appDir string) error {
 
 	return nil
 }
+
+// FindProject returns the closest project directory to the specified directory, being a directory with the specified name within it,
+// or within any of its ancestors. The global app directory is never considered a project directory, even when it has that name
+func FindProject(dir, name, appDir string) (string, bool) {
+	appDir, _ = filepath.Abs(appDir)
+
+	for current := dir; ; {
+		projectDir := filepath.Join(current, name)
+
+		if info, err := os.Stat(projectDir); err == nil && info.IsDir() && projectDir != appDir {
+			return projectDir, true
+		}
+
+		parent := filepath.Dir(current)
+
+		if parent == current {
+			return "", false
+		}
+
+		current = parent
+	}
+}
+
+// InitProject creates a project directory with the specified name in the specified directory. The sessions within the project are
+// excluded from version control, while its config and system prompt are not
+func InitProject(dir, name string) (string, error) {
+	projectDir := filepath.Join(dir, name)
+
+	if err := os.MkdirAll(projectDir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create project directory %s: %w", projectDir, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(projectDir, ".gitignore"), []byte("session/\n"), 0644); err != nil {
+		return "", fmt.Errorf("unable to write project .gitignore file %s: %w", projectDir, err)
+	}
+
+	return projectDir, nil
+}
+
+// ReadProject returns the specified configuration overridden by any values set in the config file of the specified project directory,
+// along with the content of the system prompt file of the project, if it exists. Unlike Read, no config file is created
+func ReadProject(config Config, projectDir string) (Config, error) {
+	filePath := path.Join(projectDir, "config")
+
+	buffer, err := os.ReadFile(filePath)
+
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return Config{}, fmt.Errorf("unable to read config file %s: %w", filePath, err)
+	case len(bytes.TrimSpace(buffer)) > 0:
+		project := Config{}
+
+		if err := json.Unmarshal(buffer, &project); err != nil {
+			return Config{}, fmt.Errorf("unable to parse config file %s: %w", filePath, err)
+		}
+
+		config.User.Location = cmp.Or(project.User.Location, config.User.Location)
+		config.User.Name = cmp.Or(project.User.Name, config.User.Name)
+		config.User.Description = cmp.Or(project.User.Description, config.User.Description)
+		config.Preferences.ResponseStyle = cmp.Or(project.Preferences.ResponseStyle, config.Preferences.ResponseStyle)
+	}
+
+	filePath = path.Join(projectDir, "system-prompt")
+
+	if buffer, err = os.ReadFile(filePath); err != nil && !os.IsNotExist(err) {
+		return Config{}, fmt.Errorf("unable to read system prompt file %s: %w", filePath, err)
+	}
+
+	config.SystemPrompt = strings.TrimSpace(string(buffer))
+
+	return config, nil
+}
@@ -2,6 +2,7 @@ package cfg
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -45,6 +46,18 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("expected api key to be %v. got %v", expectedCfg.Credentials.APIKey, actualCfg.Credentials.APIKey)
 	}
 
+	if actualCfg.Credentials.OpenAIAPIKey != expectedCfg.Credentials.APIKey {
+		t.Fatalf("expected openai api key to be %v. got %v", expectedCfg.Credentials.APIKey, actualCfg.Credentials.OpenAIAPIKey)
+	}
+
+	if actualCfg.Credentials.AnthropicAPIKey != expectedCfg.Credentials.APIKey {
+		t.Fatalf("expected anthropic api key to be %v. got %v", expectedCfg.Credentials.APIKey, actualCfg.Credentials.AnthropicAPIKey)
+	}
+
+	if actualCfg.Session != expectedCfg.Credentials.APIKey {
+		t.Fatalf("expected session to be %v. got %v", expectedCfg.Credentials.APIKey, actualCfg.Session)
+	}
+
 	if actualCfg.User.Location != expectedCfg.User.Location {
 		t.Fatalf("expected location to be %v. got %v", expectedCfg.User.Location, actualCfg.User.Location)
 	}
@@ -61,3 +74,76 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("expected response style to be %v. got %v", expectedCfg.Preferences.ResponseStyle, actualCfg.Preferences.ResponseStyle)
 	}
 }
+
+func TestProject(t *testing.T) {
+	testDir := t.TempDir() // outside of the repository, so no project directory exists in any ancestor
+
+	appDir, nestedDir := filepath.Join(testDir, "home", ".gen"), filepath.Join(testDir, "repo", "src", "pkg")
+
+	for _, dir := range []string{appDir, nestedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("expected no error creating test directory. got %v", err)
+		}
+	}
+
+	if _, ok := FindProject(nestedDir, ".gen", appDir); ok {
+		t.Fatalf("expected no project to be found before one is initialised")
+	}
+
+	if _, ok := FindProject(filepath.Join(testDir, "home"), ".gen", appDir); ok {
+		t.Fatalf("expected the app directory not to be found as a project")
+	}
+
+	projectDir, err := InitProject(filepath.Join(testDir, "repo"), ".gen")
+
+	if err != nil {
+		t.Fatalf("expected no error initialising project. got %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(projectDir, ".gitignore")); err != nil || string(data) != "session/\n" {
+		t.Fatalf("expected project .gitignore to exclude sessions. got '%s' (%v)", data, err)
+	}
+
+	if found, ok := FindProject(nestedDir, ".gen", appDir); !ok || found != projectDir {
+		t.Fatalf("expected project %v to be found. got '%v' (%v)", projectDir, found, ok)
+	}
+
+	global := Config{
+		User:        User{Name: "global-name", Location: "global-location"},
+		Preferences: Preferences{ResponseStyle: "global-response-style"},
+	}
+
+	actualCfg, err := ReadProject(global, projectDir)
+
+	if err != nil {
+		t.Fatalf("expected no error reading project config without a config file. got %v", err)
+	}
+
+	if actualCfg != global {
+		t.Fatalf("expected config to be unchanged without a project config file. got %+v", actualCfg)
+	}
+
+	if err := Save(User{Name: "project-name"}, Preferences{}, projectDir); err != nil {
+		t.Fatalf("expected no error saving project config. got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(projectDir, "system-prompt"), []byte("  project-system-prompt\n"), 0644); err != nil {
+		t.Fatalf("expected no error writing project system prompt. got %v", err)
+	}
+
+	if actualCfg, err = ReadProject(global, projectDir); err != nil {
+		t.Fatalf("expected no error reading project config. got %v", err)
+	}
+
+	if actualCfg.User.Name != "project-name" {
+		t.Fatalf("expected name to be overridden by the project. got %v", actualCfg.User.Name)
+	}
+
+	if actualCfg.User.Location != "global-location" || actualCfg.Preferences.ResponseStyle != "global-response-style" {
+		t.Fatalf("expected values not set by the project to be retained. got %+v", actualCfg)
+	}
+
+	if actualCfg.SystemPrompt != "project-system-prompt" {
+		t.Fatalf("expected system prompt to be read from the project. got '%v'", actualCfg.SystemPrompt)
+	}
+}
@@ -0,0 +1,14 @@
+package cli
+
+import (
+	"time"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+// ListCaches displays the specified caches
+func ListCaches(caches []llm.Cache) {
+	for _, c := range caches {
+		writer("  %v (%v, %v tokens): expires %v\n", c.Name, c.Model, c.Tokens, c.Expires.Local().Format(time.DateTime))
+	}
+}
@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+// Cite returns the specified text with numbered markers inserted at the end of each span supported by the grounding sources
+func Cite(text string, grounding *llm.Grounding) string {
+	if grounding == nil || len(grounding.Supports) == 0 {
+		return text
+	}
+
+	markers := map[int][]int{} // the source indices to cite, keyed by the offset at which to insert their markers
+
+	for _, support := range grounding.Supports {
+		end := support.End
+
+		if end < 0 || end > len(text) || support.Start < 0 || support.Start > end || text[support.Start:end] != support.Text { // fall back to locating the span when its offsets do not match the text
+			i := strings.Index(text, support.Text)
+			if support.Text == "" || i == -1 {
+				continue
+			}
+			end = i + len(support.Text)
+		}
+
+		for _, source := range support.Sources {
+			if source >= 0 && source < len(grounding.Sources) && !slices.Contains(markers[end], source) {
+				markers[end] = append(markers[end], source)
+			}
+		}
+	}
+
+	offsets := slices.Sorted(maps.Keys(markers))
+
+	for i := len(offsets) - 1; i >= 0; i-- { // insert from the end so earlier offsets remain valid
+		marker := strings.Builder{}
+		for _, source := range markers[offsets[i]] {
+			marker.WriteString(fmt.Sprintf("[%v]", source+1))
+		}
+		text = text[:offsets[i]] + marker.String() + text[offsets[i]:]
+	}
+
+	return text
+}
+
+// ListSources displays the numbered grounding sources
+func ListSources(grounding *llm.Grounding) {
+	if grounding == nil || len(grounding.Sources) == 0 {
+		return
+	}
+
+	writer("sources:\n")
+
+	for i, source := range grounding.Sources {
+		title := source.Title
+		if title == "" {
+			title = "untitled"
+		}
+
+		writer("  [%v] %v: %v\n", i+1, title, source.URI)
+	}
+
+	writer("\n")
+}
@@ -4,29 +4,46 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	scanner = bufio.NewScanner(os.Stdin)
 	writer  = fmt.Printf
+	status  = struct {
+		sync.Mutex
+		text string
+	}{}
 )
 
+// Spin displays a spinner, alongside any status set by SetStatus, until the returned stopFunc is called
 func Spin() (stopFunc func()) {
 	taskDone, spinDone := make(chan struct{}), make(chan struct{})
 
 	go func() {
-		spinner, i := []rune{'|', '/', '-', '\\'}, 0
+		spinner, i, width := []rune{'|', '/', '-', '\\'}, 0, 0
 
 		for {
 			select {
 			case <-taskDone:
-				writer("\r \n")
+				writer("\r%v\r \n", strings.Repeat(" ", width))
 				spinDone <- struct{}{}
 				return
 			default:
 				i++
-				writer("\r%c", spinner[i%len(spinner)])
+
+				status.Lock()
+				line := string(spinner[i%len(spinner)])
+				if status.text != "" {
+					line += " " + status.text
+				}
+				status.Unlock()
+
+				writer("\r%v%v", line, strings.Repeat(" ", max(width-len(line), 0))) // pad to overwrite any longer status previously displayed
+				width = max(width, len(line))
+
 				<-time.After(150 * time.Millisecond)
 			}
 		}
@@ -37,3 +54,10 @@ func Spin() (stopFunc func()) {
 		<-spinDone
 	}
 }
+
+// SetStatus sets the text displayed alongside the spinner. an empty status displays the spinner alone
+func SetStatus(text string) {
+	status.Lock()
+	defer status.Unlock()
+	status.text = text
+}
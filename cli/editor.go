@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Edit opens the specified text in the editor named by the EDITOR environment variable, or vi if it is not set, and returns the edited
+// text once the editor exits. The value of EDITOR may include arguments, such as 'code --wait'
+func Edit(text string) (string, error) {
+	f, err := os.CreateTemp("", "gen-prompt-*.md")
+
+	if err != nil {
+		return "", fmt.Errorf("unable to create file to edit. %w", err)
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return "", fmt.Errorf("unable to write file to edit. %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("unable to write file to edit. %w", err)
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to run editor '%v'. %w", strings.Join(editor, " "), err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+
+	if err != nil {
+		return "", fmt.Errorf("unable to read edited file. %w", err)
+	}
+
+	return string(data), nil
+}
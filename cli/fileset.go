@@ -0,0 +1,17 @@
+package cli
+
+import (
+	"github.com/comradequinn/gen/fileset"
+)
+
+// ListFiles displays the specified files, their sizes and their total size
+func ListFiles(files []fileset.File) {
+	size := int64(0)
+
+	for _, f := range files {
+		writer("  %v (%v bytes)\n", f.Path, f.Size)
+		size += f.Size
+	}
+
+	writer("%v files, %v bytes\n", len(files), size)
+}
@@ -0,0 +1,26 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+// ListRemoteFiles displays the specified remote files and the ids of the sessions that reference each of them
+func ListRemoteFiles(files []llm.RemoteFile, references map[string][]int) {
+	for _, f := range files {
+		sessions := "no sessions"
+
+		if ids := references[f.URI]; len(ids) > 0 {
+			labels := make([]string, 0, len(ids))
+			for _, id := range ids {
+				labels = append(labels, fmt.Sprintf("#%v", id))
+			}
+			sessions = "sessions " + strings.Join(labels, ", ")
+		}
+
+		writer("  %v (%v, %v bytes): expires %v, referenced by %v\n", f.ID, f.Name, f.Size, f.Expires.Local().Format(time.DateTime), sessions)
+	}
+}
@@ -3,19 +3,154 @@ package cli
 import (
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/comradequinn/gen/llm"
 	"github.com/comradequinn/gen/session"
 )
 
-// ListSessions displays the current and any saved sessions
-func ListSessions(records []session.Record) {
-	for i, r := range records {
-		labelPrefix := "  "
+// ListSessions displays the current and any saved sessions, preceded by their scope; either the specified project directory or, if none
+// is specified, the global app directory. Sessions forked from another are displayed below it, as a tree
+func ListSessions(projectDir string, records []session.Record) {
+	if projectDir != "" {
+		writer("project sessions (%v)\n", projectDir)
+	} else {
+		writer("global sessions\n")
+	}
+
+	ids, children := map[int]bool{}, map[int][]session.Record{}
+
+	for _, r := range records {
+		ids[r.ID] = true
+	}
+
+	for _, r := range records {
+		parent := r.Parent
+
+		if !ids[parent] {
+			parent = 0 // sessions whose parent has been deleted are displayed as roots
+		}
+
+		children[parent] = append(children[parent], r)
+	}
+
+	var list func(parent, depth int)
+
+	list = func(parent, depth int) {
+		for _, r := range children[parent] {
+			labelPrefix := "  "
+
+			if r.Active {
+				labelPrefix = "* "
+			}
+
+			if depth > 0 {
+				labelPrefix += strings.Repeat("   ", depth-1) + " └─"
+			}
+
+			name := ""
 
-		if r.Active {
-			labelPrefix = "* "
+			if r.Name != "" {
+				name = r.Name + " "
+			}
+
+			writer(fmt.Sprintf("%v #%v %v(%v): %v\n", labelPrefix, r.ID, name, r.TimeStamp.Format("January 02 2006"), strings.ToLower(r.Summary)))
+
+			list(r.ID, depth+1)
+		}
+	}
+
+	list(0, 0)
+}
+
+// ListFork displays the session created by a fork
+func ListFork(record session.Record) {
+	name := ""
+
+	if record.Name != "" {
+		name = " " + record.Name
+	}
+
+	writer("forked session #%v as #%v%v\n", record.Parent, record.ID, name)
+}
+
+// ListImports displays the sessions created by an import
+func ListImports(records []session.Record) {
+	for _, r := range records {
+		name := ""
+
+		if r.Name != "" {
+			name = " " + r.Name
 		}
 
-		writer(fmt.Sprintf("%v #%v (%v): %v\n", labelPrefix, i+1, r.TimeStamp.Format("January 02 2006"), strings.ToLower(r.Summary)))
+		writer("imported session #%v%v\n", r.ID, name)
+	}
+}
+
+// ListUndo displays the prompt removed by an undo
+func ListUndo(prompt llm.Message) {
+	const limit = 50
+
+	text := prompt.Text
+
+	if len(text) > limit {
+		text = text[:limit] + "..."
+	}
+
+	writer("removed the last turn: %v\n", strings.ToLower(text))
+}
+
+// ListMatches displays the turns matched by a search, with the matching lines of their prompts and responses
+func ListMatches(matches []session.Match) {
+	if len(matches) == 0 {
+		writer("no matches found\n")
+		return
+	}
+
+	for _, m := range matches {
+		name, details := "", []string{m.Time.Local().Format(time.DateTime)}
+
+		if m.Name != "" {
+			name = " " + m.Name
+		}
+
+		if m.Model != "" {
+			details = append(details, m.Model)
+		}
+
+		if m.Archived {
+			details = append(details, "archived")
+		}
+
+		writer("#%v%v, turn %v (%v)\n", m.ID, name, m.Turn, strings.Join(details, ", "))
+
+		for _, excerpt := range []struct {
+			label string
+			lines []string
+		}{{"user: ", m.Prompt}, {"model:", m.Response}} {
+			for i, line := range excerpt.lines {
+				label := strings.Repeat(" ", len(excerpt.label))
+
+				if i == 0 {
+					label = excerpt.label
+				}
+
+				writer("  %v %v\n", label, line)
+			}
+		}
+
+		writer("\n")
+	}
+}
+
+// ListChanges displays the specified changes made to the sessions, such as by a repair
+func ListChanges(changes []string) {
+	if len(changes) == 0 {
+		writer("no changes required\n")
+		return
+	}
+
+	for _, change := range changes {
+		writer("  %v\n", change)
 	}
 }
@@ -0,0 +1,12 @@
+package cli
+
+import (
+	"os"
+)
+
+// StdinPiped reports whether input has been piped, or redirected from a file, to stdin, rather than stdin being a terminal
+func StdinPiped() bool {
+	info, err := os.Stdin.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice == 0
+}
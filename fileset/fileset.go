@@ -0,0 +1,279 @@
+package fileset
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+type (
+	// File is a file selected for attachment
+	File struct {
+		Path string
+		Size int64
+	}
+	// Limits restrict the number and total size of the files selected for attachment. zero values are unlimited
+	Limits struct {
+		MaxFiles int
+		MaxBytes int64
+	}
+)
+
+// Expand returns the files described by the specified patterns. Each pattern is one of the following
+//   - a path to a file, which is always included, unless it is a binary file of a type that cannot be attached, which is an error
+//   - a path to a directory, which includes the files within it, and its subdirectories
+//   - a glob, such as 'src/**/*.go', where '**' matches any number of directories
+//   - an exclusion, being a glob prefixed with '!', which removes any matching files from the result
+//
+// Files found within directories, or by globs, are omitted when they are ignored by a .gitignore or .genignore file, or are binary
+// files of a type that cannot be attached. Files whose type cannot be determined, as they cannot be read, are an error. Exclusions without a slash match files of that name in any directory.
+//
+// An error is returned if a file, directory or glob does not exist, or matches nothing, or if the result exceeds the specified limits
+func Expand(patterns []string, limits Limits) ([]File, error) {
+	wd, err := os.Getwd()
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine working directory. %w", err)
+	}
+
+	includes, exclusions := []string{}, []rule{}
+
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+
+		if exclusion, ok := strings.CutPrefix(pattern, "!"); ok {
+			base, glob := wd, filepath.ToSlash(exclusion)
+
+			if strings.Contains(glob, "/") { // exclusions with a slash are anchored to the directory they specify
+				root, rest := splitGlob(glob)
+
+				if base, glob = root, "/"+rest; !filepath.IsAbs(root) {
+					base = filepath.Join(wd, root)
+				}
+			}
+
+			r, ok, err := newRule(base, glob)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				exclusions = append(exclusions, rule{base: r.base, pattern: r.pattern}) // exclusions always exclude and match files and directories alike
+			}
+
+			continue
+		}
+
+		includes = append(includes, pattern)
+	}
+
+	files, seen := []File{}, map[string]bool{}
+
+	add := func(path string, size int64) error {
+		abs, err := filepath.Abs(path)
+
+		if err != nil {
+			return fmt.Errorf("invalid filepath '%v'. %w", path, err)
+		}
+
+		if seen[abs] || ignored(exclusions, abs, false) {
+			return nil
+		}
+
+		seen[abs] = true
+		files = append(files, File{Path: path, Size: size})
+
+		return nil
+	}
+
+	for _, include := range includes {
+		matched := len(files)
+
+		if !isGlob(include) {
+			info, err := os.Stat(include)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid filepath. '%v' does not exist. %w", include, err)
+			}
+
+			if info.IsDir() {
+				err = walk(include, nil, exclusions, add)
+			} else if _, err = llm.MIMEType(include); err == nil { // checked here, as well as on attachment, so that a dry run lists exactly what is attached
+				err = add(filepath.Clean(include), info.Size())
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		root, glob := splitGlob(include)
+
+		re, err := compile(glob)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := walk(root, func(rel string) bool { return re.MatchString(rel) }, exclusions, add); err != nil {
+			return nil, err
+		}
+
+		if len(files) == matched {
+			return nil, fmt.Errorf("invalid pattern. '%v' matches no files", include)
+		}
+	}
+
+	if limits.MaxFiles > 0 && len(files) > limits.MaxFiles {
+		return nil, fmt.Errorf("too many files. %v files were selected which exceeds the limit of %v", len(files), limits.MaxFiles)
+	}
+
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size
+	}
+
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return nil, fmt.Errorf("files too large. %v bytes were selected which exceeds the limit of %v bytes", size, limits.MaxBytes)
+	}
+
+	return files, nil
+}
+
+// walk passes each file below the specified root, whose slash-separated path relative to the root is matched by match, to add.
+// a nil match matches all files. ignored and excluded files and directories, binary files and any .git directory are skipped
+func walk(root string, match func(rel string) bool, exclusions []rule, add func(path string, size int64) error) error {
+	absRoot, err := filepath.Abs(root)
+
+	if err != nil {
+		return fmt.Errorf("invalid filepath '%v'. %w", root, err)
+	}
+
+	rules := map[string][]rule{} // the rules in effect within each directory, including those inherited from its ancestors
+
+	if rules[filepath.Dir(absRoot)], err = ancestorRules(absRoot); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("unable to read '%v'. %w", path, err)
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return fmt.Errorf("invalid filepath '%v'. %w", path, err)
+		}
+
+		abs := filepath.Join(absRoot, rel)
+		inherited := rules[filepath.Dir(abs)]
+
+		if d.IsDir() {
+			if path != root && (d.Name() == ".git" || ignored(inherited, abs, true) || ignored(exclusions, abs, true)) {
+				return filepath.SkipDir
+			}
+
+			own, err := readRules(abs)
+
+			if err != nil {
+				return err
+			}
+
+			rules[abs] = append(slices.Clone(inherited), own...)
+
+			return nil
+		}
+
+		info, err := os.Stat(path) // follows symlinks, so that linked files are included
+
+		if err != nil || !info.Mode().IsRegular() || ignored(inherited, abs, false) {
+			return nil
+		}
+
+		if match != nil && !match(filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		if _, err := llm.MIMEType(path); errors.Is(err, llm.ErrUnsupportedFileType) {
+			return nil // binary files of a type that cannot be attached are skipped
+		} else if err != nil {
+			return err
+		}
+
+		return add(path, info.Size())
+	})
+}
+
+// ancestorRules returns the rules defined by ignore files in the ancestors of the specified directory, up to the root of the git repository
+// that contains it. no rules are returned when the directory is not within a git repository
+func ancestorRules(dir string) ([]rule, error) {
+	ancestors := []string{}
+
+	for current := dir; ; {
+		if _, err := os.Stat(filepath.Join(current, ".git")); err == nil {
+			break // the root of the repository has been reached
+		}
+
+		parent := filepath.Dir(current)
+
+		if parent == current {
+			return nil, nil // the directory is not within a repository
+		}
+
+		ancestors, current = append(ancestors, parent), parent
+	}
+
+	rules := []rule{}
+
+	for _, ancestor := range slices.Backward(ancestors) {
+		own, err := readRules(ancestor)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, own...)
+	}
+
+	return rules, nil
+}
+
+// isGlob reports whether the specified pattern contains any glob meta characters
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// splitGlob returns the directory from which the specified glob should be walked, being its leading segments that contain no
+// meta characters, and the remainder of the glob relative to that directory. a pattern without meta characters is split into
+// its directory and final segment
+func splitGlob(pattern string) (root, glob string) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+
+	i := slices.IndexFunc(segments, isGlob)
+
+	if i == -1 {
+		i = len(segments) - 1
+	}
+
+	if root = filepath.FromSlash(strings.Join(segments[:i], "/")); root == "" {
+		root = "."
+	}
+
+	if strings.HasPrefix(pattern, "/") && i == 1 {
+		root = "/"
+	}
+
+	return root, strings.Join(segments[i:], "/")
+}
@@ -0,0 +1,187 @@
+package fileset_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/comradequinn/gen/fileset"
+)
+
+func TestExpand(t *testing.T) {
+	testDir := t.TempDir()
+
+	testFiles := map[string]string{
+		".gitignore":       "build/\n*.log\n!keep.log\n",
+		".genignore":       "# secrets\nsecret.txt\n",
+		"main.go":          "package main",
+		"keep.log":         "test-log",
+		"drop.log":         "test-log",
+		"secret.txt":       "test-secret",
+		"data.bin":         "test\x00data",
+		"image.png":        "test\x00image",
+		"build/out.go":     "package build",
+		"src/.gitignore":   "/gen.go\n",
+		"src/a.go":         "package src",
+		"src/a_test.go":    "package src",
+		"src/gen.go":       "package src",
+		"src/sub/gen.go":   "package sub",
+		".git/HEAD":        "test-head",
+		"src/sub/notes.md": "test-notes",
+	}
+
+	for name, content := range testFiles {
+		path := filepath.Join(testDir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unable to create test directory. %v", err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write test file. %v", err)
+		}
+	}
+
+	t.Chdir(filepath.Join(testDir, "src"))
+
+	testCases := []struct {
+		name     string
+		patterns []string
+		limits   fileset.Limits
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "directory",
+			patterns: []string{".."},
+			expected: []string{"../.genignore", "../.gitignore", "../image.png", "../keep.log", "../main.go", "../src/.gitignore", "../src/a.go", "../src/a_test.go", "../src/sub/gen.go", "../src/sub/notes.md"},
+		},
+		{
+			name:     "ancestor ignore files",
+			patterns: []string{"."},
+			expected: []string{".gitignore", "a.go", "a_test.go", "sub/gen.go", "sub/notes.md"},
+		},
+		{
+			name:     "glob with exclusion",
+			patterns: []string{"**/*.go", " !*_test.go"},
+			expected: []string{"a.go", "sub/gen.go"},
+		},
+		{
+			name:     "explicit files are not ignored",
+			patterns: []string{"../secret.txt", "gen.go", "../secret.txt"},
+			expected: []string{"../secret.txt", "gen.go"},
+		},
+		{
+			name:     "directory exclusion",
+			patterns: []string{"..", "!sub", "!../*.*"},
+			expected: []string{"../src/.gitignore", "../src/a.go", "../src/a_test.go"},
+		},
+		{
+			name:     "file limit",
+			patterns: []string{"."},
+			limits:   fileset.Limits{MaxFiles: 2},
+			err:      true,
+		},
+		{
+			name:     "size limit",
+			patterns: []string{"."},
+			limits:   fileset.Limits{MaxBytes: 10},
+			err:      true,
+		},
+		{
+			name:     "explicit binary file",
+			patterns: []string{"../data.bin"},
+			err:      true,
+		},
+		{
+			name:     "missing file",
+			patterns: []string{"missing.go"},
+			err:      true,
+		},
+		{
+			name:     "unmatched glob",
+			patterns: []string{"**/*.rs"},
+			err:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := fileset.Expand(tc.patterns, tc.limits)
+
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error. got %+v", files)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error. got %v", err)
+			}
+
+			actual := []string{}
+			for _, f := range files {
+				actual = append(actual, filepath.ToSlash(f.Path))
+			}
+
+			slices.Sort(actual)
+
+			if !slices.Equal(actual, tc.expected) {
+				t.Fatalf("expected files %v. got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExpandUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("file permissions are not enforced for root")
+	}
+
+	testDir := t.TempDir()
+	file := filepath.Join(testDir, "unreadable")
+
+	if err := os.WriteFile(file, []byte("test-content"), 0000); err != nil {
+		t.Fatalf("unable to write test file. %v", err)
+	}
+
+	if files, err := fileset.Expand([]string{testDir}, fileset.Limits{}); err == nil || !strings.Contains(err.Error(), "unreadable") {
+		t.Fatalf("expected an error for a file whose type cannot be read, rather than it being skipped. got %v (%+v)", err, files)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	testDir := t.TempDir()
+
+	stale := filepath.Join(testDir, "stale")
+
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatalf("unable to create test directory. %v", err)
+	}
+
+	if err := os.Chtimes(stale, time.Now().Add(-72*time.Hour), time.Now().Add(-72*time.Hour)); err != nil {
+		t.Fatalf("unable to age test directory. %v", err)
+	}
+
+	file, err := fileset.Stdin(testDir, "changes.diff", strings.NewReader("test-diff"))
+
+	if err != nil {
+		t.Fatalf("expected no error writing stdin. got %v", err)
+	}
+
+	if data, err := os.ReadFile(file.Path); err != nil || string(data) != "test-diff" || filepath.Base(file.Path) != "changes.diff" || file.Size != 9 {
+		t.Fatalf("expected stdin to be written to a file of the specified name. got %+v with content %q. %v", file, data, err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected stale stdin files to be removed. got %v", err)
+	}
+
+	if _, err := fileset.Stdin(testDir, "../changes.diff", strings.NewReader("test-diff")); err == nil {
+		t.Fatalf("expected an error for a name with a directory")
+	}
+}
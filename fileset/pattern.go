@@ -0,0 +1,163 @@
+package fileset
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// rule is a single pattern from an ignore file, such as a .gitignore, or an exclusion specified by the user
+	rule struct {
+		base    string
+		pattern *regexp.Regexp
+		negate  bool
+		dirOnly bool
+	}
+)
+
+// IgnoreFiles are the names of the files, in any directory, whose patterns describe the files in that directory, and below it, to ignore
+var IgnoreFiles = []string{".gitignore", ".genignore"}
+
+// compile returns a regular expression equivalent to the specified glob, which is matched against slash-separated relative paths.
+// '*' and '?' match within a single path segment, '**' matches across segments and '[...]' matches a character class
+func compile(glob string) (*regexp.Regexp, error) {
+	expr := strings.Builder{}
+	expr.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				expr.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			expr.WriteString(regexp.QuoteMeta(string(glob[i+1])))
+			i++
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%v'. %w", glob, err)
+	}
+
+	return re, nil
+}
+
+// newRule returns a rule for the specified pattern, in .gitignore form, relative to the specified base directory.
+// patterns without a slash, other than a trailing one, match at any depth below the base directory
+func newRule(base, pattern string) (rule, bool, error) {
+	r := rule{base: base}
+
+	if pattern = strings.TrimRight(pattern, " "); pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule{}, false, nil
+	}
+
+	if r.negate = strings.HasPrefix(pattern, "!"); r.negate {
+		pattern = pattern[1:]
+	}
+
+	if r.dirOnly = strings.HasSuffix(pattern, "/"); r.dirOnly {
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+
+	re, err := compile(strings.TrimPrefix(pattern, "/"))
+
+	if err != nil {
+		return rule{}, false, err
+	}
+
+	r.pattern = re
+
+	return r, true, nil
+}
+
+// readRules returns the rules defined by any ignore files in the specified directory
+func readRules(dir string) ([]rule, error) {
+	rules := []rule{}
+
+	for _, name := range IgnoreFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to open ignore file '%v'. %w", filepath.Join(dir, name), err)
+		}
+
+		scanner := bufio.NewScanner(f)
+
+		for scanner.Scan() {
+			r, ok, err := newRule(dir, scanner.Text())
+
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("invalid ignore file '%v'. %w", filepath.Join(dir, name), err)
+			}
+
+			if ok {
+				rules = append(rules, r)
+			}
+		}
+
+		f.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read ignore file '%v'. %w", filepath.Join(dir, name), err)
+		}
+	}
+
+	return rules, nil
+}
+
+// ignored reports whether the specified absolute path is ignored by the specified rules. the last matching rule takes precedence
+func ignored(rules []rule, path string, isDir bool) bool {
+	result := false
+
+	for _, r := range rules {
+		rel, err := filepath.Rel(r.base, path)
+
+		if err != nil || rel == "." || strings.HasPrefix(filepath.ToSlash(rel)+"/", "../") || (r.dirOnly && !isDir) {
+			continue
+		}
+
+		if r.pattern.MatchString(filepath.ToSlash(rel)) {
+			result = !r.negate
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,52 @@
+package fileset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stdinLifetime is how long content written by Stdin is retained, being the time for which the gemini files api retains an upload of it.
+// this allows an expired upload to be uploaded again, as with any other file, when the session that references it is continued
+const stdinLifetime = 48 * time.Hour
+
+// Stdin writes the content read from r to a file with the specified name, so that it can be attached in the same manner as any other file.
+// The file is written to a directory below dir named after a hash of the content, so that concurrent calls do not conflict, and the mime type
+// of the file is determined by the extension of the name, if it is recognised, or otherwise by its content. Files written by previous calls
+// are removed once they are older than the lifetime of an upload
+func Stdin(dir, name string, r io.Reader) (File, error) {
+	if name == "" || filepath.Base(name) != name {
+		return File{}, fmt.Errorf("invalid stdin file name '%v'. a file name, without a directory, must be specified", name)
+	}
+
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return File{}, fmt.Errorf("unable to read stdin. %w", err)
+	}
+
+	entries, _ := os.ReadDir(dir) // a missing directory has no entries to remove
+
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > stdinLifetime {
+			os.RemoveAll(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	hash := sha256.Sum256(data)
+	file := filepath.Join(dir, hex.EncodeToString(hash[:]), name)
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return File{}, fmt.Errorf("unable to create stdin directory. %w", err)
+	}
+
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		return File{}, fmt.Errorf("unable to write stdin to file '%v'. %w", file, err)
+	}
+
+	return File{Path: file, Size: int64(len(data))}, nil
+}
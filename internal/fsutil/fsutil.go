@@ -0,0 +1,55 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// TempFilePrefix begins the name of the temporary files written by WriteFile, so that any left by an interrupted process can be identified
+const TempFilePrefix = ".tmp-"
+
+// WriteFile writes the specified data to a temporary file, in the same directory as the specified file, and then renames it to
+// the specified file. this ensures the file is either entirely replaced or left unchanged, even if the process is interrupted.
+// the file retains its mode, or is created with a mode of 0600, as it may hold private data
+func WriteFile(file string, data []byte) error {
+	mode := os.FileMode(0600)
+
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), TempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
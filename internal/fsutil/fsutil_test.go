@@ -0,0 +1,50 @@
+package fsutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "test-file")
+
+	assertMode := func(expected os.FileMode) {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			t.Fatalf("expected no error reading file info. got %v", err)
+		}
+
+		if info.Mode().Perm() != expected {
+			t.Fatalf("expected file mode %v. got %v", expected, info.Mode().Perm())
+		}
+	}
+
+	if err := fsutil.WriteFile(file, []byte("test-content-1")); err != nil {
+		t.Fatalf("expected no error writing file. got %v", err)
+	}
+
+	assertMode(0600)
+
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatalf("unable to change file mode. %v", err)
+	}
+
+	if err := fsutil.WriteFile(file, []byte("test-content-2")); err != nil {
+		t.Fatalf("expected no error writing file. got %v", err)
+	}
+
+	assertMode(0644)
+
+	if data, err := os.ReadFile(file); err != nil || string(data) != "test-content-2" {
+		t.Fatalf("expected the file to be replaced. got %q (%v)", data, err)
+	}
+
+	if temp, _ := filepath.Glob(filepath.Join(dir, fsutil.TempFilePrefix+"*")); len(temp) != 0 {
+		t.Fatalf("expected no temporary files to remain. got %v", temp)
+	}
+}
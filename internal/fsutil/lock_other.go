@@ -0,0 +1,8 @@
+//go:build !unix
+
+package fsutil
+
+// Lock does not lock the specified file, as advisory file locks are not supported on this platform
+func Lock(file string) (unlock func(), err error) {
+	return func() {}, nil
+}
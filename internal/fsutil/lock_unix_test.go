@@ -0,0 +1,47 @@
+//go:build unix
+
+package fsutil_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+)
+
+func TestLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test-lock")
+
+	unlock, err := fsutil.Lock(file)
+
+	if err != nil {
+		t.Fatalf("expected no error acquiring lock. got %v", err)
+	}
+
+	released, acquired := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		unlock, err := fsutil.Lock(file)
+
+		if err != nil {
+			t.Errorf("expected no error acquiring lock. got %v", err)
+			close(acquired)
+			return
+		}
+
+		select {
+		case <-released:
+		default:
+			t.Errorf("expected the lock to be held exclusively")
+		}
+
+		unlock()
+		close(acquired)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(released)
+	unlock()
+	<-acquired
+}
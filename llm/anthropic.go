@@ -0,0 +1,309 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/comradequinn/gen/llm/internal/resource"
+	"github.com/comradequinn/gen/llm/internal/schema/anthropic"
+)
+
+// anthropicProvider is the provider for the anthropic messages api
+type anthropicProvider struct{}
+
+const (
+	// respondTool is the name of the tool the model is required to call when a response schema is specified, as
+	// the messages api does not support structured responses directly
+	respondTool = "respond"
+)
+
+func (anthropicProvider) attach(_ context.Context, _ Config, files []string) ([]FileReference, error) {
+	fileReferences, err := attachLocal(files)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fileReference := range fileReferences {
+		if anthropicBlockType(fileReference.MIMEType) == "" {
+			return nil, fmt.Errorf("unable to attach file '%v'. files of type '%v' are not supported by the anthropic api", fileReference.Path, fileReference.MIMEType)
+		}
+	}
+
+	return fileReferences, nil
+}
+
+func (anthropicProvider) generate(ctx context.Context, cfg Config, rq request) (result, error) {
+	request := anthropic.Request{
+		Model:       cfg.Model,
+		System:      rq.SystemPrompt,
+		MaxTokens:   cfg.MaxTokens,
+		Temperature: cfg.Temperature, // top-p is not sent as the messages api does not permit both to be specified for all models
+		Stream:      cfg.Stream != nil,
+	}
+
+	for _, message := range rq.Messages {
+		request.Messages = append(request.Messages, anthropicMessage(cfg, message))
+	}
+
+	for _, tool := range cfg.Tools {
+		request.Tools = append(request.Tools, anthropic.Tool{Name: tool.Name, Description: tool.Description, InputSchema: anthropicInputSchema(tool.Parameters)})
+	}
+
+	wrapped := false
+
+	if rq.Schema != "" {
+		var inputSchema json.RawMessage
+
+		if inputSchema, wrapped = anthropicResponseSchema(rq.Schema); wrapped {
+			cfg.DebugPrintf("response schema wrapped in an object as the messages api requires tool inputs to be objects", "type", "schema_wrapped")
+		}
+
+		request.Tools = append(request.Tools, anthropic.Tool{Name: respondTool, Description: "Provide the response to the user in the required structured form", InputSchema: inputSchema})
+		request.ToolChoice = &anthropic.ToolChoice{Type: "tool", Name: respondTool}
+
+		if len(cfg.Tools) > 0 {
+			request.ToolChoice = &anthropic.ToolChoice{Type: "any"}
+		}
+	}
+
+	body := bytes.Buffer{}
+	if err := json.NewEncoder(&body).Encode(request); err != nil {
+		return result{}, fmt.Errorf("unable to encode llm request as json. %w", err)
+	}
+
+	cfg.DebugPrintf("sending messages request", "type", "generate_request", "url", cfg.APIURL, "request", body.String())
+
+	rs, err := post(ctx, cfg, cfg.APIURL, map[string]string{"x-api-key": cfg.APIKey, "anthropic-version": anthropic.Version}, body.Bytes())
+
+	if err != nil {
+		return result{}, err
+	}
+
+	defer rs.Body.Close()
+
+	var response anthropic.Response
+
+	if request.Stream {
+		response, err = anthropicStream(cfg, rs.Body)
+	} else {
+		var data []byte
+		if data, err = io.ReadAll(rs.Body); err != nil {
+			return result{}, fmt.Errorf("unable to read response body. %w", err)
+		}
+		cfg.DebugPrintf("received messages response", "type", "generate_response", "status", rs.Status, "response", string(data))
+		if err = json.Unmarshal(data, &response); err != nil {
+			err = fmt.Errorf("unable to parse response body. %w", err)
+		}
+	}
+
+	if err != nil {
+		return result{}, err
+	}
+
+	message := Message{Role: RoleModel}
+
+	for _, block := range response.Content {
+		switch {
+		case block.Type == anthropic.BlockTypeText:
+			message.Text += block.Text
+		case block.Type == anthropic.BlockTypeToolUse && block.Name == respondTool && rq.Schema != "":
+			message.Text = anthropicStructuredResponse(block.Input, wrapped)
+			if cfg.Stream != nil {
+				cfg.Stream(message.Text) // structured responses arrive as tool input, so are not streamed as they are generated
+			}
+		case block.Type == anthropic.BlockTypeToolUse:
+			message.FunctionCalls = append(message.FunctionCalls, FunctionCall{ID: block.ID, Name: block.Name, Args: block.Input})
+		}
+	}
+
+	if rq.Schema != "" && len(message.FunctionCalls) == 0 {
+		message.Text = strings.TrimSpace(message.Text)
+	}
+
+	return result{
+		Message:      message,
+		Tokens:       response.Usage.InputTokens + response.Usage.OutputTokens,
+		FinishReason: anthropicFinishReason(response.StopReason),
+		FinishDetail: response.StopReason,
+	}, nil
+}
+
+// anthropicFinishReason maps the specified messages api stop reason to its provider-agnostic equivalent
+func anthropicFinishReason(stopReason string) FinishReason {
+	switch stopReason {
+	case anthropic.StopReasonEndTurn, anthropic.StopReasonToolUse, anthropic.StopReasonStopSequence:
+		return FinishReasonStop
+	case anthropic.StopReasonMaxTokens:
+		return FinishReasonMaxTokens
+	case anthropic.StopReasonRefusal:
+		return FinishReasonSafety
+	default:
+		return FinishReasonOther
+	}
+}
+
+// anthropicBlockType returns the content block type used to send files of the specified mime type, or an empty string if it is unsupported
+func anthropicBlockType(mimeType string) string {
+	switch {
+	case resource.IsText(mimeType):
+		return anthropic.BlockTypeText
+	case mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif" || mimeType == "image/webp":
+		return anthropic.BlockTypeImage
+	case mimeType == "application/pdf":
+		return anthropic.BlockTypeDocument
+	default:
+		return ""
+	}
+}
+
+// anthropicMessage converts the specified message to its messages api representation
+func anthropicMessage(cfg Config, message Message) anthropic.Message {
+	role := anthropic.RoleUser
+
+	if message.Role == RoleModel {
+		role = anthropic.RoleAssistant
+	}
+
+	blocks := []anthropic.Block{}
+
+	if message.Text != "" {
+		blocks = append(blocks, anthropic.Block{Type: anthropic.BlockTypeText, Text: message.Text})
+	}
+
+	for _, fileReference := range message.Files {
+		text, data, ok := readLocal(cfg, fileReference)
+
+		switch {
+		case !ok:
+			continue
+		case text != "":
+			blocks = append(blocks, anthropic.Block{Type: anthropic.BlockTypeText, Text: text})
+		default:
+			blocks = append(blocks, anthropic.Block{
+				Type:   anthropicBlockType(fileReference.MIMEType),
+				Source: &anthropic.Source{Type: "base64", MediaType: fileReference.MIMEType, Data: data},
+			})
+		}
+	}
+
+	for _, functionCall := range message.FunctionCalls {
+		input := functionCall.Args
+		if len(input) == 0 {
+			input = json.RawMessage("{}")
+		}
+		blocks = append(blocks, anthropic.Block{Type: anthropic.BlockTypeToolUse, ID: functionCall.ID, Name: functionCall.Name, Input: input})
+	}
+
+	for _, functionResponse := range message.FunctionResponses {
+		blocks = append(blocks, anthropic.Block{Type: anthropic.BlockTypeToolResult, ToolUseID: functionResponse.ID, Content: string(functionResponse.Response)})
+	}
+
+	if len(blocks) == 0 {
+		blocks = append(blocks, anthropic.Block{Type: anthropic.BlockTypeText, Text: "..."}) // empty content is rejected by the messages api
+	}
+
+	return anthropic.Message{Role: role, Content: blocks}
+}
+
+// anthropicInputSchema returns the specified tool parameters, or an empty object schema if none are defined, as the messages api requires one
+func anthropicInputSchema(parameters json.RawMessage) json.RawMessage {
+	if len(parameters) == 0 {
+		return json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+
+	return parameters
+}
+
+// anthropicResponseSchema returns the specified response schema in a form that can be used as a tool input schema. as these must
+// describe objects, any other schema is wrapped as the single property of an object, which is indicated by wrapped being true
+func anthropicResponseSchema(responseSchema string) (inputSchema json.RawMessage, wrapped bool) {
+	definition := struct {
+		Type string `json:"type"`
+	}{}
+
+	if err := json.Unmarshal([]byte(responseSchema), &definition); err == nil && definition.Type == "object" {
+		return json.RawMessage(responseSchema), false
+	}
+
+	return json.RawMessage(fmt.Sprintf(`{"type":"object","properties":{"response":%s},"required":["response"]}`, responseSchema)), true
+}
+
+// anthropicStructuredResponse returns the json response provided as input to the respond tool, unwrapping it if required
+func anthropicStructuredResponse(input json.RawMessage, wrapped bool) string {
+	if !wrapped {
+		return string(input)
+	}
+
+	response := struct {
+		Response json.RawMessage `json:"response"`
+	}{}
+
+	if err := json.Unmarshal(input, &response); err != nil {
+		return string(input)
+	}
+
+	return string(response.Response)
+}
+
+// anthropicStream reads a streamed messages response, passing each text delta to cfg.Stream as it arrives.
+// the deltas are merged into a single response equivalent to that which a non-streamed request would have returned
+func anthropicStream(cfg Config, stream io.Reader) (anthropic.Response, error) {
+	response := anthropic.Response{}
+	inputs := map[int]*strings.Builder{}
+
+	err := readEvents(stream, func(data []byte) error {
+		cfg.DebugPrintf("received messages chunk", "type", "stream_generate_chunk", "chunk", string(data))
+
+		event := anthropic.Event{}
+
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("unable to parse response chunk. %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			response.Usage = event.Message.Usage
+		case "content_block_start":
+			if event.Index < 0 || event.Index > maxStreamIndex {
+				return fmt.Errorf("unexpected content block start for index %v", event.Index)
+			}
+			for len(response.Content) <= event.Index {
+				response.Content = append(response.Content, anthropic.Block{})
+			}
+			response.Content[event.Index] = event.ContentBlock
+			inputs[event.Index] = &strings.Builder{}
+		case "content_block_delta":
+			if event.Index < 0 || event.Index >= len(response.Content) || inputs[event.Index] == nil { // the block was never started
+				return fmt.Errorf("unexpected content block delta for index %v", event.Index)
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				cfg.Stream(event.Delta.Text)
+				response.Content[event.Index].Text += event.Delta.Text
+			case "input_json_delta":
+				inputs[event.Index].WriteString(event.Delta.PartialJSON)
+			}
+		case "content_block_stop":
+			if event.Index < 0 || event.Index >= len(response.Content) || inputs[event.Index] == nil { // the block was never started
+				return fmt.Errorf("unexpected content block stop for index %v", event.Index)
+			}
+			if input := inputs[event.Index]; input.Len() > 0 {
+				response.Content[event.Index].Input = json.RawMessage(input.String())
+			}
+		case "message_delta":
+			response.StopReason = event.Delta.StopReason
+			response.Usage.OutputTokens = event.Usage.OutputTokens
+		case "error":
+			return fmt.Errorf("error returned in response stream. %s", data)
+		}
+
+		return nil
+	})
+
+	return response, err
+}
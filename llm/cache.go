@@ -0,0 +1,214 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/llm/internal/schema"
+)
+
+type (
+	// Cache describes a named gemini api context cache, which holds a system prompt and a set of files that can be
+	// referenced by many prompts without being resent, or billed at the full rate, each time
+	Cache struct {
+		Name    string
+		ID      string
+		Model   string
+		Tokens  int
+		Expires time.Time
+	}
+)
+
+// CreateCache uploads the specified files and creates a cache of them, and the configured system prompt, with the specified name and time to live.
+// The cache can only be used with the configured model
+func CreateCache(ctx context.Context, cfg Config, name string, files []string, ttl time.Duration) (Cache, error) {
+	if name == "" {
+		return Cache{}, fmt.Errorf("invalid cache request. a cache name must be specified")
+	}
+
+	if err := validateCache(cfg); err != nil {
+		return Cache{}, err
+	}
+
+	if _, err := findCache(ctx, cfg, name); err == nil {
+		return Cache{}, fmt.Errorf("invalid cache name '%v'. a cache with that name already exists", name)
+	}
+
+	fileReferences, err := geminiProvider{}.attach(ctx, cfg, files)
+
+	if err != nil {
+		return Cache{}, err
+	}
+
+	cachedContent := schema.CachedContent{
+		DisplayName: name,
+		Model:       "models/" + cfg.Model,
+		SystemInstruction: &schema.SystemInstruction{
+			Parts: []schema.Part{{Text: systemPrompt(cfg)}},
+		},
+		TTL: cacheTTL(ttl),
+	}
+
+	if len(fileReferences) > 0 {
+		cachedContent.Contents = []schema.Content{messageContent(Message{Role: RoleUser, Files: fileReferences})}
+	}
+
+	body, err := json.Marshal(cachedContent)
+
+	if err != nil {
+		return Cache{}, fmt.Errorf("unable to encode cache request as json. %w", err)
+	}
+
+	if err := sendResource(ctx, cfg, http.MethodPost, cacheURL(cfg, "cachedContents"), body, &cachedContent); err != nil {
+		return Cache{}, fmt.Errorf("unable to create cache '%v'. %w", name, err)
+	}
+
+	return newCache(cachedContent), nil
+}
+
+// ListCaches returns all caches that have not yet expired
+func ListCaches(ctx context.Context, cfg Config) ([]Cache, error) {
+	if err := validateCache(cfg); err != nil {
+		return nil, err
+	}
+
+	caches, pageToken := []Cache{}, ""
+
+	for {
+		u := cacheURL(cfg, "cachedContents")
+
+		if pageToken != "" {
+			u += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+
+		list := schema.CachedContentList{}
+
+		if err := sendResource(ctx, cfg, http.MethodGet, u, nil, &list); err != nil {
+			return nil, fmt.Errorf("unable to list caches. %w", err)
+		}
+
+		for _, cachedContent := range list.CachedContents {
+			caches = append(caches, newCache(cachedContent))
+		}
+
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return caches, nil
+		}
+	}
+}
+
+// ExtendCache sets the expiry of the named cache to the specified time to live from now
+func ExtendCache(ctx context.Context, cfg Config, name string, ttl time.Duration) (Cache, error) {
+	if name == "" {
+		return Cache{}, fmt.Errorf("invalid cache request. a cache name must be specified")
+	}
+
+	if err := validateCache(cfg); err != nil {
+		return Cache{}, err
+	}
+
+	cache, err := findCache(ctx, cfg, name)
+
+	if err != nil {
+		return Cache{}, err
+	}
+
+	body, err := json.Marshal(schema.CachedContent{TTL: cacheTTL(ttl)})
+
+	if err != nil {
+		return Cache{}, fmt.Errorf("unable to encode cache request as json. %w", err)
+	}
+
+	cachedContent := schema.CachedContent{}
+
+	if err := sendResource(ctx, cfg, http.MethodPatch, cacheURL(cfg, cache.ID)+"&updateMask=ttl", body, &cachedContent); err != nil {
+		return Cache{}, fmt.Errorf("unable to extend cache '%v'. %w", name, err)
+	}
+
+	return newCache(cachedContent), nil
+}
+
+// DeleteCache deletes the named cache
+func DeleteCache(ctx context.Context, cfg Config, name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid cache request. a cache name must be specified")
+	}
+
+	if err := validateCache(cfg); err != nil {
+		return err
+	}
+
+	cache, err := findCache(ctx, cfg, name)
+
+	if err != nil {
+		return err
+	}
+
+	if err := sendResource(ctx, cfg, http.MethodDelete, cacheURL(cfg, cache.ID), nil, nil); err != nil {
+		return fmt.Errorf("unable to delete cache '%v'. %w", name, err)
+	}
+
+	return nil
+}
+
+// findCache returns the cache with the specified name
+func findCache(ctx context.Context, cfg Config, name string) (Cache, error) {
+	caches, err := ListCaches(ctx, cfg)
+
+	if err != nil {
+		return Cache{}, err
+	}
+
+	for _, cache := range caches {
+		if cache.Name == name {
+			return cache, nil
+		}
+	}
+
+	return Cache{}, fmt.Errorf("invalid cache name '%v'. no cache with that name exists", name)
+}
+
+// validateCache returns an error if the configuration does not support caches
+func validateCache(cfg Config) error {
+	if cfg.Provider != "" && cfg.Provider != ProviderGemini {
+		return fmt.Errorf("invalid provider '%v'. caches are only supported by the gemini provider", cfg.Provider)
+	}
+
+	if cfg.CacheURL == "" {
+		return fmt.Errorf("invalid cache request. a cache url must be specified")
+	}
+
+	return nil
+}
+
+// cacheURL returns the configured cache url for the specified resource, such as 'cachedContents' or 'cachedContents/{id}'
+func cacheURL(cfg Config, resource string) string {
+	return fmt.Sprintf(cfg.CacheURL, resource, cfg.APIKey)
+}
+
+// cacheTTL formats the specified time to live as the gemini api expects
+func cacheTTL(ttl time.Duration) string {
+	return fmt.Sprintf("%vs", int(ttl.Seconds()))
+}
+
+// newCache converts the specified gemini api cached content to its provider-agnostic equivalent
+func newCache(cachedContent schema.CachedContent) Cache {
+	cache := Cache{
+		Name:  cachedContent.DisplayName,
+		ID:    cachedContent.Name,
+		Model: strings.TrimPrefix(cachedContent.Model, "models/"),
+	}
+
+	if cachedContent.UsageMetadata != nil {
+		cache.Tokens = cachedContent.UsageMetadata.TotalTokenCount
+	}
+
+	cache.Expires, _ = time.Parse(time.RFC3339Nano, cachedContent.ExpireTime)
+
+	return cache
+}
@@ -0,0 +1,128 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+type (
+	// Compaction defines how the history sent with a prompt is reduced when it exceeds a token budget
+	Compaction struct {
+		// Budget is the estimated number of tokens of history above which it is compacted. zero disables compaction
+		Budget int
+		// Strategy is either CompactionSummarise or CompactionWindow. CompactionSummarise is used if none is specified
+		Strategy string
+	}
+)
+
+const (
+	// CompactionSummarise replaces the oldest exchanges of the history with a summary of them, written by the model
+	CompactionSummarise = "summarise"
+	// CompactionWindow removes the oldest exchanges of the history, so that only the most recent are sent
+	CompactionWindow = "window"
+)
+
+const (
+	bytesPerToken      = 4 // a rough mapping of bytes of text to tokens, sufficient to estimate the size of the history
+	compactionPrompt   = "Summarise the conversation so far, so that the summary can replace it as the context of the rest of the conversation. Include all facts, decisions, names, file contents and open questions that may be relevant to later prompts. Respond with only the summary."
+	summaryPrefix      = "The following is a summary of the earlier part of our conversation, which has been removed to save space:\n\n"
+	summaryAcknowledge = "Understood. I will use that summary as the context of the earlier part of our conversation."
+)
+
+// compact returns the specified history reduced in accordance with the configured compaction, along with the messages that were removed
+// from it and the number of tokens used to summarise them. Only whole exchanges, from a prompt to its final response, are removed, oldest
+// first, so that function calls are never separated from their responses. When summarising, the history is reduced to half of the budget,
+// so that it is not summarised again with every subsequent prompt
+func compact(ctx context.Context, cfg Config, provider provider, history []Message) ([]Message, []Message, int, error) {
+	strategy, budget := cfg.Compaction.Strategy, cfg.Compaction.Budget
+
+	switch strategy {
+	case "", CompactionSummarise:
+		strategy, budget = CompactionSummarise, budget/2
+	case CompactionWindow:
+	default:
+		return nil, nil, 0, fmt.Errorf("invalid compaction strategy '%v'. expected '%v' or '%v'", strategy, CompactionSummarise, CompactionWindow)
+	}
+
+	if cfg.Compaction.Budget <= 0 || estimateTokens(history) <= cfg.Compaction.Budget {
+		return history, nil, 0, nil
+	}
+
+	exchanges := splitExchanges(history)
+	i := 0
+
+	for i < len(exchanges) && estimateTokens(slices.Concat(exchanges[i:]...)) > budget {
+		i++
+	}
+
+	retained, archived := append([]Message{}, slices.Concat(exchanges[i:]...)...), slices.Concat(exchanges[:i]...) // an empty history is not nil, so it replaces that of the session
+
+	cfg.DebugPrintf("history compacted", "type", "compaction", "strategy", strategy, "archived_messages", len(archived), "retained_messages", len(retained))
+
+	if strategy == CompactionWindow {
+		return retained, archived, 0, nil
+	}
+
+	cfg.Grounding, cfg.Stream = false, nil // the summary is not part of the response, so is not streamed
+
+	rs, err := provider.generate(ctx, cfg, request{
+		SystemPrompt: systemPrompt(cfg),
+		Messages:     append(slices.Clone(archived), Message{Role: RoleUser, Text: compactionPrompt}),
+	})
+
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("unable to summarise history. %w", err)
+	}
+
+	if rs.FinishReason != FinishReasonStop || rs.Message.Text == "" {
+		return nil, nil, 0, fmt.Errorf("unable to summarise history. no summary was returned. finish reason: %v", rs.FinishReason)
+	}
+
+	summary := []Message{
+		{Role: RoleUser, Text: summaryPrefix + rs.Message.Text},
+		{Role: RoleModel, Text: summaryAcknowledge},
+	}
+
+	return append(summary, retained...), archived, rs.Tokens, nil
+}
+
+// splitExchanges divides the specified messages into exchanges, each beginning with a prompt from the user and including any function
+// calls and responses that followed it, up to the next prompt
+func splitExchanges(messages []Message) [][]Message {
+	exchanges := [][]Message{}
+
+	for _, message := range messages {
+		if len(exchanges) == 0 || (message.Role == RoleUser && len(message.FunctionResponses) == 0) {
+			exchanges = append(exchanges, []Message{})
+		}
+
+		exchanges[len(exchanges)-1] = append(exchanges[len(exchanges)-1], message)
+	}
+
+	return exchanges
+}
+
+// estimateTokens returns a rough estimate of the number of tokens the specified messages will consume. files that are not sent inline
+// are not included, as their size is not known
+func estimateTokens(messages []Message) int {
+	size := 0
+
+	for _, message := range messages {
+		size += len(message.Text)
+
+		for _, file := range message.Files {
+			size += len(file.Data)
+		}
+
+		for _, functionCall := range message.FunctionCalls {
+			size += len(functionCall.Args)
+		}
+
+		for _, functionResponse := range message.FunctionResponses {
+			size += len(functionResponse.Response)
+		}
+	}
+
+	return size / bytesPerToken
+}
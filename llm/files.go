@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/llm/internal/resource"
+	"github.com/comradequinn/gen/llm/internal/schema"
+)
+
+type (
+	// RemoteFile describes a file held by the gemini files api, such as one uploaded when attached to a prompt
+	RemoteFile struct {
+		ID       string
+		Name     string
+		URI      string
+		MIMEType string
+		Size     int64
+		Expires  time.Time
+	}
+)
+
+// ListRemoteFiles returns all files held by the gemini files api that have not yet expired
+func ListRemoteFiles(ctx context.Context, cfg Config) ([]RemoteFile, error) {
+	if err := validateFiles(cfg); err != nil {
+		return nil, err
+	}
+
+	files, pageToken := []RemoteFile{}, ""
+
+	for {
+		u := filesURL(cfg, "files")
+
+		if pageToken != "" {
+			u += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+
+		list := schema.FileList{}
+
+		if err := sendResource(ctx, cfg, http.MethodGet, u, nil, &list); err != nil {
+			return nil, fmt.Errorf("unable to list remote files. %w", err)
+		}
+
+		for _, file := range list.Files {
+			files = append(files, newRemoteFile(file))
+		}
+
+		if pageToken = list.NextPageToken; pageToken == "" {
+			return files, nil
+		}
+	}
+}
+
+// DeleteRemoteFile deletes the specified file from the gemini files api and removes it from the upload index, so that it is not reused.
+// The file may be specified by its id, such as 'files/abc123', or its uri
+func DeleteRemoteFile(ctx context.Context, cfg Config, file string) error {
+	if file == "" {
+		return fmt.Errorf("invalid remote file request. a file must be specified")
+	}
+
+	if err := validateFiles(cfg); err != nil {
+		return err
+	}
+
+	id := "files/" + file
+
+	if i := strings.LastIndex(file, "files/"); i != -1 {
+		id = file[i:]
+	}
+
+	if err := sendResource(ctx, cfg, http.MethodDelete, filesURL(cfg, id), nil, nil); err != nil {
+		return fmt.Errorf("unable to delete remote file '%v'. %w", file, err)
+	}
+
+	if cfg.UploadIndex == "" {
+		return nil
+	}
+
+	if err := resource.Forget(cfg.UploadIndex, id); err != nil {
+		return fmt.Errorf("unable to remove remote file '%v' from the upload index. %w", file, err)
+	}
+
+	return nil
+}
+
+// Uploads returns the uris of the files recorded in the configured upload index, being those uploaded, and not since deleted, by this app
+func Uploads(cfg Config) []string {
+	if cfg.UploadIndex == "" {
+		return nil
+	}
+
+	return resource.URIs(cfg.UploadIndex)
+}
+
+// validateFiles returns an error if the configuration does not support remote file management
+func validateFiles(cfg Config) error {
+	if cfg.Provider != "" && cfg.Provider != ProviderGemini {
+		return fmt.Errorf("invalid provider '%v'. remote files are only supported by the gemini provider", cfg.Provider)
+	}
+
+	if cfg.FilesURL == "" {
+		return fmt.Errorf("invalid remote file request. a files url must be specified")
+	}
+
+	return nil
+}
+
+// filesURL returns the configured files url for the specified resource, such as 'files' or 'files/{id}'
+func filesURL(cfg Config, resource string) string {
+	return fmt.Sprintf(cfg.FilesURL, resource, cfg.APIKey)
+}
+
+// newRemoteFile converts the specified gemini api file to its provider-agnostic equivalent
+func newRemoteFile(file schema.File) RemoteFile {
+	remoteFile := RemoteFile{
+		ID:       file.Name,
+		Name:     file.DisplayName,
+		URI:      file.URI,
+		MIMEType: file.MIMEType,
+	}
+
+	remoteFile.Size, _ = strconv.ParseInt(file.SizeBytes, 10, 64)
+	remoteFile.Expires, _ = time.Parse(time.RFC3339Nano, file.ExpirationTime)
+
+	return remoteFile
+}
@@ -0,0 +1,493 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/comradequinn/gen/llm/internal/resource"
+	"github.com/comradequinn/gen/llm/internal/schema"
+)
+
+// geminiProvider is the provider for the google gemini api
+type geminiProvider struct{}
+
+// attach uploads the specified files concurrently, with at most cfg.UploadConcurrency uploads in progress at once. if any upload fails, those
+// in progress are cancelled, those not yet started are skipped and every failure is reported in the returned error.
+//
+// files no larger than cfg.InlineMaxBytes are not uploaded, but are instead included in the request as inline data, until their total
+// size reaches maxInlineBytes
+func (geminiProvider) attach(ctx context.Context, cfg Config, files []string) ([]FileReference, error) {
+	if len(files) == 0 {
+		return []FileReference{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		fileReferences = make([]FileReference, len(files))
+		errs           = make([]error, len(files))
+		slots          = make(chan struct{}, max(cfg.UploadConcurrency, 1))
+		wg             = sync.WaitGroup{}
+		mu             = sync.Mutex{}
+		completed      = 0
+		inline         = make([]bool, len(files))
+		inlineBytes    = int64(0)
+	)
+
+	for i, f := range files {
+		if info, err := resource.Deps.OS_Stat(f); err == nil && cfg.InlineMaxBytes > 0 && info.Size() <= cfg.InlineMaxBytes && inlineBytes+info.Size() <= maxInlineBytes {
+			inline[i], inlineBytes = true, inlineBytes+info.Size()
+		}
+	}
+
+	for i, f := range files {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+
+			if errs[i] = ctx.Err(); errs[i] != nil {
+				return
+			}
+
+			if inline[i] {
+				fileReferences[i], errs[i] = inlineFile(f)
+			} else {
+				fileReferences[i], errs[i] = upload(ctx, cfg, f)
+			}
+
+			if errs[i] != nil {
+				cancel()
+				return
+			}
+
+			if cfg.UploadProgress != nil {
+				mu.Lock()
+				completed++
+				cfg.UploadProgress(f, completed, len(files))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	failures := []error{}
+
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			failures = append(failures, fmt.Errorf("unable to attach file '%v'. %w", files[i], err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("%v of %v file attachments failed.\n%w", len(failures), len(files), errors.Join(failures...))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err // the uploads were cancelled by the caller
+		}
+	}
+
+	return fileReferences, nil
+}
+
+// inlineFile returns a reference to the specified file that holds its content, so that it can be sent as inline data
+func inlineFile(file string) (FileReference, error) {
+	resourceRef, data, err := resource.Read(file)
+
+	if err != nil {
+		return FileReference{}, err
+	}
+
+	path, err := filepath.Abs(file)
+
+	if err != nil {
+		return FileReference{}, fmt.Errorf("invalid filepath '%v'. %w", file, err)
+	}
+
+	return FileReference{
+		MIMEType: resourceRef.MIMEType,
+		Label:    resourceRef.Label,
+		Path:     path,
+		Hash:     resourceRef.Hash,
+		Data:     data,
+	}, nil
+}
+
+// upload sends the specified file to the gemini files api and returns a reference to it
+func upload(ctx context.Context, cfg Config, file string) (FileReference, error) {
+	resourceRef, err := resource.Upload(ctx, resource.UploadRequest{
+		URL:   cfg.UploadURL,
+		Key:   cfg.APIKey,
+		File:  file,
+		Retry: cfg.Retry,
+		Index: cfg.UploadIndex,
+	}, cfg.DebugPrintf)
+
+	if err != nil {
+		return FileReference{}, err
+	}
+
+	path, err := filepath.Abs(file)
+
+	if err != nil {
+		return FileReference{}, fmt.Errorf("invalid filepath '%v'. %w", file, err)
+	}
+
+	return FileReference{
+		URI:      resourceRef.URI,
+		MIMEType: resourceRef.MIMEType,
+		Label:    resourceRef.Label,
+		Path:     path,
+		Hash:     resourceRef.Hash,
+		Expires:  resourceRef.Expires,
+	}, nil
+}
+
+// refreshFiles returns the specified history with any references to uploaded files that have expired, or will soon, replaced by new uploads
+// of the same files. references to files that are no longer available locally, or whose content has changed, are removed and described by
+// the returned warnings. references without an expiry, which were recorded by earlier versions, cannot be checked and are left unchanged
+func refreshFiles(ctx context.Context, cfg Config, history []Message) ([]Message, []string, error) {
+	refreshed, warnings := slices.Clone(history), []string(nil)
+
+	for i, message := range refreshed {
+		files := make([]FileReference, 0, len(message.Files))
+
+		for _, fileReference := range message.Files {
+			if fileReference.URI == "" || fileReference.Expires.IsZero() || time.Until(fileReference.Expires) >= resource.ExpiryMargin {
+				files = append(files, fileReference)
+				continue
+			}
+
+			mimeType, err := resource.MIMEType(fileReference.Path)
+			hash := ""
+
+			if err == nil {
+				hash, err = resource.Hash(fileReference.Path, mimeType)
+			}
+
+			switch {
+			case fileReference.Path == "" || err != nil:
+				warnings = append(warnings, fmt.Sprintf("the upload of '%v' has expired and the file is no longer available, so it has been removed from the session", fileReference.Label))
+				continue
+			case fileReference.Hash != "" && hash != fileReference.Hash:
+				warnings = append(warnings, fmt.Sprintf("the upload of '%v' has expired and the file has since changed, so it has been removed from the session. attach it again to include its current content", fileReference.Label))
+				continue
+			}
+
+			cfg.DebugPrintf("re-uploading expired file", "type", "refresh_upload", "path", fileReference.Path, "expired", fileReference.Expires)
+
+			uploaded, err := upload(ctx, cfg, fileReference.Path)
+
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to upload file '%v' to gemini api. %w", fileReference.Path, err)
+			}
+
+			files = append(files, uploaded)
+		}
+
+		refreshed[i].Files = files
+	}
+
+	return refreshed, warnings, nil
+}
+
+func (geminiProvider) generate(ctx context.Context, cfg Config, rq request) (result, error) {
+	contents := make([]schema.Content, 0, len(rq.Messages))
+
+	for _, message := range rq.Messages {
+		contents = append(contents, messageContent(message))
+	}
+
+	tools := []schema.Tool{}
+
+	if cfg.Grounding {
+		tools = []schema.Tool{
+			{GoogleSearch: &schema.GoogleSearch{}},
+		}
+	}
+
+	if len(cfg.Tools) > 0 {
+		declarations := make([]schema.FunctionDeclaration, 0, len(cfg.Tools))
+
+		for _, tool := range cfg.Tools {
+			declarations = append(declarations, schema.FunctionDeclaration{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			})
+		}
+
+		tools = []schema.Tool{
+			{FunctionDeclarations: declarations},
+		}
+	}
+
+	generationConfig := schema.GenerationConfig{
+		Temperature:     cfg.Temperature,
+		TopP:            cfg.TopP,
+		MaxOutputTokens: cfg.MaxTokens,
+	}
+
+	generationConfig.ResponseMimeType = "text/plain"
+
+	if rq.Schema != "" {
+		generationConfig.ResponseMimeType = "application/json"
+		generationConfig.ResponseSchema = json.RawMessage(rq.Schema)
+	}
+
+	geminiRequest := schema.Request{
+		SystemInstruction: &schema.SystemInstruction{
+			Parts: []schema.Part{{Text: rq.SystemPrompt}},
+		},
+		Contents:         contents,
+		Tools:            tools,
+		GenerationConfig: generationConfig,
+	}
+
+	if rq.Cache != "" { // the system prompt is held by the cache and the gemini api rejects requests that also specify one
+		geminiRequest.CachedContent = rq.Cache
+		geminiRequest.SystemInstruction = nil
+	}
+
+	request := bytes.Buffer{}
+	if err := json.NewEncoder(&request).Encode(geminiRequest); err != nil {
+		return result{}, fmt.Errorf("unable to encode llm request as json. %w", err)
+	}
+
+	var (
+		response schema.Response
+		err      error
+	)
+
+	if cfg.Stream != nil {
+		response, err = streamGenerate(ctx, cfg, &request)
+	} else {
+		response, err = generate(ctx, cfg, &request)
+	}
+
+	if err != nil {
+		return result{}, err
+	}
+
+	if len(response.Candidates) == 0 {
+		if response.PromptFeedback != nil && response.PromptFeedback.BlockReason != "" {
+			return result{
+				Message:      Message{Role: RoleModel},
+				Tokens:       response.UsageMetadata.TotalTokenCount,
+				FinishReason: FinishReasonSafety,
+				FinishDetail: "prompt blocked: " + response.PromptFeedback.BlockReason,
+			}, nil
+		}
+
+		return result{}, fmt.Errorf("no response candidates returned. response: %+v", response)
+	}
+
+	message := Message{Role: RoleModel}
+
+	for _, part := range response.Candidates[0].Content.Parts {
+		message.Text += part.Text
+		if part.FunctionCall != nil {
+			message.FunctionCalls = append(message.FunctionCalls, FunctionCall{ID: part.FunctionCall.ID, Name: part.FunctionCall.Name, Args: part.FunctionCall.Args})
+		}
+	}
+
+	message.Grounding = geminiGrounding(response.Candidates[0].GroundingMetadata)
+
+	return result{
+		Message:      message,
+		Tokens:       response.UsageMetadata.TotalTokenCount,
+		CachedTokens: response.UsageMetadata.CachedContentTokenCount,
+		FinishReason: geminiFinishReason(response.Candidates[0].FinishReason),
+		FinishDetail: response.Candidates[0].FinishReason,
+	}, nil
+}
+
+// geminiGrounding maps the specified gemini api grounding metadata to its provider-agnostic equivalent
+func geminiGrounding(metadata *schema.GroundingMetadata) *Grounding {
+	if metadata == nil || (len(metadata.GroundingChunks) == 0 && len(metadata.WebSearchQueries) == 0) {
+		return nil
+	}
+
+	grounding := &Grounding{Queries: metadata.WebSearchQueries}
+
+	for _, chunk := range metadata.GroundingChunks {
+		source := Source{}
+		if chunk.Web != nil {
+			source = Source{URI: chunk.Web.URI, Title: chunk.Web.Title}
+		}
+		grounding.Sources = append(grounding.Sources, source)
+	}
+
+	for _, support := range metadata.GroundingSupports {
+		grounding.Supports = append(grounding.Supports, Support{
+			Start:   support.Segment.StartIndex,
+			End:     support.Segment.EndIndex,
+			Text:    support.Segment.Text,
+			Sources: support.GroundingChunkIndices,
+		})
+	}
+
+	return grounding
+}
+
+// geminiFinishReason maps the specified gemini api finish reason to its provider-agnostic equivalent
+func geminiFinishReason(finishReason string) FinishReason {
+	switch finishReason {
+	case schema.FinishReasonStop:
+		return FinishReasonStop
+	case schema.FinishReasonMaxTokens:
+		return FinishReasonMaxTokens
+	case schema.FinishReasonSafety, schema.FinishReasonBlocklist, schema.FinishReasonProhibitedContent, schema.FinishReasonSPII, schema.FinishReasonImageSafety:
+		return FinishReasonSafety
+	case schema.FinishReasonRecitation:
+		return FinishReasonRecitation
+	default:
+		return FinishReasonOther
+	}
+}
+
+// messageContent converts the specified message to its gemini api representation
+func messageContent(message Message) schema.Content {
+	content := schema.Content{Role: string(message.Role)}
+
+	if message.Text != "" || (len(message.FunctionCalls) == 0 && len(message.FunctionResponses) == 0) {
+		content.Parts = append(content.Parts, schema.Part{Text: message.Text})
+	}
+
+	for _, fileReference := range message.Files {
+		switch {
+		case len(fileReference.Data) > 0:
+			content.Parts = append(content.Parts, schema.Part{
+				InlineData: &schema.InlineData{MIMEType: fileReference.MIMEType, Data: fileReference.Data},
+			})
+		case fileReference.URI != "":
+			content.Parts = append(content.Parts, schema.Part{
+				File: &schema.FileData{URI: fileReference.URI, MIMEType: fileReference.MIMEType},
+			})
+		} // otherwise, the file was attached using another provider and has not been uploaded to the gemini api
+	}
+
+	for _, functionCall := range message.FunctionCalls {
+		content.Parts = append(content.Parts, schema.Part{
+			FunctionCall: &schema.FunctionCall{ID: functionCall.ID, Name: functionCall.Name, Args: functionCall.Args},
+		})
+	}
+
+	for _, functionResponse := range message.FunctionResponses {
+		content.Parts = append(content.Parts, schema.Part{
+			FunctionResponse: &schema.FunctionResponse{ID: functionResponse.ID, Name: functionResponse.Name, Response: functionResponse.Response},
+		})
+	}
+
+	return content
+}
+
+// generate sends the request to the generate endpoint and returns the complete response
+func generate(ctx context.Context, cfg Config, request *bytes.Buffer) (schema.Response, error) {
+	url := fmt.Sprintf(cfg.APIURL, cfg.Model, cfg.APIKey)
+	cfg.DebugPrintf("sending generate request", "type", "generate_request", "url", url, "request", request.String())
+
+	rs, err := post(ctx, cfg, url, nil, request.Bytes())
+
+	if err != nil {
+		return schema.Response{}, err
+	}
+
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+
+	if err != nil {
+		return schema.Response{}, fmt.Errorf("unable to read response body. %w", err)
+	}
+
+	cfg.DebugPrintf("received generate response", "type", "generate_response", "status", rs.Status, "request", string(body))
+
+	response := schema.Response{}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return schema.Response{}, fmt.Errorf("unable to parse response body. %w", err)
+	}
+
+	return response, nil
+}
+
+// streamGenerate sends the request to the streaming endpoint, passing each text chunk to cfg.Stream as it arrives.
+// the chunks are merged into a single response equivalent to that which generate would have returned
+func streamGenerate(ctx context.Context, cfg Config, request *bytes.Buffer) (schema.Response, error) {
+	url := fmt.Sprintf(cfg.StreamURL, cfg.Model, cfg.APIKey)
+	cfg.DebugPrintf("sending stream generate request", "type", "stream_generate_request", "url", url, "request", request.String())
+
+	rs, err := post(ctx, cfg, url, nil, request.Bytes())
+
+	if err != nil {
+		return schema.Response{}, err
+	}
+
+	defer rs.Body.Close()
+
+	response := schema.Response{Candidates: []schema.Candidate{{Content: schema.Content{Role: RoleModel}}}}
+
+	err = readEvents(rs.Body, func(data []byte) error {
+		cfg.DebugPrintf("received stream generate chunk", "type", "stream_generate_chunk", "chunk", string(data))
+
+		chunk := schema.Response{}
+
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("unable to parse response chunk. %w", err)
+		}
+
+		if chunk.UsageMetadata.TotalTokenCount > 0 {
+			response.UsageMetadata = chunk.UsageMetadata
+		}
+
+		if len(chunk.Candidates) == 0 {
+			return nil
+		}
+
+		candidate := &response.Candidates[0]
+
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if part.Text != "" {
+				cfg.Stream(part.Text)
+			}
+			candidate.Content.Parts = append(candidate.Content.Parts, part)
+		}
+
+		if chunk.Candidates[0].FinishReason != "" {
+			candidate.FinishReason = chunk.Candidates[0].FinishReason
+		}
+
+		if chunk.Candidates[0].GroundingMetadata != nil {
+			candidate.GroundingMetadata = chunk.Candidates[0].GroundingMetadata
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return schema.Response{}, err
+	}
+
+	return response, nil
+}
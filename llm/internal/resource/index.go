@@ -0,0 +1,172 @@
+package resource
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+)
+
+type (
+	// indexEntry records a file previously uploaded to the gemini files api
+	indexEntry struct {
+		URI      string    `json:"uri"`
+		MIMEType string    `json:"mimeType"`
+		Label    string    `json:"label"`
+		Expires  time.Time `json:"expires"`
+	}
+)
+
+const (
+	// uploadLifetime is how long the gemini files api retains an uploaded file, when it does not report an expiry itself
+	uploadLifetime = 48 * time.Hour
+	// ExpiryMargin is the remaining lifetime below which an uploaded file is not reused, so that it does not expire while still in use
+	ExpiryMargin = time.Hour
+)
+
+const lockFileSuffix = ".lock"
+
+var indexMutex sync.Mutex // serialises access to the upload index by concurrent uploads within a process; a file lock serialises processes
+
+// Hash returns a hash of the content and mime type of the specified file, which is also its key in the upload index
+func Hash(file, mimeType string) (string, error) {
+	f, err := Deps.OS_Open(file)
+
+	if err != nil {
+		return "", fmt.Errorf("unable to open file '%v' for hashing. %w", file, err)
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	h.Write([]byte(mimeType + "\x00"))
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("unable to read file '%v' for hashing. %w", file, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lookup returns the reference recorded in the specified upload index for the specified key, if it exists and will not expire imminently
+func lookup(indexFile, key string) (Reference, bool) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	entry, ok := readIndex(indexFile)[key]
+
+	if !ok || time.Until(entry.Expires) < ExpiryMargin {
+		return Reference{}, false
+	}
+
+	return Reference{URI: entry.URI, MIMEType: entry.MIMEType, Label: entry.Label, Hash: key, Expires: entry.Expires}, true
+}
+
+// record adds the specified reference to the specified upload index under the specified key. expired entries are removed
+func record(indexFile, key string, reference Reference) error {
+	return updateIndex(indexFile, func(index map[string]indexEntry) bool {
+		for k, entry := range index {
+			if time.Now().After(entry.Expires) {
+				delete(index, k)
+			}
+		}
+
+		index[key] = indexEntry{URI: reference.URI, MIMEType: reference.MIMEType, Label: reference.Label, Expires: reference.Expires}
+
+		return true
+	})
+}
+
+// updateIndex applies update to the entries of the specified upload index and, if update reports that it changed them, writes them back.
+// the index is reread and written while holding a lock on it, so that the changes of concurrent processes are merged, rather than one
+// overwriting those of another, and is written atomically, so that it is never read partially written
+func updateIndex(indexFile string, update func(index map[string]indexEntry) bool) error {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(indexFile), 0755); err != nil {
+		return fmt.Errorf("unable to create upload index directory. %w", err)
+	}
+
+	unlock, err := fsutil.Lock(indexFile + lockFileSuffix)
+
+	if err != nil {
+		return fmt.Errorf("unable to lock upload index. %w", err)
+	}
+
+	defer unlock()
+
+	index := readIndex(indexFile)
+
+	if !update(index) {
+		return nil
+	}
+
+	data, err := json.Marshal(index)
+
+	if err != nil {
+		return fmt.Errorf("unable to encode upload index. %w", err)
+	}
+
+	if err := fsutil.WriteFile(indexFile, data); err != nil {
+		return fmt.Errorf("unable to write upload index. %w", err)
+	}
+
+	return nil
+}
+
+// readIndex returns the entries of the specified upload index. a missing or unreadable index is treated as empty, as it is only an optimisation
+func readIndex(indexFile string) map[string]indexEntry {
+	index := map[string]indexEntry{}
+
+	data, err := os.ReadFile(indexFile)
+
+	if err != nil {
+		return index
+	}
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return map[string]indexEntry{}
+	}
+
+	return index
+}
+
+// URIs returns the uris of the uploads recorded in the specified upload index
+func URIs(indexFile string) []string {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	uris := []string{}
+
+	for _, entry := range readIndex(indexFile) {
+		uris = append(uris, entry.URI)
+	}
+
+	return uris
+}
+
+// Forget removes any entries for the specified files, identified in the form 'files/{id}', from the specified upload index, such as when
+// they have been deleted
+func Forget(indexFile string, ids ...string) error {
+	return updateIndex(indexFile, func(index map[string]indexEntry) bool {
+		count := len(index)
+
+		for k, entry := range index {
+			if slices.ContainsFunc(ids, func(id string) bool { return strings.HasSuffix(entry.URI, "/"+id) }) {
+				delete(index, k)
+			}
+		}
+
+		return len(index) != count
+	})
+}
@@ -0,0 +1,70 @@
+package resource
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+)
+
+func TestIndex(t *testing.T) {
+	indexFile := filepath.Join(t.TempDir(), "uploads")
+	expires := time.Now().Add(uploadLifetime)
+
+	wg := sync.WaitGroup{}
+
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := record(indexFile, fmt.Sprintf("test-key-%v", i), Reference{URI: fmt.Sprintf("test-uri/files/%v", i), Expires: expires}); err != nil {
+				t.Errorf("expected no error recording upload. got %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if uris := URIs(indexFile); len(uris) != 20 {
+		t.Fatalf("expected all concurrently recorded uploads to be retained. got %v", uris)
+	}
+
+	info, err := os.Stat(indexFile)
+
+	if err != nil {
+		t.Fatalf("expected no error reading upload index info. got %v", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the upload index to be created with mode 0600. got %v", info.Mode().Perm())
+	}
+
+	// an entry written by another process since the index was last read is merged, rather than overwritten
+	if err := os.WriteFile(indexFile, []byte(fmt.Sprintf(`{"test-other-key":{"uri":"test-uri/files/other","expires":%q}}`, expires.Format(time.RFC3339))), 0600); err != nil {
+		t.Fatalf("unable to write upload index. %v", err)
+	}
+
+	if err := record(indexFile, "test-key", Reference{URI: "test-uri/files/test", Expires: expires}); err != nil {
+		t.Fatalf("expected no error recording upload. got %v", err)
+	}
+
+	if _, ok := lookup(indexFile, "test-other-key"); !ok {
+		t.Fatalf("expected the entry written by another process to be retained")
+	}
+
+	if err := Forget(indexFile, "other"); err != nil {
+		t.Fatalf("expected no error forgetting upload. got %v", err)
+	}
+
+	if uris := URIs(indexFile); len(uris) != 1 || uris[0] != "test-uri/files/test" {
+		t.Fatalf("expected only the remaining upload to be listed. got %v", uris)
+	}
+
+	if temp, _ := filepath.Glob(filepath.Join(filepath.Dir(indexFile), fsutil.TempFilePrefix+"*")); len(temp) != 0 {
+		t.Fatalf("expected no temporary files to remain. got %v", temp)
+	}
+}
@@ -0,0 +1,119 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// mimeTypes maps file extensions to the mime types accepted by the gemini api. extensions of text files whose content needs no
+// special treatment, such as source code, are omitted and detected as text/plain by their content
+var mimeTypes = map[string]string{
+	// images
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".bmp":  "image/bmp",
+	".webp": "image/webp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".svg":  "image/svg+xml",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".ico":  "image/x-icon",
+	// audio
+	".wav":  "audio/wav",
+	".mp3":  "audio/mp3",
+	".aiff": "audio/aiff",
+	".aif":  "audio/aiff",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".flac": "audio/flac",
+	// video
+	".mp4":  "video/mp4",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpg",
+	".mov":  "video/mov",
+	".avi":  "video/avi",
+	".flv":  "video/x-flv",
+	".webm": "video/webm",
+	".wmv":  "video/wmv",
+	".3gp":  "video/3gpp",
+	// documents
+	".pdf":  "application/pdf",
+	".rtf":  "text/rtf",
+	".html": "text/html",
+	".htm":  "text/html",
+	".css":  "text/css",
+	".csv":  "text/csv",
+	".md":   "text/markdown",
+	".xml":  "text/xml",
+	".json": "application/json",
+	".js":   "text/javascript",
+	".ts":   "text/x-typescript",
+	".py":   "text/x-python",
+}
+
+// sniffedTypes maps the mime types detected from file content to those accepted by the gemini api, for files whose extension is not recognised
+var sniffedTypes = map[string]string{
+	"image/jpeg":      "image/jpeg",
+	"image/png":       "image/png",
+	"image/gif":       "image/gif",
+	"image/bmp":       "image/bmp",
+	"image/webp":      "image/webp",
+	"image/x-icon":    "image/x-icon",
+	"audio/wave":      "audio/wav",
+	"audio/mpeg":      "audio/mp3",
+	"audio/aiff":      "audio/aiff",
+	"application/ogg": "audio/ogg",
+	"video/mp4":       "video/mp4",
+	"video/webm":      "video/webm",
+	"video/avi":       "video/avi",
+	"application/pdf": "application/pdf",
+	"text/html":       "text/html",
+	"text/xml":        "text/xml",
+	"text/plain":      "text/plain",
+}
+
+// ErrUnsupportedType is returned by MIMEType for binary files of a type that cannot be attached
+var ErrUnsupportedType = errors.New("unsupported file type")
+
+// MIMEType returns the mime type of the specified file, based on its extension or, where that is not recognised, its content.
+// An error is returned for binary files of a type that is not supported, so that they are not sent as text
+func MIMEType(file string) (string, error) {
+	if mimeType := mimeTypes[strings.ToLower(filepath.Ext(file))]; mimeType != "" {
+		return mimeType, nil
+	}
+
+	f, err := Deps.OS_Open(file)
+
+	if err != nil {
+		return "", fmt.Errorf("unable to open file '%v' to detect its type. %w", file, err)
+	}
+
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, 512)) // the maximum number of bytes considered by http.DetectContentType
+
+	if err != nil {
+		return "", fmt.Errorf("unable to read file '%v' to detect its type. %w", file, err)
+	}
+
+	detected, _, _ := strings.Cut(http.DetectContentType(data), ";")
+
+	if mimeType := sniffedTypes[detected]; mimeType != "" {
+		return mimeType, nil
+	}
+
+	return "", fmt.Errorf("%w. '%v' appears to be a binary file of type '%v', which cannot be attached. convert it to text or pdf first", ErrUnsupportedType, file, detected)
+}
+
+// IsText reports whether files of the specified mime type contain text, which can be included directly in a prompt
+func IsText(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") || mimeType == "application/json" || mimeType == "image/svg+xml"
+}
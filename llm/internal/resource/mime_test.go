@@ -0,0 +1,60 @@
+package resource
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMIMEType(t *testing.T) {
+	content := map[string]string{}
+
+	Deps.OS_Open = func(name string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(content[name])), nil
+	}
+
+	testCases := []struct {
+		file     string
+		content  string
+		expected string
+		err      bool
+	}{
+		{file: "photo.JPG", expected: "image/jpeg"},
+		{file: "recording.mp3", expected: "audio/mp3"},
+		{file: "clip.mov", expected: "video/mov"},
+		{file: "report.pdf", expected: "application/pdf"},
+		{file: "data.csv", expected: "text/csv"},
+		{file: "config.json", expected: "application/json"},
+		{file: "main.go", content: "package main", expected: "text/plain"},
+		{file: "Makefile", content: "build:\n\tgo build", expected: "text/plain"},
+		{file: "empty", content: "", expected: "text/plain"},
+		{file: "screenshot", content: "\x89PNG\x0D\x0A\x1A\x0Atest-data", expected: "image/png"},
+		{file: "document", content: "%PDF-1.7 test-data", expected: "application/pdf"},
+		{file: "sound", content: "RIFF\x00\x00\x00\x00WAVEfmt test-data", expected: "audio/wav"},
+		{file: "report.docx", content: "PK\x03\x04test-data", err: true},
+		{file: "binary", content: "test\x00\x01\x02data", err: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.file, func(t *testing.T) {
+			content[tc.file] = tc.content
+
+			actual, err := MIMEType(tc.file)
+
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error for unsupported file. got %v", actual)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error. got %v", err)
+			}
+
+			if actual != tc.expected {
+				t.Fatalf("expected mime type to be %v. got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package resource
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,35 +10,28 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/llm/internal/retry"
 )
 
 type (
 	UploadRequest struct {
-		Key  string
-		URL  string
-		File string
+		Key   string
+		URL   string
+		File  string
+		Retry retry.Policy
+		Index string
 	}
 	Reference struct {
 		URI      string
 		MIMEType string
 		Label    string
+		Hash     string
+		Expires  time.Time
 	}
 )
 
-var mimeTypes = map[string]string{
-	".jpg":  "image/jpeg",
-	".jpeg": "image/jpeg",
-	".png":  "image/png",
-	".gif":  "image/gif",
-	".bmp":  "image/bmp",
-	".webp": "image/webp",
-	".svg":  "image/svg+xml",
-	".tif":  "image/tiff",
-	".tiff": "image/tiff",
-	".ico":  "image/x-icon",
-	".pdf":  "application/pdf",
-}
-
 var (
 	Deps = struct {
 		OS_Stat func(name string) (os.FileInfo, error)
@@ -48,34 +42,54 @@ var (
 	}
 )
 
-func Upload(uploadRequest UploadRequest, debugPrintf func(msg string, args ...any)) (Reference, error) {
-
-	contentType := mimeTypes[filepath.Ext(uploadRequest.File)]
-	if contentType == "" {
-		contentType = "text/plain"
-	}
+// Upload sends the specified file to the gemini files api and returns a reference to it. The upload is abandoned when the context is done.
+// When an attempt to send the file fails and is retried, the number of bytes the api has already received is queried, so that only the
+// remainder of the file is sent.
+//
+// When an index file is specified, a previous upload of the same content, with the same mime type, is reused in place of a new
+// upload, provided it is not due to expire imminently. New uploads are recorded in the index
+func Upload(ctx context.Context, uploadRequest UploadRequest, debugPrintf func(msg string, args ...any)) (Reference, error) {
 
 	fileInfo, err := Deps.OS_Stat(uploadRequest.File)
 	if err != nil {
 		return Reference{}, fmt.Errorf("invalid filepath. '%v' file does not exist. %w", uploadRequest.File, err)
 	}
 
-	url := fmt.Sprintf(uploadRequest.URL, uploadRequest.Key)
+	contentType, err := MIMEType(uploadRequest.File)
+	if err != nil {
+		return Reference{}, err
+	}
 
-	rq, err := http.NewRequest("POST", url, strings.NewReader(fmt.Sprintf(`{"file":{"display_name":"%v"}}`, fileInfo.Name())))
+	key, err := Hash(uploadRequest.File, contentType)
 	if err != nil {
-		return Reference{}, fmt.Errorf("unable to create start-upload request. %w", err)
+		return Reference{}, err
 	}
 
-	rq.Header.Set("X-Goog-Upload-Protocol", "resumable")
-	rq.Header.Set("X-Goog-Upload-Command", "start")
-	rq.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
-	rq.Header.Set("X-Goog-Upload-Header-Content-Type", contentType)
-	rq.Header.Set("Content-Type", "application/json")
+	if uploadRequest.Index != "" {
+		if reference, ok := lookup(uploadRequest.Index, key); ok {
+			debugPrintf("reusing previous upload", "type", "upload_reuse", "file", uploadRequest.File, "uri", reference.URI, "expires", reference.Expires)
+			return reference, nil
+		}
+	}
 
-	debugPrintf("sending start upload request", "type", "start_upload_request", "url", url, "headers", rq.Header)
+	url := fmt.Sprintf(uploadRequest.URL, uploadRequest.Key)
 
-	rs, err := http.DefaultClient.Do(rq)
+	rs, err := retry.Do(ctx, uploadRequest.Retry, func(ctx context.Context) (*http.Request, error) {
+		rq, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(fmt.Sprintf(`{"file":{"display_name":"%v"}}`, fileInfo.Name())))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create start-upload request. %w", err)
+		}
+
+		rq.Header.Set("X-Goog-Upload-Protocol", "resumable")
+		rq.Header.Set("X-Goog-Upload-Command", "start")
+		rq.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+		rq.Header.Set("X-Goog-Upload-Header-Content-Type", contentType)
+		rq.Header.Set("Content-Type", "application/json")
+
+		debugPrintf("sending start upload request", "type", "start_upload_request", "url", url, "headers", rq.Header)
+
+		return rq, nil
+	}, debugPrintf)
 	if err != nil {
 		return Reference{}, fmt.Errorf("error starting file upload. %w", err)
 	}
@@ -94,24 +108,46 @@ func Upload(uploadRequest UploadRequest, debugPrintf func(msg string, args ...an
 		return Reference{}, fmt.Errorf("upload url not found in start-upload response header of 'x-goog-upload-url'")
 	}
 
-	file, err := Deps.OS_Open(uploadRequest.File)
-	if err != nil {
-		return Reference{}, fmt.Errorf("unable to open file '%v' for upload. %w", uploadRequest.File, err)
-	}
-	defer file.Close()
+	var file io.ReadCloser
 
-	rq, err = http.NewRequest("POST", uploadURL, file) // Use the file as the request body
-	if err != nil {
-		return Reference{}, fmt.Errorf("unable to create upload-request. %w", err)
-	}
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	rs, err = retry.Do(ctx, uploadRequest.Retry, func(ctx context.Context) (*http.Request, error) {
+		offset := int64(0)
+
+		if file != nil {
+			file.Close() // a previous attempt failed, so the file is re-opened in order to resume it from the offset the api has received
+			offset = receivedOffset(ctx, uploadURL, fileInfo.Size(), debugPrintf)
+		}
+
+		f, err := Deps.OS_Open(uploadRequest.File)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open file '%v' for upload. %w", uploadRequest.File, err)
+		}
 
-	rq.Header.Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
-	rq.Header.Set("X-Goog-Upload-Offset", "0")
-	rq.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+		file = f
 
-	debugPrintf("sending upload request", "type", "upload_request", "url", url, "headers", rq.Header, "bytes", strconv.FormatInt(fileInfo.Size(), 10))
+		if err := skip(file, offset); err != nil {
+			return nil, fmt.Errorf("unable to resume upload of file '%v' from offset %v. %w", uploadRequest.File, offset, err)
+		}
 
-	rs, err = http.DefaultClient.Do(rq)
+		rq, err := http.NewRequestWithContext(ctx, "POST", uploadURL, file) // Use the file as the request body
+		if err != nil {
+			return nil, fmt.Errorf("unable to create upload-request. %w", err)
+		}
+
+		rq.Header.Set("Content-Length", strconv.FormatInt(fileInfo.Size()-offset, 10))
+		rq.Header.Set("X-Goog-Upload-Offset", strconv.FormatInt(offset, 10))
+		rq.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+
+		debugPrintf("sending upload request", "type", "upload_request", "url", url, "headers", rq.Header, "bytes", strconv.FormatInt(fileInfo.Size()-offset, 10))
+
+		return rq, nil
+	}, debugPrintf)
 	if err != nil {
 		return Reference{}, fmt.Errorf("error during upload-request. %w", err)
 	}
@@ -127,9 +163,10 @@ func Upload(uploadRequest UploadRequest, debugPrintf func(msg string, args ...an
 
 	uploadResponse := struct {
 		File struct {
-			DisplayName string `json:"displayName"`
-			MimeType    string `json:"mimeType"`
-			URI         string `json:"uri"`
+			DisplayName    string `json:"displayName"`
+			MimeType       string `json:"mimeType"`
+			URI            string `json:"uri"`
+			ExpirationTime string `json:"expirationTime"`
 		} `json:"file"`
 	}{}
 
@@ -137,9 +174,91 @@ func Upload(uploadRequest UploadRequest, debugPrintf func(msg string, args ...an
 		return Reference{}, fmt.Errorf("unable to marshal upload-request response. %w", err)
 	}
 
-	return Reference{
+	reference := Reference{
 		URI:      uploadResponse.File.URI,
 		MIMEType: uploadResponse.File.MimeType,
 		Label:    uploadResponse.File.DisplayName,
-	}, nil
+		Hash:     key,
+	}
+
+	if reference.Expires, err = time.Parse(time.RFC3339Nano, uploadResponse.File.ExpirationTime); err != nil {
+		reference.Expires = time.Now().Add(uploadLifetime)
+	}
+
+	if uploadRequest.Index != "" {
+		if err := record(uploadRequest.Index, key, reference); err != nil {
+			debugPrintf("unable to record upload in index", "type", "upload_index", "file", uploadRequest.File, "error", err) // the upload itself succeeded, so this is not fatal
+		}
+	}
+
+	return reference, nil
+}
+
+// receivedOffset returns the number of bytes of a file of the specified size that the api has received for the specified upload, so that
+// a failed upload can be resumed from that offset. If it cannot be determined, zero is returned, so that the file is sent from the start
+func receivedOffset(ctx context.Context, uploadURL string, size int64, debugPrintf func(msg string, args ...any)) int64 {
+	rq, err := http.NewRequestWithContext(ctx, "POST", uploadURL, nil)
+	if err != nil {
+		return 0
+	}
+
+	rq.Header.Set("X-Goog-Upload-Command", "query")
+
+	rs, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		debugPrintf("unable to query upload status", "type", "upload_query", "error", err)
+		return 0
+	}
+	defer rs.Body.Close()
+
+	received, err := strconv.ParseInt(rs.Header.Get("X-Goog-Upload-Size-Received"), 10, 64)
+
+	debugPrintf("received upload status", "type", "upload_query", "status", rs.Status, "upload_status", rs.Header.Get("X-Goog-Upload-Status"), "received", received)
+
+	if rs.StatusCode != http.StatusOK || rs.Header.Get("X-Goog-Upload-Status") != "active" || err != nil || received < 0 || received > size {
+		return 0
+	}
+
+	return received
+}
+
+// skip advances the specified file by the specified number of bytes
+func skip(file io.Reader, offset int64) error {
+	if offset == 0 {
+		return nil
+	}
+
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err := seeker.Seek(offset, io.SeekStart)
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, file, offset)
+	return err
+}
+
+// Read returns the content of the specified file and a reference to it, without a uri, so that it can be sent inline with a request
+func Read(file string) (Reference, []byte, error) {
+	mimeType, err := MIMEType(file)
+	if err != nil {
+		return Reference{}, nil, err
+	}
+
+	f, err := Deps.OS_Open(file)
+	if err != nil {
+		return Reference{}, nil, fmt.Errorf("unable to open file '%v'. %w", file, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return Reference{}, nil, fmt.Errorf("unable to read file '%v'. %w", file, err)
+	}
+
+	hash, err := Hash(file, mimeType)
+	if err != nil {
+		return Reference{}, nil, err
+	}
+
+	return Reference{MIMEType: mimeType, Label: filepath.Base(file), Hash: hash}, data, nil
 }
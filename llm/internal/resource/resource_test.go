@@ -0,0 +1,85 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/comradequinn/gen/llm/internal/retry"
+)
+
+func TestUploadResume(t *testing.T) {
+	Deps.OS_Stat = os.Stat
+	Deps.OS_Open = func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	content := strings.Repeat("test-content-", 10)
+	file := filepath.Join(t.TempDir(), "test-file.txt")
+
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("unable to write test file. %v", err)
+	}
+
+	const receivedBeforeFailure = 20
+
+	var (
+		svr      *httptest.Server
+		received string
+		offsets  []string
+	)
+
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch command := r.Header.Get("X-Goog-Upload-Command"); command {
+		case "start":
+			w.Header().Set("X-Goog-Upload-Url", svr.URL+"/test-upload-url/")
+		case "query":
+			w.Header().Set("X-Goog-Upload-Status", "active")
+			w.Header().Set("X-Goog-Upload-Size-Received", strconv.Itoa(len(received)))
+		case "upload, finalize":
+			data, _ := io.ReadAll(r.Body)
+			offsets = append(offsets, r.Header.Get("X-Goog-Upload-Offset"))
+
+			if len(offsets) == 1 { // only part of the file is received before the first attempt fails
+				received = string(data[:receivedBeforeFailure])
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			received += string(data)
+			json.NewEncoder(w).Encode(map[string]any{"file": map[string]string{"displayName": "test-file.txt", "mimeType": "text/plain", "uri": "test-uri"}})
+		default:
+			t.Fatalf("unexpected upload command %q", command)
+		}
+	}))
+	defer svr.Close()
+
+	reference, err := Upload(context.Background(), UploadRequest{
+		URL:   svr.URL + "/test-start-upload-url/?api-key=%v",
+		Key:   "test-api-key",
+		File:  file,
+		Retry: retry.Policy{MaxAttempts: 2, Backoff: time.Millisecond},
+	}, func(string, ...any) {})
+
+	if err != nil {
+		t.Fatalf("expected no error uploading file. got %v", err)
+	}
+
+	if reference.URI != "test-uri" {
+		t.Fatalf("expected the uploaded file to be referenced. got %+v", reference)
+	}
+
+	if len(offsets) != 2 || offsets[0] != "0" || offsets[1] != strconv.Itoa(receivedBeforeFailure) {
+		t.Fatalf("expected the retried upload to resume from the offset received. got offsets %v", offsets)
+	}
+
+	if received != content {
+		t.Fatalf("expected the file to be received in full, once. got %q", received)
+	}
+}
@@ -0,0 +1,168 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type (
+	Policy struct {
+		MaxAttempts int
+		Backoff     time.Duration
+		MaxBackoff  time.Duration
+		Jitter      float64
+	}
+)
+
+var (
+	Deps = struct {
+		Time_After func(d time.Duration) <-chan time.Time
+	}{
+		Time_After: time.After,
+	}
+)
+
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// Do sends the request created by newRequest, retrying transport errors and retryable status codes in accordance with the specified policy.
+// newRequest is called for each attempt, with the specified context, so that request bodies can be recreated. Retries are abandoned
+// when the context is done.
+//
+// The response of the final attempt is returned regardless of its status code; the caller is responsible for closing its body
+func Do(ctx context.Context, policy Policy, newRequest func(ctx context.Context) (*http.Request, error), debugPrintf func(msg string, args ...any)) (*http.Response, error) {
+	maxAttempts := max(policy.MaxAttempts, 1)
+
+	wait := func(delay time.Duration) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-Deps.Time_After(delay):
+			return nil
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		rq, err := newRequest(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rs, err := http.DefaultClient.Do(rq)
+
+		if err != nil {
+			if attempt == maxAttempts || ctx.Err() != nil {
+				return nil, fmt.Errorf("request failed after %v attempts. %w", attempt, err)
+			}
+
+			delay := policy.backoff(attempt)
+			debugPrintf("retrying failed request", "type", "retry", "url", rq.URL.Redacted(), "attempt", attempt, "delay", delay.String(), "error", err)
+
+			if err := wait(delay); err != nil {
+				return nil, fmt.Errorf("request abandoned after %v attempts. %w", attempt, err)
+			}
+
+			continue
+		}
+
+		if !retryableStatusCodes[rs.StatusCode] {
+			return rs, nil
+		}
+
+		body, err := io.ReadAll(rs.Body)
+		rs.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read response body. %w", err)
+		}
+
+		if attempt == maxAttempts {
+			rs.Body = io.NopCloser(bytes.NewReader(body))
+			return rs, nil
+		}
+
+		delay, ok := retryDelay(rs, body)
+
+		if !ok {
+			delay = policy.backoff(attempt)
+		}
+
+		if policy.MaxBackoff > 0 && delay > policy.MaxBackoff { // the delay requested by the server is bounded as any other
+			delay = policy.MaxBackoff
+		}
+
+		debugPrintf("retrying failed request", "type", "retry", "url", rq.URL.Redacted(), "attempt", attempt, "delay", delay.String(), "status", rs.Status, "response", string(body))
+
+		if err := wait(delay); err != nil {
+			return nil, fmt.Errorf("request abandoned after %v attempts. %w", attempt, err)
+		}
+	}
+}
+
+// backoff returns the exponential backoff, with jitter applied, for the specified attempt
+func (p Policy) backoff(attempt int) time.Duration {
+	delay := p.Backoff << (attempt - 1)
+
+	if p.MaxBackoff > 0 && (delay > p.MaxBackoff || delay <= 0) {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (rand.Float64()*2 - 1))
+	}
+
+	return max(delay, 0)
+}
+
+// retryDelay returns the delay requested by the server, if any, via either a Retry-After header or
+// the retryDelay field of a google.rpc.RetryInfo detail in the error body
+func retryDelay(rs *http.Response, body []byte) (time.Duration, bool) {
+	if retryAfter := rs.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(t), 0), true
+		}
+	}
+
+	errorBody := struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(body, &errorBody); err != nil {
+		return 0, false
+	}
+
+	for _, detail := range errorBody.Error.Details {
+		if detail.Type != "type.googleapis.com/google.rpc.RetryInfo" || detail.RetryDelay == "" {
+			continue
+		}
+
+		if delay, err := time.ParseDuration(detail.RetryDelay); err == nil {
+			return delay, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	delays := []time.Duration{}
+	Deps.Time_After = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+
+	responses := []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+		func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+		func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"12s"}]}}`)
+		},
+		func(w http.ResponseWriter) { io.WriteString(w, "test-response") },
+	}
+
+	attempts, badBody := 0, "" // the body of any request not recreated for its attempt, asserted on the test goroutine
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); string(body) != "test-request" {
+			badBody = string(body)
+		}
+
+		responses[attempts](w)
+		attempts++
+	}))
+	defer svr.Close()
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	send := func(policy Policy) (*http.Response, error) {
+		return Do(context.Background(), policy, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodPost, svr.URL, strings.NewReader("test-request"))
+		}, func(string, ...any) {})
+	}
+
+	rs, err := send(Policy{MaxAttempts: 4, Backoff: time.Second, MaxBackoff: time.Minute})
+
+	assert(t, err == nil, "expected no error. got %v", err)
+	assert(t, badBody == "", "expected request body to be recreated for each attempt. got %q", badBody)
+
+	body, _ := io.ReadAll(rs.Body)
+	rs.Body.Close()
+
+	assert(t, rs.StatusCode == http.StatusOK, "expected status to be 200. got %v", rs.StatusCode)
+	assert(t, string(body) == "test-response", "expected body to be test-response. got %q", body)
+	assert(t, attempts == 4, "expected 4 attempts. got %v", attempts)
+	assert(t, len(delays) == 3, "expected 3 delays. got %v", len(delays))
+	assert(t, delays[0] == time.Second, "expected first delay to be the initial backoff. got %v", delays[0])
+	assert(t, delays[1] == 7*time.Second, "expected second delay to honour retry-after. got %v", delays[1])
+	assert(t, delays[2] == 12*time.Second, "expected third delay to honour retry-delay. got %v", delays[2])
+
+	attempts, delays = 0, nil
+
+	_, err = send(Policy{MaxAttempts: 4, Backoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	assert(t, err == nil, "expected no error. got %v", err)
+	assert(t, len(delays) == 3, "expected 3 delays. got %v", len(delays))
+	assert(t, delays[1] == 5*time.Second && delays[2] == 5*time.Second, "expected delays requested by the server to be limited to the max backoff. got %v", delays)
+
+	attempts, delays = 0, nil
+
+	rs, err = send(Policy{MaxAttempts: 2, Backoff: time.Second})
+
+	assert(t, err == nil, "expected no error. got %v", err)
+	assert(t, rs.StatusCode == http.StatusTooManyRequests, "expected the status of the final attempt to be returned. got %v", rs.StatusCode)
+	assert(t, attempts == 2, "expected 2 attempts. got %v", attempts)
+	assert(t, badBody == "", "expected request body to be recreated for each attempt. got %q", badBody)
+
+	policy := Policy{Backoff: time.Second, MaxBackoff: 5 * time.Second, Jitter: 0.5}
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		delay := policy.backoff(attempt)
+		expected := min(time.Second<<(attempt-1), 5*time.Second)
+		assert(t, delay >= expected/2 && delay <= expected*3/2, "expected delay for attempt %v to be within jitter of %v. got %v", attempt, expected, delay)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts = 0
+	Deps.Time_After = func(d time.Duration) <-chan time.Time { return nil }
+
+	_, err = Do(ctx, Policy{MaxAttempts: 4, Backoff: time.Second}, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, svr.URL, strings.NewReader("test-request"))
+	}, func(string, ...any) {})
+
+	assert(t, errors.Is(err, context.Canceled), "expected a cancelled context to abandon the request. got %v", err)
+	assert(t, attempts == 0, "expected no attempts to reach the server. got %v", attempts)
+}
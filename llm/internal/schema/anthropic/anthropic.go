@@ -0,0 +1,95 @@
+package anthropic
+
+import "encoding/json"
+
+const (
+	Version = "2023-06-01"
+)
+
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+const (
+	StopReasonEndTurn      = "end_turn"
+	StopReasonToolUse      = "tool_use"
+	StopReasonStopSequence = "stop_sequence"
+	StopReasonMaxTokens    = "max_tokens"
+	StopReasonRefusal      = "refusal"
+)
+
+const (
+	BlockTypeText       = "text"
+	BlockTypeImage      = "image"
+	BlockTypeDocument   = "document"
+	BlockTypeToolUse    = "tool_use"
+	BlockTypeToolResult = "tool_result"
+)
+
+type (
+	Request struct {
+		Model       string      `json:"model"`
+		System      string      `json:"system,omitempty"`
+		Messages    []Message   `json:"messages"`
+		Tools       []Tool      `json:"tools,omitempty"`
+		ToolChoice  *ToolChoice `json:"tool_choice,omitempty"`
+		MaxTokens   int         `json:"max_tokens"`
+		Temperature float64     `json:"temperature"`
+		Stream      bool        `json:"stream,omitempty"`
+	}
+	Message struct {
+		Role    string  `json:"role"`
+		Content []Block `json:"content"`
+	}
+	Block struct {
+		Type      string          `json:"type"`
+		Text      string          `json:"text,omitempty"`
+		Source    *Source         `json:"source,omitempty"`
+		ID        string          `json:"id,omitempty"`
+		Name      string          `json:"name,omitempty"`
+		Input     json.RawMessage `json:"input,omitempty"`
+		ToolUseID string          `json:"tool_use_id,omitempty"`
+		Content   string          `json:"content,omitempty"`
+	}
+	Source struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+	}
+	Tool struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		InputSchema json.RawMessage `json:"input_schema"`
+	}
+	ToolChoice struct {
+		Type string `json:"type"`
+		Name string `json:"name,omitempty"`
+	}
+)
+
+type (
+	Response struct {
+		Content    []Block `json:"content"`
+		StopReason string  `json:"stop_reason"`
+		Usage      Usage   `json:"usage"`
+	}
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	}
+	Event struct {
+		Type         string   `json:"type"`
+		Index        int      `json:"index"`
+		Message      Response `json:"message"`
+		ContentBlock Block    `json:"content_block"`
+		Delta        Delta    `json:"delta"`
+		Usage        Usage    `json:"usage"`
+	}
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	}
+)
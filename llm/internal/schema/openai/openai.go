@@ -0,0 +1,102 @@
+package openai
+
+import "encoding/json"
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
+const (
+	FinishReasonStop          = "stop"
+	FinishReasonToolCalls     = "tool_calls"
+	FinishReasonLength        = "length"
+	FinishReasonContentFilter = "content_filter"
+)
+
+type (
+	Request struct {
+		Model               string          `json:"model"`
+		Messages            []Message       `json:"messages"`
+		Tools               []Tool          `json:"tools,omitempty"`
+		Temperature         float64         `json:"temperature"`
+		TopP                float64         `json:"top_p"`
+		MaxCompletionTokens int             `json:"max_completion_tokens"`
+		ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+		Stream              bool            `json:"stream,omitempty"`
+		StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+	}
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	}
+	Message struct {
+		Role       string     `json:"role"`
+		Content    any        `json:"content"` // either a string or a []ContentPart
+		ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+		ToolCallID string     `json:"tool_call_id,omitempty"`
+	}
+	ContentPart struct {
+		Type     string    `json:"type"`
+		Text     string    `json:"text,omitempty"`
+		ImageURL *ImageURL `json:"image_url,omitempty"`
+		File     *File     `json:"file,omitempty"`
+	}
+	ImageURL struct {
+		URL string `json:"url"`
+	}
+	File struct {
+		Filename string `json:"filename"`
+		FileData string `json:"file_data"`
+	}
+	Tool struct {
+		Type     string   `json:"type"`
+		Function Function `json:"function"`
+	}
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description,omitempty"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+	}
+	ToolCall struct {
+		Index    int          `json:"index"`
+		ID       string       `json:"id,omitempty"`
+		Type     string       `json:"type,omitempty"`
+		Function FunctionCall `json:"function"`
+	}
+	FunctionCall struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	}
+	ResponseFormat struct {
+		Type       string      `json:"type"`
+		JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+	}
+	JSONSchema struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+	}
+)
+
+type (
+	Response struct {
+		Choices []Choice `json:"choices"`
+		Usage   *Usage   `json:"usage"`
+	}
+	Choice struct {
+		Message      ResponseMessage `json:"message"`
+		Delta        ResponseMessage `json:"delta"`
+		FinishReason string          `json:"finish_reason"`
+	}
+	ResponseMessage struct {
+		Role      string     `json:"role"`
+		Content   string     `json:"content"`
+		ToolCalls []ToolCall `json:"tool_calls"`
+	}
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}
+)
@@ -3,7 +3,17 @@ package schema
 import "encoding/json"
 
 const (
-	FinishReasonStop = "STOP"
+	FinishReasonStop                  = "STOP"
+	FinishReasonMaxTokens             = "MAX_TOKENS"
+	FinishReasonSafety                = "SAFETY"
+	FinishReasonRecitation            = "RECITATION"
+	FinishReasonLanguage              = "LANGUAGE"
+	FinishReasonOther                 = "OTHER"
+	FinishReasonBlocklist             = "BLOCKLIST"
+	FinishReasonProhibitedContent     = "PROHIBITED_CONTENT"
+	FinishReasonSPII                  = "SPII"
+	FinishReasonMalformedFunctionCall = "MALFORMED_FUNCTION_CALL"
+	FinishReasonImageSafety           = "IMAGE_SAFETY"
 )
 
 type (
@@ -19,17 +29,24 @@ type (
 		} `json:"file"`
 	}
 	Request struct {
-		SystemInstruction SystemInstruction `json:"system_instruction"`
-		Contents          []Content         `json:"contents"`
-		Tools             []Tool            `json:"tools"`
-		GenerationConfig  GenerationConfig  `json:"generationConfig"`
+		SystemInstruction *SystemInstruction `json:"system_instruction,omitempty"`
+		Contents          []Content          `json:"contents"`
+		Tools             []Tool             `json:"tools,omitempty"`
+		GenerationConfig  GenerationConfig   `json:"generationConfig"`
+		CachedContent     string             `json:"cachedContent,omitempty"`
 	}
 	SystemInstruction struct {
 		Parts []Part `json:"parts"`
 	}
 	GoogleSearch struct{}
 	Tool         struct {
-		GoogleSearch *GoogleSearch `json:"googleSearch,omitempty"`
+		GoogleSearch         *GoogleSearch         `json:"googleSearch,omitempty"`
+		FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+	}
+	FunctionDeclaration struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
 	}
 	GenerationConfig struct {
 		Temperature      float64         `json:"temperature"`
@@ -42,18 +59,69 @@ type (
 
 type (
 	Response struct {
-		Candidates    []Candidate   `json:"candidates"`
-		UsageMetadata UsageMetadata `json:"usageMetadata"`
+		Candidates     []Candidate     `json:"candidates"`
+		PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+		UsageMetadata  UsageMetadata   `json:"usageMetadata"`
+	}
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
 	}
 	UsageMetadata struct {
-		TotalTokenCount int `json:"totalTokenCount"`
+		TotalTokenCount         int `json:"totalTokenCount"`
+		CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"`
+	}
+)
+
+type (
+	CachedContent struct {
+		Name              string             `json:"name,omitempty"`
+		DisplayName       string             `json:"displayName,omitempty"`
+		Model             string             `json:"model,omitempty"`
+		SystemInstruction *SystemInstruction `json:"systemInstruction,omitempty"`
+		Contents          []Content          `json:"contents,omitempty"`
+		TTL               string             `json:"ttl,omitempty"`
+		ExpireTime        string             `json:"expireTime,omitempty"`
+		UsageMetadata     *UsageMetadata     `json:"usageMetadata,omitempty"`
+	}
+	CachedContentList struct {
+		CachedContents []CachedContent `json:"cachedContents"`
+		NextPageToken  string          `json:"nextPageToken,omitempty"`
+	}
+	File struct {
+		Name           string `json:"name"`
+		DisplayName    string `json:"displayName,omitempty"`
+		MIMEType       string `json:"mimeType,omitempty"`
+		SizeBytes      string `json:"sizeBytes,omitempty"`
+		ExpirationTime string `json:"expirationTime,omitempty"`
+		URI            string `json:"uri,omitempty"`
+	}
+	FileList struct {
+		Files         []File `json:"files"`
+		NextPageToken string `json:"nextPageToken,omitempty"`
 	}
 )
 
 type (
 	Part struct {
-		Text string    `json:"text,omitzero"`
-		File *FileData `json:"fileData,omitempty"`
+		Text             string            `json:"text,omitzero"`
+		File             *FileData         `json:"fileData,omitempty"`
+		InlineData       *InlineData       `json:"inlineData,omitempty"`
+		FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+		FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	}
+	FunctionCall struct {
+		ID   string          `json:"id,omitempty"`
+		Name string          `json:"name"`
+		Args json.RawMessage `json:"args,omitempty"`
+	}
+	FunctionResponse struct {
+		ID       string          `json:"id,omitempty"`
+		Name     string          `json:"name"`
+		Response json.RawMessage `json:"response"`
+	}
+	InlineData struct {
+		MIMEType string `json:"mimeType"`
+		Data     []byte `json:"data"`
 	}
 	FileData struct {
 		MIMEType string `json:"mimeType"`
@@ -64,7 +132,29 @@ type (
 		Parts []Part `json:"parts"`
 	}
 	Candidate struct {
-		Content      Content `json:"content"`
-		FinishReason string  `json:"finishReason"`
+		Content           Content            `json:"content"`
+		FinishReason      string             `json:"finishReason"`
+		GroundingMetadata *GroundingMetadata `json:"groundingMetadata,omitempty"`
+	}
+	GroundingMetadata struct {
+		WebSearchQueries  []string           `json:"webSearchQueries,omitempty"`
+		GroundingChunks   []GroundingChunk   `json:"groundingChunks,omitempty"`
+		GroundingSupports []GroundingSupport `json:"groundingSupports,omitempty"`
+	}
+	GroundingChunk struct {
+		Web *WebChunk `json:"web,omitempty"`
+	}
+	WebChunk struct {
+		URI   string `json:"uri"`
+		Title string `json:"title"`
+	}
+	GroundingSupport struct {
+		Segment               Segment `json:"segment"`
+		GroundingChunkIndices []int   `json:"groundingChunkIndices"`
+	}
+	Segment struct {
+		StartIndex int    `json:"startIndex"`
+		EndIndex   int    `json:"endIndex"`
+		Text       string `json:"text"`
 	}
 )
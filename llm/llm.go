@@ -2,30 +2,51 @@ package llm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"maps"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/comradequinn/gen/llm/internal/resource"
-	"github.com/comradequinn/gen/llm/internal/schema"
+	"github.com/comradequinn/gen/llm/internal/retry"
 )
 
 type (
 	Config struct {
-		APIKey        string
-		APIURL        string
-		UploadURL     string
-		SystemPrompt  string
-		ResponseStyle string
-		Model         string
-		MaxTokens     int
-		Temperature   float64
-		TopP          float64
-		User          User
-		Grounding     bool
-		DebugPrintf   func(msg string, args ...any)
+		Provider             string
+		APIKey               string
+		APIURL               string
+		StreamURL            string
+		UploadURL            string
+		UploadIndex          string
+		UploadConcurrency    int
+		InlineMaxBytes       int64
+		UploadProgress       func(file string, completed, total int)
+		CacheURL             string
+		FilesURL             string
+		Cache                string
+		SystemPrompt         string
+		ResponseStyle        string
+		Model                string
+		MaxTokens            int
+		Temperature          float64
+		TopP                 float64
+		User                 User
+		Grounding            bool
+		Tools                []Tool
+		Retry                RetryPolicy
+		ContinueOnTruncation bool
+		Compaction           Compaction
+		DebugPrintf          func(msg string, args ...any)
+		Stream               func(text string)
+	}
+	Tool struct {
+		Name        string
+		Description string
+		Parameters  json.RawMessage
+		Call        func(ctx context.Context, args json.RawMessage) (json.RawMessage, error)
 	}
 	User struct {
 		Name        string
@@ -39,31 +60,104 @@ type (
 		Schema  string
 	}
 	FileReference struct {
-		URI      string `json:"uri"`
-		MIMEType string `json:"mimeType"`
-		Label    string `json:"label"`
+		URI      string    `json:"uri,omitempty"`
+		MIMEType string    `json:"mimeType"`
+		Label    string    `json:"label"`
+		Path     string    `json:"path,omitempty"`
+		Hash     string    `json:"hash,omitempty"`
+		Expires  time.Time `json:"expires,omitzero"`
+		Data     []byte    `json:"data,omitempty"`
 	}
 	Response struct {
-		Tokens int
-		Text   string
-		Files  []FileReference
+		Model        string
+		Tokens       int
+		CachedTokens int
+		Text         string
+		Files        []FileReference
+		Turns        []Message
+		FinishReason FinishReason
+		FinishDetail string
+		Grounding    *Grounding
+		History      []Message
+		Archived     []Message // messages removed from the history by compaction, which History no longer includes
+		Warnings     []string
+	}
+	FinishReason string
+	Grounding    struct {
+		Queries  []string  `json:"queries,omitempty"`
+		Sources  []Source  `json:"sources,omitempty"`
+		Supports []Support `json:"supports,omitempty"`
+	}
+	Source struct {
+		URI   string `json:"uri"`
+		Title string `json:"title"`
+	}
+	Support struct {
+		Start   int    `json:"start"`
+		End     int    `json:"end"`
+		Text    string `json:"text"`
+		Sources []int  `json:"sources"`
 	}
 	Role    string
 	Message struct {
-		Role  Role            `json:"role"`
-		Text  string          `json:"text"`
-		Files []FileReference `json:"files,omitempty"`
+		Role              Role               `json:"role"`
+		Text              string             `json:"text"`
+		Files             []FileReference    `json:"files,omitempty"`
+		FunctionCalls     []FunctionCall     `json:"functionCalls,omitempty"`
+		FunctionResponses []FunctionResponse `json:"functionResponses,omitempty"`
+		Grounding         *Grounding         `json:"grounding,omitempty"`
+		Model             string             `json:"model,omitempty"`  // the model that wrote the message, if recorded
+		Tokens            int                `json:"tokens,omitempty"` // the tokens used to generate the message, if recorded
+		Time              time.Time          `json:"time,omitzero"`    // when the message was sent or received, if recorded
+	}
+	FunctionCall struct {
+		ID   string          `json:"id,omitempty"`
+		Name string          `json:"name"`
+		Args json.RawMessage `json:"args,omitempty"`
+	}
+	FunctionResponse struct {
+		ID       string          `json:"id,omitempty"`
+		Name     string          `json:"name"`
+		Response json.RawMessage `json:"response"`
+	}
+	ModelSet struct {
+		Pro   string
+		Flash string
+	}
+	ProviderDefaults struct {
+		APIURL string
+		Models ModelSet
 	}
 )
 
+// RetryPolicy defines how failed api requests are retried
+type RetryPolicy = retry.Policy
+
 var (
-	Models = struct {
-		Pro   string
-		Flash string
-	}{
+	Models = ModelSet{
 		Pro:   "gemini-2.5-pro-preview-05-06",
 		Flash: "gemini-2.5-flash-preview-04-17",
 	}
+	Providers = map[string]ProviderDefaults{
+		ProviderGemini: {
+			APIURL: "https://generativelanguage.googleapis.com/v1beta/models/%v:generateContent?key=%v",
+			Models: Models,
+		},
+		ProviderOpenAI: {
+			APIURL: "https://api.openai.com/v1/chat/completions",
+			Models: ModelSet{Pro: "gpt-4.1", Flash: "gpt-4.1-mini"},
+		},
+		ProviderAnthropic: {
+			APIURL: "https://api.anthropic.com/v1/messages",
+			Models: ModelSet{Pro: "claude-sonnet-4-0", Flash: "claude-3-5-haiku-latest"},
+		},
+	}
+)
+
+const (
+	ProviderGemini    = "gemini"
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
 )
 
 const (
@@ -71,167 +165,284 @@ const (
 	RoleModel = "model"
 )
 
-// Generate queries the configured LLM with the specified prompt and returns the result
-func Generate(cfg Config, prompt Prompt) (Response, error) {
+const (
+	// FinishReasonStop indicates the response is complete
+	FinishReasonStop FinishReason = "stop"
+	// FinishReasonMaxTokens indicates the response was truncated by the token limit
+	FinishReasonMaxTokens FinishReason = "max_tokens"
+	// FinishReasonSafety indicates the prompt or response was blocked by safety filters or content policies
+	FinishReasonSafety FinishReason = "safety"
+	// FinishReasonRecitation indicates the response was stopped as it recited material, such as copyrighted text
+	FinishReasonRecitation FinishReason = "recitation"
+	// FinishReasonOther indicates the response was stopped for any other reason, which is described by Response.FinishDetail
+	FinishReasonOther FinishReason = "other"
+)
+
+const (
+	maxToolRounds      = 10
+	maxContinuations   = 5
+	maxInlineBytes     = 10 * 1024 * 1024 // the gemini api limits the total size of a request, including inline data, to 20MB
+	maxStreamIndex     = 1024             // the highest index of a content block or tool call accepted from a stream, far beyond any real response
+	continuationPrompt = "Your previous response was truncated. Continue it from exactly where it ended, without repeating any of it or adding any preamble."
+)
+
+// Generate queries the configured LLM with the specified prompt and returns the result. Any file uploads and api
+// requests in progress are abandoned when the context is done
+func Generate(ctx context.Context, cfg Config, prompt Prompt) (Response, error) {
 	if cfg.Model == "" || cfg.MaxTokens == 0 || cfg.Temperature == 0 {
 		return Response{}, fmt.Errorf("invalid prompt. model, maxtokens and temperature must be specified")
 	}
 
+	if cfg.Provider == "" {
+		cfg.Provider = ProviderGemini
+	}
+
+	provider, ok := providers[cfg.Provider]
+
+	if !ok {
+		return Response{}, fmt.Errorf("invalid provider '%v'. expected one of %v", cfg.Provider, strings.Join(slices.Sorted(maps.Keys(providers)), ", "))
+	}
+
+	if cfg.APIURL == "" {
+		cfg.APIURL = Providers[cfg.Provider].APIURL
+	}
+
+	if cfg.Grounding && cfg.Provider != ProviderGemini {
+		cfg.DebugPrintf("grounding was specified but silently disabled as it is only supported by the gemini provider", "provider", cfg.Provider)
+		cfg.Grounding = false
+	}
+
 	if prompt.Schema != "" && cfg.Grounding {
 		cfg.DebugPrintf("grounding was specified but silently disabled due to the specification of a schema. the gemini api will not currently perform grounding for prompts requiring a structured response")
 		cfg.Grounding = false
 	}
 
-	systemPrompt := strings.Builder{}
-	systemPrompt.WriteString(cfg.SystemPrompt + ". ")
-	systemPrompt.WriteString(fmt.Sprintf("Your responses must not exceed %v words in length. ", float64(cfg.MaxTokens)*0.75)) // rough mapping of tokens to words
+	if len(cfg.Tools) > 0 && cfg.Grounding {
+		cfg.DebugPrintf("grounding was specified but silently disabled due to the specification of tools. the gemini api will not currently perform grounding alongside function calling")
+		cfg.Grounding = false
+	}
+
+	cache := Cache{}
 
-	defineAttribute := func(key string, val any, unset any) string {
-		if val == unset {
-			return ""
+	if cfg.Cache != "" {
+		if cfg.Provider != ProviderGemini {
+			return Response{}, fmt.Errorf("invalid cache '%v'. caches are only supported by the gemini provider", cfg.Cache)
 		}
-		return fmt.Sprintf("Consider in your responses, where it may be relevant, that the user has provided this information regarding their %v: %q", key, val) + ". "
-	}
 
-	systemPrompt.WriteString(defineAttribute("location", cfg.User.Location, ""))
-	systemPrompt.WriteString(defineAttribute("name", cfg.User.Name, ""))
-	systemPrompt.WriteString(defineAttribute("description", cfg.User.Description, ""))
-	systemPrompt.WriteString(defineAttribute("preferred response style; note that this only refines your output and does not override any previous instruction where there is a contradiction", cfg.ResponseStyle, ""))
+		if len(cfg.Tools) > 0 {
+			return Response{}, fmt.Errorf("invalid cache '%v'. tools cannot be used with a cache", cfg.Cache)
+		}
 
-	contents := make([]schema.Content, 0, len(prompt.History)+1)
+		if cfg.Grounding {
+			cfg.DebugPrintf("grounding was specified but silently disabled due to the specification of a cache. the gemini api will not currently perform grounding for prompts using a cache")
+			cfg.Grounding = false
+		}
 
-	for _, message := range prompt.History {
-		content := schema.Content{
-			Role:  string(message.Role),
-			Parts: []schema.Part{{Text: message.Text}}}
-		if len(message.Files) > 0 {
-			for _, fileReference := range message.Files {
-				content.Parts = append(content.Parts, schema.Part{
-					File: &schema.FileData{URI: fileReference.URI, MIMEType: fileReference.MIMEType},
-				})
-			}
+		var err error
+
+		if cache, err = findCache(ctx, cfg, cfg.Cache); err != nil {
+			return Response{}, err
 		}
 
-		contents = append(contents, content)
+		if cfg.Model != cache.Model {
+			cfg.DebugPrintf("model overridden by that of the cache", "type", "cache", "cache", cache.Name, "model", cache.Model)
+			cfg.Model = cache.Model // a cache can only be used with the model that created it
+		}
 	}
 
-	content := schema.Content{
-		Role: RoleUser,
-		Parts: []schema.Part{
-			{Text: prompt.Text},
-		},
+	history, warnings := prompt.History, []string(nil)
+
+	if cfg.Provider == ProviderGemini {
+		var err error
+		if history, warnings, err = refreshFiles(ctx, cfg, history); err != nil {
+			return Response{}, err
+		}
+	}
+
+	history, archived, tokens, err := compact(ctx, cfg, provider, history)
+
+	if err != nil {
+		return Response{}, err
+	}
+
+	files, err := provider.attach(ctx, cfg, prompt.Files)
+
+	if err != nil {
+		return Response{}, err
+	}
+
+	rq := request{
+		SystemPrompt: systemPrompt(cfg),
+		Messages:     append(slices.Clone(history), Message{Role: RoleUser, Text: prompt.Text, Files: files}),
+		Schema:       prompt.Schema,
+		Cache:        cache.ID,
 	}
 
 	var (
-		resourceRefs []resource.Reference
-		err          error
+		rs            result
+		turns         []Message
+		cachedTokens  int
+		toolRounds    int
+		continuations int
+		text          = strings.Builder{}
+		grounding     *Grounding
 	)
 
-	if len(prompt.Files) > 0 {
-		for _, f := range prompt.Files {
-			resourceRef, err := resource.Upload(resource.UploadRequest{
-				URL:  cfg.UploadURL,
-				Key:  cfg.APIKey,
-				File: f,
-			}, cfg.DebugPrintf)
-
-			if err != nil {
-				return Response{}, fmt.Errorf("unable to upload file '%v' to gemini api. %v", f, err)
-			}
-			content.Parts = append(content.Parts, schema.Part{File: &schema.FileData{URI: resourceRef.URI, MIMEType: resourceRef.MIMEType}})
-			resourceRefs = append(resourceRefs, resourceRef)
+	for {
+		if rs, err = provider.generate(ctx, cfg, rq); err != nil {
+			return Response{}, err
 		}
-	}
 
-	contents = append(contents, content)
+		tokens += rs.Tokens
+		cachedTokens += rs.CachedTokens
+		grounding = grounding.merge(rs.Message.Grounding, text.Len())
+		text.WriteString(rs.Message.Text)
 
-	tools := []schema.Tool{}
+		if rs.FinishReason == FinishReasonMaxTokens && cfg.ContinueOnTruncation && len(rs.Message.FunctionCalls) == 0 && continuations < maxContinuations {
+			continuations++
+			cfg.DebugPrintf("response truncated. requesting continuation", "type", "continuation", "continuation", continuations)
+			rq.Messages = append(rq.Messages, rs.Message, Message{Role: RoleUser, Text: continuationPrompt})
+			continue
+		}
 
-	if cfg.Grounding {
-		tools = []schema.Tool{
-			{GoogleSearch: &schema.GoogleSearch{}},
+		if rs.FinishReason != FinishReasonStop || len(rs.Message.FunctionCalls) == 0 {
+			break
 		}
-	}
 
-	generationConfig := schema.GenerationConfig{
-		Temperature:     cfg.Temperature,
-		TopP:            cfg.TopP,
-		MaxOutputTokens: cfg.MaxTokens,
-	}
+		if toolRounds == maxToolRounds {
+			return Response{}, fmt.Errorf("no final response returned after %v rounds of function calls", maxToolRounds)
+		}
 
-	generationConfig.ResponseMimeType = "text/plain"
+		toolRounds++
 
-	if prompt.Schema != "" {
-		generationConfig.ResponseMimeType = "application/json"
-		generationConfig.ResponseSchema = json.RawMessage(prompt.Schema)
-	}
+		functionResponses := Message{Role: RoleUser, FunctionResponses: callTools(ctx, cfg, rs.Message.FunctionCalls)}
 
-	request := bytes.Buffer{}
-	if err := json.NewEncoder(&request).Encode(schema.Request{
-		SystemInstruction: schema.SystemInstruction{
-			Parts: []schema.Part{{Text: systemPrompt.String()}},
-		},
-		Contents:         contents,
-		Tools:            tools,
-		GenerationConfig: generationConfig,
-	}); err != nil {
-		return Response{}, fmt.Errorf("unable to encode llm request as json. %w", err)
+		if err := ctx.Err(); err != nil {
+			return Response{}, err
+		}
+
+		rs.Message.Text = text.String()
+		rs.Message.Grounding = grounding
+		text.Reset() // text accompanying function calls is recorded with them, rather than in the final response
+		grounding = nil
+
+		rq.Messages = append(rq.Messages, rs.Message, functionResponses)
+		turns = append(turns, rs.Message, functionResponses)
 	}
 
-	url := fmt.Sprintf(cfg.APIURL, cfg.Model, cfg.APIKey)
-	cfg.DebugPrintf("sending generate request", "type", "generate_request", "url", url, "request", request.String())
+	cfg.DebugPrintf("token count value reported", "type", "report", "token_count", tokens, "cached_token_count", cachedTokens, "finish_reason", rs.FinishReason, "finish_detail", rs.FinishDetail)
+
+	return Response{
+		Model:        cfg.Model,
+		Tokens:       tokens,
+		CachedTokens: cachedTokens,
+		Text:         text.String(),
+		Files:        files,
+		Turns:        turns,
+		FinishReason: rs.FinishReason,
+		FinishDetail: rs.FinishDetail,
+		Grounding:    grounding,
+		History:      history,
+		Archived:     archived,
+		Warnings:     warnings,
+	}, nil
+}
 
-	rs, err := http.Post(url, "application/json", &request)
+// systemPrompt returns the system prompt derived from the configured system prompt, token limit, user details and response style
+func systemPrompt(cfg Config) string {
+	prompt := strings.Builder{}
+	prompt.WriteString(cfg.SystemPrompt + ". ")
+	prompt.WriteString(fmt.Sprintf("Your responses must not exceed %v words in length. ", float64(cfg.MaxTokens)*0.75)) // rough mapping of tokens to words
 
-	if err != nil {
-		return Response{}, fmt.Errorf("unable to send request to llm api. %w", err)
+	defineAttribute := func(key string, val any, unset any) string {
+		if val == unset {
+			return ""
+		}
+		return fmt.Sprintf("Consider in your responses, where it may be relevant, that the user has provided this information regarding their %v: %q", key, val) + ". "
 	}
 
-	defer rs.Body.Close()
+	prompt.WriteString(defineAttribute("location", cfg.User.Location, ""))
+	prompt.WriteString(defineAttribute("name", cfg.User.Name, ""))
+	prompt.WriteString(defineAttribute("description", cfg.User.Description, ""))
+	prompt.WriteString(defineAttribute("preferred response style; note that this only refines your output and does not override any previous instruction where there is a contradiction", cfg.ResponseStyle, ""))
 
-	body, err := io.ReadAll(rs.Body)
+	return prompt.String()
+}
 
-	if err != nil {
-		return Response{}, fmt.Errorf("unable to read response body. %w", err)
+// merge returns the combination of g and the grounding of a subsequent part of the same response, which begins at the specified
+// byte offset. sources are de-duplicated and the positions and source indices of the supports are adjusted accordingly
+func (g *Grounding) merge(next *Grounding, offset int) *Grounding {
+	if next == nil {
+		return g
 	}
 
-	cfg.DebugPrintf("received generate response", "type", "generate_response", "status", rs.Status, "request", string(body))
+	if g == nil {
+		g = &Grounding{}
+	}
 
-	if rs.StatusCode != 200 {
-		return Response{}, fmt.Errorf("non-200 status code returned from llm api. %s", body)
+	merged := &Grounding{
+		Queries:  append(slices.Clone(g.Queries), next.Queries...),
+		Sources:  slices.Clone(g.Sources),
+		Supports: slices.Clone(g.Supports),
 	}
 
-	response := schema.Response{}
+	indices := make([]int, len(next.Sources))
 
-	if err := json.Unmarshal(body, &response); err != nil {
-		return Response{}, fmt.Errorf("unable to parse response body. %w", err)
+	for i, source := range next.Sources {
+		if indices[i] = slices.IndexFunc(merged.Sources, func(s Source) bool { return s.URI == source.URI }); indices[i] == -1 {
+			merged.Sources = append(merged.Sources, source)
+			indices[i] = len(merged.Sources) - 1
+		}
 	}
 
-	if len(response.Candidates) == 0 || response.Candidates[0].FinishReason != schema.FinishReasonStop {
-		return Response{}, fmt.Errorf("no valid response candidates returned. response: %s", body)
+	for _, support := range next.Supports {
+		sources := make([]int, 0, len(support.Sources))
+		for _, i := range support.Sources {
+			if i >= 0 && i < len(indices) {
+				sources = append(sources, indices[i])
+			}
+		}
+		merged.Supports = append(merged.Supports, Support{Start: support.Start + offset, End: support.End + offset, Text: support.Text, Sources: sources})
 	}
 
-	sb := strings.Builder{}
+	return merged
+}
+
+// callTools executes the configured tools requested by the specified function calls and returns their results.
+// failures are reported to the llm as part of the result, rather than returned, so that it may respond to them
+func callTools(ctx context.Context, cfg Config, functionCalls []FunctionCall) []FunctionResponse {
+	functionResponses := make([]FunctionResponse, 0, len(functionCalls))
 
-	for _, part := range response.Candidates[0].Content.Parts {
-		sb.WriteString(part.Text)
+	toolError := func(functionCall FunctionCall, err error) FunctionResponse {
+		data, _ := json.Marshal(map[string]string{"error": err.Error()})
+		return FunctionResponse{ID: functionCall.ID, Name: functionCall.Name, Response: data}
 	}
 
-	cfg.DebugPrintf("token count value reported", "type", "report", "token_count", response.UsageMetadata.TotalTokenCount)
+	for _, functionCall := range functionCalls {
+		i := slices.IndexFunc(cfg.Tools, func(tool Tool) bool { return tool.Name == functionCall.Name })
+
+		if i == -1 {
+			functionResponses = append(functionResponses, toolError(functionCall, fmt.Errorf("no tool named '%v' is available", functionCall.Name)))
+			continue
+		}
+
+		cfg.DebugPrintf("calling tool", "type", "tool_call", "name", functionCall.Name, "args", string(functionCall.Args))
+
+		result, err := cfg.Tools[i].Call(ctx, functionCall.Args)
 
-	files := make([]FileReference, 0, len(resourceRefs))
+		cfg.DebugPrintf("tool call returned", "type", "tool_result", "name", functionCall.Name, "result", string(result), "error", err)
 
-	for _, resourceRef := range resourceRefs {
-		files = append(files, FileReference{
-			URI:      resourceRef.URI,
-			MIMEType: resourceRef.MIMEType,
-			Label:    resourceRef.Label,
-		})
+		if err != nil {
+			functionResponses = append(functionResponses, toolError(functionCall, err))
+			continue
+		}
+
+		if !json.Valid(result) || !bytes.HasPrefix(bytes.TrimSpace(result), []byte("{")) {
+			result, _ = json.Marshal(map[string]string{"output": string(result)}) // function responses must be json objects
+		}
+
+		functionResponses = append(functionResponses, FunctionResponse{ID: functionCall.ID, Name: functionCall.Name, Response: result})
 	}
 
-	return Response{
-		Tokens: response.UsageMetadata.TotalTokenCount,
-		Text:   sb.String(),
-		Files:  files,
-	}, nil
+	return functionResponses
 }
@@ -1,12 +1,19 @@
 package llm_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -36,6 +43,7 @@ func TestLLM(t *testing.T) {
 
 	expectedFileURI := "test-file-ref-uri"
 	actualRq := schema.Request{}
+	uploads := 0
 	expectedResponse := schema.Response{
 		Candidates: []schema.Candidate{
 			{
@@ -76,6 +84,7 @@ func TestLLM(t *testing.T) {
 				t.Fatalf("expected api key to be %v. got %v", "test=api-key", r.URL.Query()["api-key"][0])
 			}
 
+			actualRq = schema.Request{}
 			if err := json.NewDecoder(r.Body).Decode(&actualRq); err != nil {
 				t.Fatalf("unable to decode llm stub request body. %v", err)
 			}
@@ -83,9 +92,31 @@ func TestLLM(t *testing.T) {
 			if err := json.NewEncoder(w).Encode(&expectedResponse); err != nil {
 				t.Fatalf("unable to encode llm stub response body. %v", err)
 			}
+		case r.URL.Path == "/test-stream-url/":
+			actualRq = schema.Request{}
+			if err := json.NewDecoder(r.Body).Decode(&actualRq); err != nil {
+				t.Fatalf("unable to decode llm stub request body. %v", err)
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+
+			for i, part := range expectedResponse.Candidates[0].Content.Parts {
+				chunk := schema.Response{
+					Candidates: []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{part}}}},
+				}
+
+				if i == len(expectedResponse.Candidates[0].Content.Parts)-1 {
+					chunk.Candidates[0].FinishReason = schema.FinishReasonStop
+					chunk.UsageMetadata = expectedResponse.UsageMetadata
+				}
+
+				data, _ := json.Marshal(chunk)
+				fmt.Fprintf(w, "data: %s\r\n\r\n", data)
+			}
 		case r.URL.Path == "/test-start-upload-url/":
 			w.Header().Set("X-Goog-Upload-Url", svr.URL+"/test-upload-url/")
 		case r.URL.Path == "/test-upload-url/":
+			uploads++
 			rs := map[string]interface{}{
 				"file": map[string]string{
 					"displayName": "test-file-1",
@@ -103,6 +134,7 @@ func TestLLM(t *testing.T) {
 	cfg := llm.Config{
 		APIKey:        "test=api-key",
 		APIURL:        svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		StreamURL:     svr.URL + "/test-stream-url/?model=%v&api-key=%v",
 		UploadURL:     svr.URL + "/test-start-upload-url/?api-key=%v",
 		ResponseStyle: "test-style",
 		SystemPrompt:  "test-system-prompt",
@@ -155,7 +187,7 @@ func TestLLM(t *testing.T) {
 		}
 
 		if prompt.Schema != "" {
-			assert(t, actualRq.GenerationConfig.ResponseMimeType == "application/json", "expected response mime type to be application/json when a response schema is specified. got %v")
+			assert(t, actualRq.GenerationConfig.ResponseMimeType == "application/json", "expected response mime type to be application/json when a response schema is specified. got %v", actualRq.GenerationConfig.ResponseMimeType)
 			data, _ := actualRq.GenerationConfig.ResponseSchema.MarshalJSON()
 			assert(t, string(data) == prompt.Schema, "expected response schema to be %v. got %v", prompt.Schema, string(data))
 		} else {
@@ -183,14 +215,1060 @@ func TestLLM(t *testing.T) {
 		assert(t, rs.Tokens == expectedResponse.UsageMetadata.TotalTokenCount, "expected response token count to be %v. got %v", expectedResponse.UsageMetadata.TotalTokenCount, rs.Tokens)
 	}
 
-	rs, err := llm.Generate(cfg, prompt)
+	rs, err := llm.Generate(context.Background(), cfg, prompt)
 
 	assertResponse(t, rs, err)
 
 	cfg.Grounding = false
 	prompt.Schema = `{"type":"object","properties":{"response":{"type":"string"}}}`
 
-	rs, err = llm.Generate(cfg, prompt)
+	rs, err = llm.Generate(context.Background(), cfg, prompt)
+
+	assertResponse(t, rs, err)
+
+	streamed := strings.Builder{}
+	cfg.Stream = func(text string) { streamed.WriteString(text) }
+
+	rs, err = llm.Generate(context.Background(), cfg, prompt)
 
 	assertResponse(t, rs, err)
+	assert(t, streamed.String() == rs.Text, "expected streamed text to be %v. got %v", rs.Text, streamed.String())
+
+	cfg.Stream = nil
+	cfg.UploadIndex = filepath.Join(t.TempDir(), "uploads")
+	uploads = 0
+
+	for range 2 {
+		rs, err = llm.Generate(context.Background(), cfg, prompt)
+		assertResponse(t, rs, err)
+	}
+
+	assert(t, uploads == 1, "expected file to be uploaded once and then reused from the upload index. got %v uploads", uploads)
+}
+
+func TestLLMTools(t *testing.T) {
+	requests := []schema.Request{}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rq := schema.Request{}
+
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			t.Fatalf("unable to decode llm stub request body. %v", err)
+		}
+
+		requests = append(requests, rq)
+
+		part := schema.Part{FunctionCall: &schema.FunctionCall{Name: "test-tool", Args: json.RawMessage(`{"id":1}`)}}
+
+		if len(requests) > 1 {
+			part = schema.Part{Text: "test-response"}
+		}
+
+		if err := json.NewEncoder(w).Encode(schema.Response{
+			Candidates:    []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{part}}, FinishReason: schema.FinishReasonStop}},
+			UsageMetadata: schema.UsageMetadata{TotalTokenCount: 10},
+		}); err != nil {
+			t.Fatalf("unable to encode llm stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	toolArgs := ""
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		APIURL:      svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		Model:       llm.Models.Flash,
+		MaxTokens:   1000,
+		Temperature: 1.0,
+		TopP:        1.0,
+		Grounding:   true,
+		Tools: []llm.Tool{
+			{
+				Name:        "test-tool",
+				Description: "test-tool-description",
+				Call: func(ctx context.Context, args json.RawMessage) (json.RawMessage, error) {
+					toolArgs = string(args)
+					return json.RawMessage("test-tool-output"), nil
+				},
+			},
+		},
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt"})
+
+	assert(t, err == nil, "expected no error generating response. got %v", err)
+	assert(t, len(requests) == 2, "expected 2 requests. got %v", len(requests))
+	assert(t, len(requests[0].Tools) == 1 && len(requests[0].Tools[0].FunctionDeclarations) == 1, "expected 1 function declaration and no grounding. got %+v", requests[0].Tools)
+	assert(t, requests[0].Tools[0].FunctionDeclarations[0].Name == "test-tool", "expected function declaration to be test-tool. got %v", requests[0].Tools[0].FunctionDeclarations[0].Name)
+	assert(t, toolArgs == `{"id":1}`, "expected tool to be called with the function call args. got %v", toolArgs)
+	assert(t, len(requests[1].Contents) == 3, "expected 3 content entries in the second request. got %v", len(requests[1].Contents))
+	assert(t, requests[1].Contents[1].Parts[0].FunctionCall.Name == "test-tool", "expected second content entry to be the function call. got %+v", requests[1].Contents[1])
+
+	functionResponse := requests[1].Contents[2].Parts[0].FunctionResponse
+
+	assert(t, functionResponse != nil && string(functionResponse.Response) == `{"output":"test-tool-output"}`, "expected third content entry to be the wrapped function response. got %+v", requests[1].Contents[2])
+	assert(t, rs.Text == "test-response", "expected response text to be test-response. got %v", rs.Text)
+	assert(t, rs.Tokens == 20, "expected token count to be the sum of both requests. got %v", rs.Tokens)
+	assert(t, len(rs.Turns) == 2, "expected 2 turns. got %v", len(rs.Turns))
+	assert(t, rs.Turns[0].FunctionCalls[0].Name == "test-tool", "expected first turn to be the function call. got %+v", rs.Turns[0])
+	assert(t, rs.Turns[1].FunctionResponses[0].Name == "test-tool", "expected second turn to be the function response. got %+v", rs.Turns[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = llm.Generate(ctx, cfg, llm.Prompt{Text: "test prompt"})
+
+	assert(t, errors.Is(err, context.Canceled), "expected a cancelled context to abandon generation. got %v", err)
+}
+
+func TestLLMProviders(t *testing.T) {
+	testFile := t.TempDir() + "/test-file.txt"
+
+	if err := os.WriteFile(testFile, []byte("test-file-content"), 0644); err != nil {
+		t.Fatalf("unable to write test file. %v", err)
+	}
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	testCases := []struct {
+		provider string
+		stream   bool
+		response string
+		assertRq func(t *testing.T, r *http.Request, body map[string]any)
+	}{
+		{
+			provider: llm.ProviderOpenAI,
+			response: `{"choices":[{"message":{"role":"assistant","content":"{\"colour\":\"blue\"}"},"finish_reason":"stop"}],"usage":{"total_tokens":42}}`,
+			assertRq: func(t *testing.T, r *http.Request, body map[string]any) {
+				assert(t, r.Header.Get("Authorization") == "Bearer test-api-key", "expected bearer authorization. got %v", r.Header.Get("Authorization"))
+				messages := body["messages"].([]any)
+				assert(t, len(messages) == 4, "expected system, history and prompt messages. got %v", len(messages))
+				assert(t, messages[0].(map[string]any)["role"] == "system", "expected first message to be the system prompt. got %v", messages[0])
+				assert(t, messages[2].(map[string]any)["role"] == "assistant", "expected model history to be mapped to the assistant role. got %v", messages[2])
+				parts := messages[3].(map[string]any)["content"].([]any)
+				assert(t, len(parts) == 2 && strings.Contains(parts[1].(map[string]any)["text"].(string), "test-file-content"), "expected text file to be sent inline. got %v", parts)
+				assert(t, body["response_format"].(map[string]any)["type"] == "json_schema", "expected json schema response format. got %v", body["response_format"])
+			},
+		},
+		{
+			provider: llm.ProviderOpenAI,
+			stream:   true,
+			response: "data: {\"choices\":[{\"delta\":{\"content\":\"{\\\"colour\\\":\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"\\\"blue\\\"}\"},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"total_tokens\":42}}\n\n" +
+				"data: [DONE]\n\n",
+			assertRq: func(t *testing.T, r *http.Request, body map[string]any) {
+				assert(t, body["stream"] == true, "expected stream to be requested. got %v", body["stream"])
+			},
+		},
+		{
+			provider: llm.ProviderAnthropic,
+			response: `{"content":[{"type":"tool_use","id":"1","name":"respond","input":{"colour":"blue"}}],"stop_reason":"tool_use","usage":{"input_tokens":40,"output_tokens":2}}`,
+			assertRq: func(t *testing.T, r *http.Request, body map[string]any) {
+				assert(t, r.Header.Get("x-api-key") == "test-api-key", "expected x-api-key header. got %v", r.Header.Get("x-api-key"))
+				assert(t, r.Header.Get("anthropic-version") != "", "expected anthropic-version header")
+				assert(t, body["system"] != "", "expected system prompt to be set")
+				messages := body["messages"].([]any)
+				assert(t, len(messages) == 3, "expected history and prompt messages. got %v", len(messages))
+				assert(t, messages[1].(map[string]any)["role"] == "assistant", "expected model history to be mapped to the assistant role. got %v", messages[1])
+				blocks := messages[2].(map[string]any)["content"].([]any)
+				assert(t, len(blocks) == 2 && strings.Contains(blocks[1].(map[string]any)["text"].(string), "test-file-content"), "expected text file to be sent inline. got %v", blocks)
+				assert(t, body["tool_choice"].(map[string]any)["name"] == "respond", "expected the respond tool to be required. got %v", body["tool_choice"])
+			},
+		},
+		{
+			provider: llm.ProviderAnthropic,
+			stream:   true,
+			response: "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":40}}}\n\n" +
+				"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"tool_use\",\"id\":\"1\",\"name\":\"respond\"}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"colour\\\":\"}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"\\\"blue\\\"}\"}}\n\n" +
+				"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n" +
+				"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"},\"usage\":{\"output_tokens\":2}}\n\n",
+			assertRq: func(t *testing.T, r *http.Request, body map[string]any) {
+				assert(t, body["stream"] == true, "expected stream to be requested. got %v", body["stream"])
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v-stream-%v", tc.provider, tc.stream), func(t *testing.T) {
+			svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := map[string]any{}
+
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Fatalf("unable to decode llm stub request body. %v", err)
+				}
+
+				assert(t, body["model"] == "test-model", "expected model to be test-model. got %v", body["model"])
+				tc.assertRq(t, r, body)
+
+				io.WriteString(w, tc.response)
+			}))
+			defer svr.Close()
+
+			streamed := strings.Builder{}
+
+			cfg := llm.Config{
+				Provider:    tc.provider,
+				APIKey:      "test-api-key",
+				APIURL:      svr.URL,
+				Model:       "test-model",
+				MaxTokens:   1000,
+				Temperature: 1.0,
+				TopP:        1.0,
+				Grounding:   true,
+				DebugPrintf: func(string, ...any) {},
+			}
+
+			if tc.stream {
+				cfg.Stream = func(text string) { streamed.WriteString(text) }
+			}
+
+			rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{
+				Text:    "test prompt",
+				History: []llm.Message{{Role: llm.RoleUser, Text: "test-history-1"}, {Role: llm.RoleModel, Text: "test-history-2"}},
+				Files:   []string{testFile},
+				Schema:  `{"type":"object","properties":{"colour":{"type":"string"}}}`,
+			})
+
+			assert(t, err == nil, "expected no error generating response. got %v", err)
+			assert(t, rs.Text == `{"colour":"blue"}`, "expected structured response text. got %v", rs.Text)
+			assert(t, rs.Tokens == 42, "expected token count to be 42. got %v", rs.Tokens)
+			assert(t, len(rs.Files) == 1 && rs.Files[0].Path == testFile && rs.Files[0].MIMEType == "text/plain", "expected local file reference. got %+v", rs.Files)
+
+			if tc.stream {
+				assert(t, streamed.String() == rs.Text, "expected streamed text to be %v. got %v", rs.Text, streamed.String())
+			}
+		})
+	}
+
+	t.Run("stream-invalid-indexes", func(t *testing.T) {
+		testCases := []struct {
+			name, provider, response, err string
+		}{
+			{
+				name:     "anthropic-unstarted-delta",
+				provider: llm.ProviderAnthropic,
+				response: "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"text\"}}\n\n" +
+					"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{}\"}}\n\n",
+				err: "unexpected content block delta for index 0",
+			},
+			{
+				name:     "anthropic-unstarted-stop",
+				provider: llm.ProviderAnthropic,
+				response: "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"text\"}}\n\n" +
+					"event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":0}\n\n",
+				err: "unexpected content block stop for index 0",
+			},
+			{
+				name:     "anthropic-out-of-range-stop",
+				provider: llm.ProviderAnthropic,
+				response: "event: content_block_stop\ndata: {\"type\":\"content_block_stop\",\"index\":-1}\n\n",
+				err:      "unexpected content block stop for index -1",
+			},
+			{
+				name:     "anthropic-out-of-range-start",
+				provider: llm.ProviderAnthropic,
+				response: "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":100000000,\"content_block\":{\"type\":\"text\"}}\n\n",
+				err:      "unexpected content block start for index 100000000",
+			},
+			{
+				name:     "openai-out-of-range-tool-call",
+				provider: llm.ProviderOpenAI,
+				response: "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":100000000,\"function\":{\"arguments\":\"{}\"}}]}}]}\n\n",
+				err:      "unexpected tool call fragment for index 100000000",
+			},
+			{
+				name:     "openai-negative-tool-call",
+				provider: llm.ProviderOpenAI,
+				response: "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":-1,\"function\":{\"arguments\":\"{}\"}}]}}]}\n\n",
+				err:      "unexpected tool call fragment for index -1",
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, tc.response)
+				}))
+				defer svr.Close()
+
+				cfg := llm.Config{
+					Provider:    tc.provider,
+					APIKey:      "test-api-key",
+					APIURL:      svr.URL,
+					Model:       "test-model",
+					MaxTokens:   1000,
+					Temperature: 1.0,
+					TopP:        1.0,
+					DebugPrintf: func(string, ...any) {},
+					Stream:      func(string) {},
+				}
+
+				_, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt"})
+
+				assert(t, err != nil && strings.Contains(err.Error(), tc.err), "expected error %q for an invalid stream index. got %v", tc.err, err)
+			})
+		}
+	})
+}
+
+func TestLLMFinishReasons(t *testing.T) {
+	responses := []schema.Response{}
+	requests := []schema.Request{}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rq := schema.Request{}
+
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			t.Fatalf("unable to decode llm stub request body. %v", err)
+		}
+
+		requests = append(requests, rq)
+
+		if err := json.NewEncoder(w).Encode(responses[len(requests)-1]); err != nil {
+			t.Fatalf("unable to encode llm stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	candidate := func(text, finishReason string) schema.Response {
+		return schema.Response{
+			Candidates:    []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: text}}}, FinishReason: finishReason}},
+			UsageMetadata: schema.UsageMetadata{TotalTokenCount: 10},
+		}
+	}
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		APIURL:      svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		Model:       llm.Models.Flash,
+		MaxTokens:   1000,
+		Temperature: 1.0,
+		TopP:        1.0,
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	testCases := []struct {
+		name                 string
+		responses            []schema.Response
+		continueOnTruncation bool
+		expectedText         string
+		expectedReason       llm.FinishReason
+		expectedRequests     int
+	}{
+		{
+			name:             "truncated",
+			responses:        []schema.Response{candidate("test-part-a", schema.FinishReasonMaxTokens)},
+			expectedText:     "test-part-a",
+			expectedReason:   llm.FinishReasonMaxTokens,
+			expectedRequests: 1,
+		},
+		{
+			name:                 "truncated and continued",
+			responses:            []schema.Response{candidate("test-part-a", schema.FinishReasonMaxTokens), candidate("test-part-b", schema.FinishReasonStop)},
+			continueOnTruncation: true,
+			expectedText:         "test-part-atest-part-b",
+			expectedReason:       llm.FinishReasonStop,
+			expectedRequests:     2,
+		},
+		{
+			name:             "safety",
+			responses:        []schema.Response{candidate("", schema.FinishReasonProhibitedContent)},
+			expectedReason:   llm.FinishReasonSafety,
+			expectedRequests: 1,
+		},
+		{
+			name:             "recitation",
+			responses:        []schema.Response{candidate("test-part-a", schema.FinishReasonRecitation)},
+			expectedText:     "test-part-a",
+			expectedReason:   llm.FinishReasonRecitation,
+			expectedRequests: 1,
+		},
+		{
+			name:             "prompt blocked",
+			responses:        []schema.Response{{PromptFeedback: &schema.PromptFeedback{BlockReason: "SAFETY"}}},
+			expectedReason:   llm.FinishReasonSafety,
+			expectedRequests: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			responses, requests = tc.responses, nil
+			cfg.ContinueOnTruncation = tc.continueOnTruncation
+
+			rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt"})
+
+			assert(t, err == nil, "expected no error generating response. got %v", err)
+			assert(t, rs.Text == tc.expectedText, "expected response text to be %q. got %q", tc.expectedText, rs.Text)
+			assert(t, rs.FinishReason == tc.expectedReason, "expected finish reason to be %v. got %v", tc.expectedReason, rs.FinishReason)
+			assert(t, len(requests) == tc.expectedRequests, "expected %v requests. got %v", tc.expectedRequests, len(requests))
+
+			if tc.continueOnTruncation {
+				assert(t, len(requests[1].Contents) == 3, "expected continuation request to include the partial response and a continuation prompt. got %+v", requests[1].Contents)
+				assert(t, requests[1].Contents[1].Parts[0].Text == "test-part-a", "expected partial response to be sent. got %+v", requests[1].Contents[1])
+			}
+		})
+	}
+}
+
+func TestLLMGrounding(t *testing.T) {
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rs := schema.Response{
+			Candidates: []schema.Candidate{{
+				Content:      schema.Content{Role: "model", Parts: []schema.Part{{Text: "test-claim-a. test-claim-b."}}},
+				FinishReason: schema.FinishReasonStop,
+				GroundingMetadata: &schema.GroundingMetadata{
+					WebSearchQueries: []string{"test-query"},
+					GroundingChunks: []schema.GroundingChunk{
+						{Web: &schema.WebChunk{URI: "https://test-source-a", Title: "test-title-a"}},
+						{Web: &schema.WebChunk{URI: "https://test-source-b", Title: "test-title-b"}},
+					},
+					GroundingSupports: []schema.GroundingSupport{
+						{Segment: schema.Segment{StartIndex: 0, EndIndex: 13, Text: "test-claim-a."}, GroundingChunkIndices: []int{0}},
+						{Segment: schema.Segment{StartIndex: 14, EndIndex: 27, Text: "test-claim-b."}, GroundingChunkIndices: []int{0, 1}},
+					},
+				},
+			}},
+			UsageMetadata: schema.UsageMetadata{TotalTokenCount: 10},
+		}
+
+		if err := json.NewEncoder(w).Encode(rs); err != nil {
+			t.Fatalf("unable to encode llm stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		APIURL:      svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		Model:       llm.Models.Flash,
+		MaxTokens:   1000,
+		Temperature: 1.0,
+		TopP:        1.0,
+		Grounding:   true,
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt"})
+
+	if err != nil {
+		t.Fatalf("expected no error generating response. got %v", err)
+	}
+
+	if rs.Grounding == nil {
+		t.Fatalf("expected grounding in response. got none")
+	}
+
+	if len(rs.Grounding.Queries) != 1 || rs.Grounding.Queries[0] != "test-query" {
+		t.Fatalf("expected search queries to be returned. got %+v", rs.Grounding.Queries)
+	}
+
+	if len(rs.Grounding.Sources) != 2 || rs.Grounding.Sources[1].URI != "https://test-source-b" || rs.Grounding.Sources[1].Title != "test-title-b" {
+		t.Fatalf("expected 2 sources to be returned. got %+v", rs.Grounding.Sources)
+	}
+
+	if len(rs.Grounding.Supports) != 2 || rs.Grounding.Supports[1].Start != 14 || rs.Grounding.Supports[1].End != 27 || len(rs.Grounding.Supports[1].Sources) != 2 {
+		t.Fatalf("expected 2 supports to be returned. got %+v", rs.Grounding.Supports)
+	}
+}
+
+func TestLLMCache(t *testing.T) {
+	caches := map[string]schema.CachedContent{}
+	generateRequests := []schema.Request{}
+	generateModels := []string{}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "test-api-key" {
+			t.Fatalf("expected api key to be specified. got %q", r.URL.RawQuery)
+		}
+
+		var rs any
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/test-generate-url"):
+			rq := schema.Request{}
+			if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+				t.Fatalf("unable to decode llm stub request body. %v", err)
+			}
+			generateRequests, generateModels = append(generateRequests, rq), append(generateModels, r.URL.Query().Get("model"))
+			rs = schema.Response{
+				Candidates:    []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: "test-response"}}}, FinishReason: schema.FinishReasonStop}},
+				UsageMetadata: schema.UsageMetadata{TotalTokenCount: 100, CachedContentTokenCount: 80},
+			}
+		case r.URL.Path == "/cachedContents" && r.Method == http.MethodPost:
+			rq := schema.CachedContent{}
+			if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+				t.Fatalf("unable to decode cache stub request body. %v", err)
+			}
+			rq.Name, rq.TTL, rq.ExpireTime = "cachedContents/test-id", "", "2030-01-01T00:00:00Z"
+			rq.UsageMetadata = &schema.UsageMetadata{TotalTokenCount: 5000}
+			caches[rq.Name] = rq
+			rs = rq
+		case r.URL.Path == "/cachedContents" && r.Method == http.MethodGet:
+			list := schema.CachedContentList{}
+			for _, c := range caches {
+				list.CachedContents = append(list.CachedContents, c)
+			}
+			rs = list
+		case r.Method == http.MethodPatch:
+			c := caches[strings.TrimPrefix(r.URL.Path, "/")]
+			if r.URL.Query().Get("updateMask") != "ttl" {
+				t.Fatalf("expected ttl update mask. got %q", r.URL.RawQuery)
+			}
+			c.ExpireTime = "2031-01-01T00:00:00Z"
+			caches[c.Name] = c
+			rs = c
+		case r.Method == http.MethodDelete:
+			delete(caches, strings.TrimPrefix(r.URL.Path, "/"))
+			rs = struct{}{}
+		default:
+			t.Fatalf("unexpected request %v %v", r.Method, r.URL)
+		}
+
+		if err := json.NewEncoder(w).Encode(rs); err != nil {
+			t.Fatalf("unable to encode stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	cfg := llm.Config{
+		APIKey:       "test-api-key",
+		APIURL:       svr.URL + "/test-generate-url/?model=%v&key=%v",
+		CacheURL:     svr.URL + "/%v?key=%v",
+		SystemPrompt: "test-system-prompt",
+		Model:        llm.Models.Pro,
+		MaxTokens:    1000,
+		Temperature:  1.0,
+		TopP:         1.0,
+		DebugPrintf:  func(string, ...any) {},
+	}
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	ctx := context.Background()
+
+	cache, err := llm.CreateCache(ctx, cfg, "test-cache", nil, time.Hour)
+	assert(t, err == nil, "expected no error creating cache. got %v", err)
+	assert(t, cache.Name == "test-cache" && cache.ID == "cachedContents/test-id" && cache.Model == llm.Models.Pro && cache.Tokens == 5000, "expected cache to be created. got %+v", cache)
+	assert(t, caches[cache.ID].SystemInstruction != nil && strings.HasPrefix(caches[cache.ID].SystemInstruction.Parts[0].Text, "test-system-prompt"), "expected system prompt to be cached. got %+v", caches[cache.ID])
+
+	_, err = llm.CreateCache(ctx, cfg, "test-cache", nil, time.Hour)
+	assert(t, err != nil, "expected error creating cache with duplicate name. got none")
+
+	cache, err = llm.ExtendCache(ctx, cfg, "test-cache", 2*time.Hour)
+	assert(t, err == nil, "expected no error extending cache. got %v", err)
+	assert(t, cache.Expires.Year() == 2031, "expected cache expiry to be extended. got %v", cache.Expires)
+
+	cfg.Model, cfg.Cache, cfg.Grounding = llm.Models.Flash, "test-cache", true
+
+	rs, err := llm.Generate(ctx, cfg, llm.Prompt{Text: "test prompt"})
+	assert(t, err == nil, "expected no error generating response with cache. got %v", err)
+	assert(t, rs.Tokens == 100 && rs.CachedTokens == 80, "expected 100 tokens of which 80 are cached. got %v and %v", rs.Tokens, rs.CachedTokens)
+	assert(t, generateRequests[0].CachedContent == "cachedContents/test-id", "expected cached content to be referenced. got %q", generateRequests[0].CachedContent)
+	assert(t, generateRequests[0].SystemInstruction == nil && len(generateRequests[0].Tools) == 0, "expected no system instruction or tools with cache. got %+v", generateRequests[0])
+	assert(t, generateModels[0] == llm.Models.Pro, "expected model of cache to be used. got %v", generateModels[0])
+
+	cfg.Tools = []llm.Tool{{Name: "test-tool"}}
+	_, err = llm.Generate(ctx, cfg, llm.Prompt{Text: "test prompt"})
+	assert(t, err != nil, "expected error generating response with cache and tools. got none")
+
+	err = llm.DeleteCache(ctx, cfg, "test-cache")
+	assert(t, err == nil, "expected no error deleting cache. got %v", err)
+
+	list, err := llm.ListCaches(ctx, cfg)
+	assert(t, err == nil && len(list) == 0, "expected no caches after delete. got %v, %v", list, err)
+}
+
+func TestLLMExpiredFiles(t *testing.T) {
+	resource.Deps.OS_Stat = os.Stat
+	resource.Deps.OS_Open = func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	dir := t.TempDir()
+	availableFile, changedFile, missingFile := filepath.Join(dir, "available.txt"), filepath.Join(dir, "changed.txt"), filepath.Join(dir, "missing.txt")
+
+	for _, file := range []string{availableFile, changedFile} {
+		if err := os.WriteFile(file, []byte("test-data"), 0644); err != nil {
+			t.Fatalf("unable to write test file. %v", err)
+		}
+	}
+
+	mimeType, err := resource.MIMEType(availableFile)
+
+	if err != nil {
+		t.Fatalf("unable to detect mime type of test file. %v", err)
+	}
+
+	hash, err := resource.Hash(availableFile, mimeType)
+
+	if err != nil {
+		t.Fatalf("unable to hash test file. %v", err)
+	}
+
+	var (
+		svr     *httptest.Server
+		request schema.Request
+		uploads int
+	)
+
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rs any
+
+		switch r.URL.Path {
+		case "/test-generate-url/":
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Fatalf("unable to decode llm stub request body. %v", err)
+			}
+			rs = schema.Response{
+				Candidates: []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: "test-response"}}}, FinishReason: schema.FinishReasonStop}},
+			}
+		case "/test-start-upload-url/":
+			w.Header().Set("X-Goog-Upload-Url", svr.URL+"/test-upload-url/")
+			return
+		case "/test-upload-url/":
+			uploads++
+			rs = map[string]any{"file": map[string]string{"displayName": "available.txt", "mimeType": "text/plain", "uri": "test-new-uri", "expirationTime": time.Now().Add(48 * time.Hour).Format(time.RFC3339)}}
+		default:
+			t.Fatalf("unexpected request to %v", r.URL.Path)
+		}
+
+		if err := json.NewEncoder(w).Encode(rs); err != nil {
+			t.Fatalf("unable to encode stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		APIURL:      svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		UploadURL:   svr.URL + "/test-start-upload-url/?api-key=%v",
+		Model:       llm.Models.Flash,
+		MaxTokens:   1000,
+		Temperature: 1.0,
+		TopP:        1.0,
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	expired, valid := time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour)
+
+	history := []llm.Message{
+		{Role: llm.RoleUser, Text: "test-history-1", Files: []llm.FileReference{
+			{URI: "test-expired-uri", MIMEType: "text/plain", Label: "available.txt", Path: availableFile, Hash: hash, Expires: expired},
+			{URI: "test-changed-uri", MIMEType: "text/plain", Label: "changed.txt", Path: changedFile, Hash: "test-old-hash", Expires: expired},
+			{URI: "test-missing-uri", MIMEType: "text/plain", Label: "missing.txt", Path: missingFile, Hash: hash, Expires: expired},
+			{URI: "test-valid-uri", MIMEType: "text/plain", Label: "valid.txt", Path: missingFile, Hash: hash, Expires: valid},
+		}},
+		{Role: llm.RoleModel, Text: "test-history-2"},
+	}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	if err != nil {
+		t.Fatalf("expected no error generating response. got %v", err)
+	}
+
+	if uploads != 1 {
+		t.Fatalf("expected only the expired, available and unchanged file to be uploaded. got %v uploads", uploads)
+	}
+
+	if len(rs.Warnings) != 2 || !strings.Contains(rs.Warnings[0], "changed.txt") || !strings.Contains(rs.Warnings[1], "missing.txt") {
+		t.Fatalf("expected warnings for the changed and missing files. got %v", rs.Warnings)
+	}
+
+	files := rs.History[0].Files
+
+	if len(files) != 2 || files[0].URI != "test-new-uri" || files[0].Path != availableFile || files[1].URI != "test-valid-uri" {
+		t.Fatalf("expected the expired file to be replaced and the changed and missing files to be removed. got %+v", files)
+	}
+
+	if parts := request.Contents[0].Parts; len(parts) != 3 || parts[1].File.URI != "test-new-uri" || parts[2].File.URI != "test-valid-uri" {
+		t.Fatalf("expected the refreshed file references to be sent. got %+v", parts)
+	}
+
+	if history[0].Files[0].URI != "test-expired-uri" {
+		t.Fatalf("expected the specified history to be left unchanged. got %+v", history[0].Files[0])
+	}
+}
+
+func TestLLMConcurrentUploads(t *testing.T) {
+	resource.Deps.OS_Stat = os.Stat
+	resource.Deps.OS_Open = func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	dir := t.TempDir()
+	files := []string{}
+
+	for _, name := range []string{"fail-a.txt", "fail-b.txt", "ok-a.txt", "ok-b.txt", "ok-c.txt", "ok-d.txt"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatalf("unable to write test file. %v", err)
+		}
+		files = append(files, file)
+	}
+
+	var (
+		svr                 *httptest.Server
+		mu                  sync.Mutex
+		inFlight, maxFlight int
+		failures            sync.WaitGroup
+	)
+
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test-generate-url/":
+			json.NewEncoder(w).Encode(schema.Response{
+				Candidates: []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: "test-response"}}}, FinishReason: schema.FinishReasonStop}},
+			})
+		case "/test-start-upload-url/":
+			w.Header().Set("X-Goog-Upload-Url", svr.URL+"/test-upload-url/")
+		case "/test-upload-url/":
+			mu.Lock()
+			inFlight++
+			maxFlight = max(maxFlight, inFlight)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+
+			json.NewEncoder(w).Encode(map[string]any{"file": map[string]string{"displayName": "test-file", "mimeType": "text/plain", "uri": "test-uri"}})
+		default:
+			t.Fatalf("unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer svr.Close()
+
+	progress := []int{}
+
+	cfg := llm.Config{
+		APIKey:            "test-api-key",
+		APIURL:            svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		UploadURL:         svr.URL + "/test-start-upload-url/?api-key=%v",
+		UploadConcurrency: 2,
+		UploadProgress:    func(file string, completed, total int) { progress = append(progress, completed) },
+		Model:             llm.Models.Flash,
+		MaxTokens:         1000,
+		Temperature:       1.0,
+		TopP:              1.0,
+		DebugPrintf:       func(string, ...any) {},
+	}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", Files: files[2:]})
+
+	if err != nil {
+		t.Fatalf("expected no error generating response. got %v", err)
+	}
+
+	if len(rs.Files) != 4 || maxFlight != 2 {
+		t.Fatalf("expected 4 files to be uploaded with at most 2 in progress at once. got %v files and %v at once", len(rs.Files), maxFlight)
+	}
+
+	if !slices.Equal(progress, []int{1, 2, 3, 4}) {
+		t.Fatalf("expected progress to be reported for each file. got %v", progress)
+	}
+
+	cfg.UploadConcurrency = len(files)
+	failures.Add(2)
+
+	resource.Deps.OS_Open = func(name string) (io.ReadCloser, error) {
+		if strings.Contains(name, "fail-") {
+			failures.Done()
+			failures.Wait() // fail neither file until both are being read, so that neither is cancelled by the failure of the other
+			return nil, fmt.Errorf("test-read-error")
+		}
+		return os.Open(name)
+	}
+
+	_, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", Files: files})
+
+	if err == nil || !strings.Contains(err.Error(), "fail-a.txt") || !strings.Contains(err.Error(), "fail-b.txt") {
+		t.Fatalf("expected an error reporting both failed files. got %v", err)
+	}
+}
+
+func TestLLMInlineFiles(t *testing.T) {
+	resource.Deps.OS_Stat = os.Stat
+	resource.Deps.OS_Open = func(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+	dir := t.TempDir()
+	smallFile, largeFile := filepath.Join(dir, "small.txt"), filepath.Join(dir, "large.txt")
+
+	if err := os.WriteFile(smallFile, []byte("test-small"), 0644); err != nil {
+		t.Fatalf("unable to write test file. %v", err)
+	}
+
+	if err := os.WriteFile(largeFile, []byte(strings.Repeat("test-large", 10)), 0644); err != nil {
+		t.Fatalf("unable to write test file. %v", err)
+	}
+
+	var (
+		svr       *httptest.Server
+		uploads   = []string{}
+		actualRqs = []schema.Request{}
+	)
+
+	svr = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/test-generate-url/":
+			rq := schema.Request{}
+			json.NewDecoder(r.Body).Decode(&rq)
+			actualRqs = append(actualRqs, rq)
+			json.NewEncoder(w).Encode(schema.Response{
+				Candidates: []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: "test-response"}}}, FinishReason: schema.FinishReasonStop}},
+			})
+		case "/test-start-upload-url/":
+			data, _ := io.ReadAll(r.Body)
+			uploads = append(uploads, string(data))
+			w.Header().Set("X-Goog-Upload-Url", svr.URL+"/test-upload-url/")
+		case "/test-upload-url/":
+			json.NewEncoder(w).Encode(map[string]any{"file": map[string]string{"displayName": "large.txt", "mimeType": "text/plain", "uri": "test-uri"}})
+		default:
+			t.Fatalf("unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer svr.Close()
+
+	cfg := llm.Config{
+		APIKey:         "test-api-key",
+		APIURL:         svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		UploadURL:      svr.URL + "/test-start-upload-url/?api-key=%v",
+		InlineMaxBytes: 50,
+		Model:          llm.Models.Flash,
+		MaxTokens:      1000,
+		Temperature:    1.0,
+		TopP:           1.0,
+		DebugPrintf:    func(string, ...any) {},
+	}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", Files: []string{smallFile, largeFile}})
+
+	if err != nil {
+		t.Fatalf("expected no error generating response. got %v", err)
+	}
+
+	if len(uploads) != 1 || !strings.Contains(uploads[0], "large.txt") {
+		t.Fatalf("expected only the large file to be uploaded. got %v", uploads)
+	}
+
+	parts := actualRqs[0].Contents[0].Parts
+
+	if len(parts) != 3 || parts[1].InlineData == nil || string(parts[1].InlineData.Data) != "test-small" || parts[2].File == nil || parts[2].File.URI != "test-uri" {
+		t.Fatalf("expected the small file as inline data and the large file as file data. got %+v", parts)
+	}
+
+	if len(rs.Files) != 2 || string(rs.Files[0].Data) != "test-small" || rs.Files[0].URI != "" {
+		t.Fatalf("expected the inline file reference to hold its content. got %+v", rs.Files)
+	}
+
+	_, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test follow-up", History: []llm.Message{
+		{Role: llm.RoleUser, Text: "test prompt", Files: rs.Files},
+		{Role: llm.RoleModel, Text: rs.Text},
+	}})
+
+	if err != nil {
+		t.Fatalf("expected no error generating response. got %v", err)
+	}
+
+	if parts := actualRqs[1].Contents[0].Parts; len(parts) != 3 || parts[1].InlineData == nil || string(parts[1].InlineData.Data) != "test-small" {
+		t.Fatalf("expected the inline file to be replayed from history. got %+v", parts)
+	}
+}
+
+func TestLLMRemoteFiles(t *testing.T) {
+	remoteFiles := map[string]schema.File{
+		"files/test-a": {Name: "files/test-a", DisplayName: "a.txt", SizeBytes: "100", ExpirationTime: "2030-01-01T00:00:00Z", URI: "https://test/v1beta/files/test-a"},
+		"files/test-b": {Name: "files/test-b", DisplayName: "b.txt", SizeBytes: "200", ExpirationTime: "2030-01-01T00:00:00Z", URI: "https://test/v1beta/files/test-b"},
+	}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rs any
+
+		switch {
+		case r.URL.Path == "/files" && r.Method == http.MethodGet: // each page holds a single file, to exercise pagination
+			names := slices.Sorted(maps.Keys(remoteFiles))
+			i := slices.Index(names, r.URL.Query().Get("pageToken")) + 1
+			list := schema.FileList{}
+			if i < len(names) {
+				list.Files = []schema.File{remoteFiles[names[i]]}
+			}
+			if i+1 < len(names) {
+				list.NextPageToken = names[i]
+			}
+			rs = list
+		case r.Method == http.MethodDelete:
+			delete(remoteFiles, strings.TrimPrefix(r.URL.Path, "/"))
+			rs = struct{}{}
+		default:
+			t.Fatalf("unexpected request %v %v", r.Method, r.URL)
+		}
+
+		if err := json.NewEncoder(w).Encode(rs); err != nil {
+			t.Fatalf("unable to encode stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	indexFile := filepath.Join(t.TempDir(), "uploads")
+
+	if err := os.WriteFile(indexFile, []byte(`{"test-key":{"uri":"https://test/v1beta/files/test-a","mimeType":"text/plain","label":"a.txt","expires":"2030-01-01T00:00:00Z"}}`), 0644); err != nil {
+		t.Fatalf("unable to write test upload index. %v", err)
+	}
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		FilesURL:    svr.URL + "/%v?key=%v",
+		UploadIndex: indexFile,
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	files, err := llm.ListRemoteFiles(context.Background(), cfg)
+
+	if err != nil {
+		t.Fatalf("expected no error listing remote files. got %v", err)
+	}
+
+	if len(files) != 2 || files[0].ID != "files/test-a" || files[0].Size != 100 || files[1].Name != "b.txt" || files[1].Expires.Year() != 2030 {
+		t.Fatalf("expected both remote files to be listed across pages. got %+v", files)
+	}
+
+	if uploads := llm.Uploads(cfg); !slices.Equal(uploads, []string{"https://test/v1beta/files/test-a"}) {
+		t.Fatalf("expected the indexed upload to be returned. got %v", uploads)
+	}
+
+	if err := llm.DeleteRemoteFile(context.Background(), cfg, "https://test/v1beta/files/test-a"); err != nil {
+		t.Fatalf("expected no error deleting remote file. got %v", err)
+	}
+
+	if _, ok := remoteFiles["files/test-a"]; ok || len(remoteFiles) != 1 {
+		t.Fatalf("expected only the specified remote file to be deleted. got %+v", remoteFiles)
+	}
+
+	if uploads := llm.Uploads(cfg); len(uploads) != 0 {
+		t.Fatalf("expected the deleted file to be removed from the upload index. got %v", uploads)
+	}
+
+	if err := llm.DeleteRemoteFile(context.Background(), cfg, "test-b"); err != nil || len(remoteFiles) != 0 {
+		t.Fatalf("expected remote file to be deleted by id. got %v and %+v", err, remoteFiles)
+	}
+}
+
+func TestLLMCompaction(t *testing.T) {
+	requests := []schema.Request{}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rq := schema.Request{}
+
+		if err := json.NewDecoder(r.Body).Decode(&rq); err != nil {
+			t.Fatalf("unable to decode llm stub request body. %v", err)
+		}
+
+		requests = append(requests, rq)
+
+		if err := json.NewEncoder(w).Encode(schema.Response{
+			Candidates:    []schema.Candidate{{Content: schema.Content{Role: "model", Parts: []schema.Part{{Text: fmt.Sprintf("test-response-%v", len(requests))}}}, FinishReason: schema.FinishReasonStop}},
+			UsageMetadata: schema.UsageMetadata{TotalTokenCount: 10},
+		}); err != nil {
+			t.Fatalf("unable to encode llm stub response body. %v", err)
+		}
+	}))
+	defer svr.Close()
+
+	history := []llm.Message{}
+
+	for i := range 3 { // each exchange is estimated at 200 tokens
+		history = append(history,
+			llm.Message{Role: llm.RoleUser, Text: fmt.Sprintf("%v%v", i, strings.Repeat("p", 399))},
+			llm.Message{Role: llm.RoleModel, Text: strings.Repeat("r", 400)},
+		)
+	}
+
+	cfg := llm.Config{
+		APIKey:      "test-api-key",
+		APIURL:      svr.URL + "/test-generate-url/?model=%v&api-key=%v",
+		Model:       llm.Models.Flash,
+		MaxTokens:   1000,
+		Temperature: 1.0,
+		TopP:        1.0,
+		DebugPrintf: func(string, ...any) {},
+	}
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	cfg.Compaction = llm.Compaction{Budget: 600, Strategy: llm.CompactionWindow}
+
+	rs, err := llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	assert(t, err == nil, "expected no error generating response. got %v", err)
+	assert(t, len(rs.History) == 6 && len(rs.Archived) == 0, "expected history within the budget not to be compacted. got %v messages and %v archived", len(rs.History), len(rs.Archived))
+	assert(t, len(requests[0].Contents) == 7, "expected the full history to be sent. got %v content entries", len(requests[0].Contents))
+
+	requests = requests[:0]
+	cfg.Compaction = llm.Compaction{Budget: 500, Strategy: llm.CompactionWindow}
+
+	rs, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	assert(t, err == nil, "expected no error generating response. got %v", err)
+	assert(t, len(requests) == 1, "expected a single request when removing exchanges. got %v", len(requests))
+	assert(t, len(rs.Archived) == 2 && rs.Archived[0].Text == history[0].Text, "expected the oldest exchange to be archived. got %+v", rs.Archived)
+	assert(t, len(rs.History) == 4 && rs.History[0].Text == history[2].Text, "expected the most recent exchanges to be retained. got %v messages", len(rs.History))
+	assert(t, len(requests[0].Contents) == 5, "expected only the retained history to be sent. got %v content entries", len(requests[0].Contents))
+
+	requests = requests[:0]
+	cfg.Compaction = llm.Compaction{Budget: 500, Strategy: llm.CompactionSummarise}
+
+	rs, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	assert(t, err == nil, "expected no error generating response. got %v", err)
+	assert(t, len(requests) == 2, "expected a request to summarise the history and one for the prompt. got %v", len(requests))
+	assert(t, len(requests[0].Contents) == 5, "expected the two oldest exchanges and the summary prompt to be sent for summary. got %v content entries", len(requests[0].Contents))
+	assert(t, len(rs.Archived) == 4 && rs.Archived[2].Text == history[2].Text, "expected the two oldest exchanges to be archived. got %v messages", len(rs.Archived))
+	assert(t, len(rs.History) == 4 && strings.HasSuffix(rs.History[0].Text, "test-response-1") && rs.History[2].Text == history[4].Text, "expected the summary to precede the retained exchange. got %+v", rs.History)
+	assert(t, len(requests[1].Contents) == 5 && requests[1].Contents[4].Parts[0].Text == "test prompt", "expected the summary, retained exchange and prompt to be sent. got %v content entries", len(requests[1].Contents))
+	assert(t, rs.Text == "test-response-2", "expected response text to be test-response-2. got %v", rs.Text)
+	assert(t, rs.Tokens == 20, "expected token count to include the summary. got %v", rs.Tokens)
+
+	requests = requests[:0]
+	cfg.Compaction = llm.Compaction{Budget: 1, Strategy: llm.CompactionWindow}
+
+	rs, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	assert(t, err == nil, "expected no error generating response. got %v", err)
+	assert(t, len(rs.Archived) == 6, "expected the whole history to be archived. got %v messages", len(rs.Archived))
+	assert(t, rs.History != nil && len(rs.History) == 0, "expected an empty, rather than nil, history when the whole history is archived. got %#v", rs.History)
+	assert(t, len(requests[0].Contents) == 1, "expected only the prompt to be sent. got %v content entries", len(requests[0].Contents))
+
+	cfg.Compaction = llm.Compaction{Budget: 500, Strategy: "test-invalid-strategy"}
+
+	_, err = llm.Generate(context.Background(), cfg, llm.Prompt{Text: "test prompt", History: history})
+
+	assert(t, err != nil, "expected an error for an invalid compaction strategy")
 }
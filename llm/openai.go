@@ -0,0 +1,252 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/comradequinn/gen/llm/internal/schema/openai"
+)
+
+// openAIProvider is the provider for openai-compatible chat completions apis, such as those of openai itself, ollama or llama.cpp
+type openAIProvider struct{}
+
+func (openAIProvider) attach(_ context.Context, _ Config, files []string) ([]FileReference, error) {
+	return attachLocal(files)
+}
+
+func (openAIProvider) generate(ctx context.Context, cfg Config, rq request) (result, error) {
+	messages := []openai.Message{{Role: openai.RoleSystem, Content: rq.SystemPrompt}}
+
+	for _, message := range rq.Messages {
+		messages = append(messages, openAIMessages(cfg, message)...)
+	}
+
+	request := openai.Request{
+		Model:               cfg.Model,
+		Messages:            messages,
+		Temperature:         cfg.Temperature,
+		TopP:                cfg.TopP,
+		MaxCompletionTokens: cfg.MaxTokens,
+		Stream:              cfg.Stream != nil,
+	}
+
+	if request.Stream {
+		request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	for _, tool := range cfg.Tools {
+		request.Tools = append(request.Tools, openai.Tool{
+			Type:     "function",
+			Function: openai.Function{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters},
+		})
+	}
+
+	if rq.Schema != "" {
+		request.ResponseFormat = &openai.ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &openai.JSONSchema{Name: "response", Schema: json.RawMessage(rq.Schema)},
+		}
+	}
+
+	body := bytes.Buffer{}
+	if err := json.NewEncoder(&body).Encode(request); err != nil {
+		return result{}, fmt.Errorf("unable to encode llm request as json. %w", err)
+	}
+
+	cfg.DebugPrintf("sending chat completions request", "type", "generate_request", "url", cfg.APIURL, "request", body.String())
+
+	headers := map[string]string{}
+
+	if cfg.APIKey != "" { // self-hosted servers, such as ollama, typically do not require a key
+		headers["Authorization"] = "Bearer " + cfg.APIKey
+	}
+
+	rs, err := post(ctx, cfg, cfg.APIURL, headers, body.Bytes())
+
+	if err != nil {
+		return result{}, err
+	}
+
+	defer rs.Body.Close()
+
+	var response openai.Response
+
+	if request.Stream {
+		response, err = openAIStream(cfg, rs.Body)
+	} else {
+		var data []byte
+		if data, err = io.ReadAll(rs.Body); err != nil {
+			return result{}, fmt.Errorf("unable to read response body. %w", err)
+		}
+		cfg.DebugPrintf("received chat completions response", "type", "generate_response", "status", rs.Status, "response", string(data))
+		if err = json.Unmarshal(data, &response); err != nil {
+			err = fmt.Errorf("unable to parse response body. %w", err)
+		}
+	}
+
+	if err != nil {
+		return result{}, err
+	}
+
+	if len(response.Choices) == 0 {
+		return result{}, fmt.Errorf("no response choices returned. response: %+v", response)
+	}
+
+	message := Message{Role: RoleModel, Text: response.Choices[0].Message.Content}
+
+	for _, toolCall := range response.Choices[0].Message.ToolCalls {
+		message.FunctionCalls = append(message.FunctionCalls, FunctionCall{
+			ID:   toolCall.ID,
+			Name: toolCall.Function.Name,
+			Args: json.RawMessage(toolCall.Function.Arguments),
+		})
+	}
+
+	tokens := 0
+
+	if response.Usage != nil {
+		tokens = response.Usage.TotalTokens
+	}
+
+	return result{
+		Message:      message,
+		Tokens:       tokens,
+		FinishReason: openAIFinishReason(response.Choices[0].FinishReason),
+		FinishDetail: response.Choices[0].FinishReason,
+	}, nil
+}
+
+// openAIFinishReason maps the specified chat completions finish reason to its provider-agnostic equivalent
+func openAIFinishReason(finishReason string) FinishReason {
+	switch finishReason {
+	case openai.FinishReasonStop, openai.FinishReasonToolCalls:
+		return FinishReasonStop
+	case openai.FinishReasonLength:
+		return FinishReasonMaxTokens
+	case openai.FinishReasonContentFilter:
+		return FinishReasonSafety
+	default:
+		return FinishReasonOther
+	}
+}
+
+// openAIMessages converts the specified message to its chat completions representation. function responses are
+// represented as one tool message per response
+func openAIMessages(cfg Config, message Message) []openai.Message {
+	if len(message.FunctionResponses) > 0 {
+		messages := make([]openai.Message, 0, len(message.FunctionResponses))
+		for _, functionResponse := range message.FunctionResponses {
+			messages = append(messages, openai.Message{Role: openai.RoleTool, ToolCallID: functionResponse.ID, Content: string(functionResponse.Response)})
+		}
+		return messages
+	}
+
+	if message.Role == RoleModel {
+		assistant := openai.Message{Role: openai.RoleAssistant, Content: message.Text}
+		for _, functionCall := range message.FunctionCalls {
+			args := string(functionCall.Args)
+			if args == "" {
+				args = "{}"
+			}
+			assistant.ToolCalls = append(assistant.ToolCalls, openai.ToolCall{
+				ID:       functionCall.ID,
+				Type:     "function",
+				Function: openai.FunctionCall{Name: functionCall.Name, Arguments: args},
+			})
+		}
+		return []openai.Message{assistant}
+	}
+
+	if len(message.Files) == 0 {
+		return []openai.Message{{Role: openai.RoleUser, Content: message.Text}}
+	}
+
+	parts := []openai.ContentPart{{Type: "text", Text: message.Text}}
+
+	for _, fileReference := range message.Files {
+		text, data, ok := readLocal(cfg, fileReference)
+
+		switch {
+		case !ok:
+			continue
+		case text != "":
+			parts = append(parts, openai.ContentPart{Type: "text", Text: text})
+		case strings.HasPrefix(fileReference.MIMEType, "image/"):
+			parts = append(parts, openai.ContentPart{Type: "image_url", ImageURL: &openai.ImageURL{URL: "data:" + fileReference.MIMEType + ";base64," + data}})
+		default:
+			parts = append(parts, openai.ContentPart{Type: "file", File: &openai.File{Filename: fileReference.Label, FileData: "data:" + fileReference.MIMEType + ";base64," + data}})
+		}
+	}
+
+	return []openai.Message{{Role: openai.RoleUser, Content: parts}}
+}
+
+// openAIStream reads a streamed chat completions response, passing each text delta to cfg.Stream as it arrives.
+// the deltas are merged into a single response equivalent to that which a non-streamed request would have returned
+func openAIStream(cfg Config, stream io.Reader) (openai.Response, error) {
+	response := openai.Response{Choices: []openai.Choice{{Message: openai.ResponseMessage{Role: openai.RoleAssistant}}}}
+	choice := &response.Choices[0]
+
+	err := readEvents(stream, func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return nil
+		}
+
+		cfg.DebugPrintf("received chat completions chunk", "type", "stream_generate_chunk", "chunk", string(data))
+
+		chunk := openai.Response{}
+
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("unable to parse response chunk. %w", err)
+		}
+
+		if chunk.Usage != nil {
+			response.Usage = chunk.Usage
+		}
+
+		if len(chunk.Choices) == 0 {
+			return nil
+		}
+
+		delta := chunk.Choices[0].Delta
+
+		if delta.Content != "" {
+			cfg.Stream(delta.Content)
+			choice.Message.Content += delta.Content
+		}
+
+		for _, toolCall := range delta.ToolCalls { // tool calls are streamed as fragments identified by their index
+			if toolCall.Index < 0 || toolCall.Index > maxStreamIndex {
+				return fmt.Errorf("unexpected tool call fragment for index %v", toolCall.Index)
+			}
+
+			for len(choice.Message.ToolCalls) <= toolCall.Index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, openai.ToolCall{Index: len(choice.Message.ToolCalls)})
+			}
+
+			merged := &choice.Message.ToolCalls[toolCall.Index]
+
+			if toolCall.ID != "" {
+				merged.ID = toolCall.ID
+			}
+
+			if toolCall.Function.Name != "" {
+				merged.Function.Name = toolCall.Function.Name
+			}
+
+			merged.Function.Arguments += toolCall.Function.Arguments
+		}
+
+		if chunk.Choices[0].FinishReason != "" {
+			choice.FinishReason = chunk.Choices[0].FinishReason
+		}
+
+		return nil
+	})
+
+	return response, err
+}
@@ -0,0 +1,198 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/comradequinn/gen/llm/internal/resource"
+	"github.com/comradequinn/gen/llm/internal/retry"
+)
+
+type (
+	// provider is implemented by each llm api that can serve a Generate call
+	provider interface {
+		// attach prepares the specified local files for inclusion in the next message sent to the provider
+		attach(ctx context.Context, cfg Config, files []string) ([]FileReference, error)
+		// generate sends the request to the provider and returns the next model message
+		generate(ctx context.Context, cfg Config, rq request) (result, error)
+	}
+	request struct {
+		SystemPrompt string
+		Messages     []Message
+		Schema       string
+		Cache        string
+	}
+	result struct {
+		Message      Message
+		Tokens       int
+		CachedTokens int
+		FinishReason FinishReason
+		FinishDetail string
+	}
+)
+
+var providers = map[string]provider{
+	ProviderGemini:    geminiProvider{},
+	ProviderOpenAI:    openAIProvider{},
+	ProviderAnthropic: anthropicProvider{},
+}
+
+// ErrUnsupportedFileType is returned by MIMEType for files of a type that cannot be attached
+var ErrUnsupportedFileType = resource.ErrUnsupportedType
+
+// MIMEType returns the mime type of the specified file, as it is described when attached to a prompt. An error is returned
+// if the file is of a type that cannot be attached, or cannot be read
+func MIMEType(file string) (string, error) {
+	return resource.MIMEType(file)
+}
+
+// post sends the json encoded body to the specified url, retrying in accordance with the configured policy.
+// any non-200 response is returned as an error
+func post(ctx context.Context, cfg Config, url string, headers map[string]string, body []byte) (*http.Response, error) {
+	return send(ctx, cfg, http.MethodPost, url, headers, body)
+}
+
+// send sends the json encoded body, which may be nil, to the specified url using the specified method, retrying in accordance
+// with the configured policy. any non-200 response is returned as an error
+func send(ctx context.Context, cfg Config, method, url string, headers map[string]string, body []byte) (*http.Response, error) {
+	rs, err := retry.Do(ctx, cfg.Retry, func(ctx context.Context) (*http.Request, error) {
+		rq, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create request to llm api. %w", err)
+		}
+		rq.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			rq.Header.Set(k, v)
+		}
+		return rq, nil
+	}, cfg.DebugPrintf)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to send request to llm api. %w", err)
+	}
+
+	if rs.StatusCode != http.StatusOK {
+		defer rs.Body.Close()
+		data, _ := io.ReadAll(rs.Body)
+		cfg.DebugPrintf("received error response", "type", "error_response", "status", rs.Status, "response", string(data))
+		return nil, fmt.Errorf("non-200 status code returned from llm api. %s", data)
+	}
+
+	return rs, nil
+}
+
+// readEvents passes the data field of each server-sent event in the stream to fn, until the stream ends or fn returns an error
+func readEvents(stream io.Reader, fn func(data []byte) error) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+
+		if !ok {
+			continue // events are separated by blank lines and only data fields are relevant
+		}
+
+		if err := fn([]byte(strings.TrimSpace(data))); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read response stream. %w", err)
+	}
+
+	return nil
+}
+
+// attachLocal returns references to the specified local files, for providers that send file content inline with each request
+func attachLocal(files []string) ([]FileReference, error) {
+	fileReferences := make([]FileReference, 0, len(files))
+
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid filepath '%v'. %w", file, err)
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("invalid filepath. '%v' file does not exist. %w", file, err)
+		}
+
+		mimeType, err := resource.MIMEType(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fileReferences = append(fileReferences, FileReference{
+			MIMEType: mimeType,
+			Label:    filepath.Base(file),
+			Path:     path,
+		})
+	}
+
+	return fileReferences, nil
+}
+
+// readLocal returns the content of the specified local file reference, either as text or as base64 encoded data, depending on its mime type.
+// files that are no longer available are reported to the debug log and indicated by ok being false
+func readLocal(cfg Config, fileReference FileReference) (text string, data string, ok bool) {
+	content, err := fileReference.Data, error(nil)
+
+	if len(content) == 0 { // files attached as inline data using the gemini provider hold their own content
+		content, err = os.ReadFile(fileReference.Path)
+	}
+
+	if err != nil {
+		cfg.DebugPrintf("attached file is no longer available and has been omitted", "type", "missing_file", "path", fileReference.Path, "error", err)
+		return "", "", false
+	}
+
+	if resource.IsText(fileReference.MIMEType) {
+		return fmt.Sprintf("file: %v\n\n%s", fileReference.Label, content), "", true
+	}
+
+	return "", base64.StdEncoding.EncodeToString(content), true
+}
+
+// sendResource sends the json encoded body, which may be nil, to the specified gemini api resource url and decodes the response into v, unless it is nil
+func sendResource(ctx context.Context, cfg Config, method, url string, body []byte, v any) error {
+	cfg.DebugPrintf("sending resource request", "type", "resource_request", "method", method, "url", url, "request", string(body))
+
+	rs, err := send(ctx, cfg, method, url, nil, body)
+
+	if err != nil {
+		return err
+	}
+
+	defer rs.Body.Close()
+
+	data, err := io.ReadAll(rs.Body)
+
+	if err != nil {
+		return fmt.Errorf("unable to read response body. %w", err)
+	}
+
+	cfg.DebugPrintf("received resource response", "type", "resource_response", "status", rs.Status, "response", string(data))
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unable to parse response body. %w", err)
+	}
+
+	return nil
+}
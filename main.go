@@ -1,26 +1,45 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/comradequinn/gen/cfg"
 	"github.com/comradequinn/gen/cli"
+	"github.com/comradequinn/gen/fileset"
 	"github.com/comradequinn/gen/llm"
 	"github.com/comradequinn/gen/schema"
 	"github.com/comradequinn/gen/session"
+	"github.com/comradequinn/gen/tool"
+	"github.com/comradequinn/gen/transcript"
 )
 
 const (
 	app = "gen"
 )
 
+const (
+	exitCodeTruncated  = 3
+	exitCodeBlocked    = 4
+	exitCodeIncomplete = 5
+)
+
 var (
 	commit = "dev"
 	tag    = "none"
@@ -31,6 +50,12 @@ func main() {
 		if !condition {
 			return
 		}
+		for _, arg := range v {
+			if err, ok := arg.(error); ok && errors.Is(err, session.ErrRepairRequired) {
+				format += fmt.Sprintf(". run '%v --repair' to repair it", app)
+				break
+			}
+		}
 		fmt.Printf(format+"\n", v...)
 		os.Exit(1)
 	}
@@ -41,17 +66,25 @@ func main() {
 	script := flag.Bool("script", false, "supress activity indicators, such as spinners, to better support piping stdout into other utils when scripting")
 	scriptShort := flag.Bool("s", false, "shortform of --script")
 	disableGrounding := flag.Bool("no-grounding", false, "disable grounding with search")
+	citations := flag.Bool("citations", false, "mark the spans of the response supported by grounding sources with numbered citations and list the sources after the response")
 	schemaDefinition := flag.String("schema", "", "a schema that defines the required response format. either in the form `name:type:[description],...n` or as a json-form open-api schema. grounding with search must be disabled to use a schema")
 	debug := flag.Bool("debug", false, "enable debug output")
 	stats := flag.Bool("stats", false, "print count of tokens used")
 	appDir := flag.String("app-dir", path.Join(homeDir, "."+app), fmt.Sprintf("location of the %v app (directory", app))
 	configure := flag.Bool("config", false, "reset or initialise the configuration")
+	global := flag.Bool("global", false, fmt.Sprintf("use the sessions and config of the app directory, even within a project that has a .%v directory", app))
+	projectInit := flag.Bool("project-init", false, fmt.Sprintf("create a .%v directory in the working directory, so that it, and its subdirectories, use their own sessions, config and system prompt", app))
 	model := flag.String("model", "", "the specific model to use")
-	flashModel := flag.Bool("flash", false, fmt.Sprintf("use the cheaper %v model", llm.Models.Flash))
+	flashModel := flag.Bool("flash", false, fmt.Sprintf("use the cheaper model of the provider, such as %v", llm.Models.Flash))
 	maxTokens := flag.Int("max-tokens", 10000, "the maximum number of tokens to allow in a response")
 	temperature := flag.Float64("temperature", 0.2, "the temperature setting for the model")
 	topP := flag.Float64("top-p", 0.2, "the top-p setting for the model")
-	apiURL := flag.String("api-url", "https://generativelanguage.googleapis.com/v1beta/models/%v:generateContent?key=%v", "the url for the gemini api. it must expose two placeholders; one for the model and a second for the api key")
+	provider := flag.String("provider", llm.ProviderGemini, fmt.Sprintf("the llm provider to use. one of '%v', '%v' or '%v'. use '%v' with --api-url for any openai-compatible api, such as ollama or llama.cpp", llm.ProviderGemini, llm.ProviderOpenAI, llm.ProviderAnthropic, llm.ProviderOpenAI))
+	apiURL := flag.String("api-url", "", "the url for the provider api. defaults to the public api of the provider. for gemini, it must expose two placeholders; one for the model and a second for the api key")
+	streamURL := flag.String("stream-url", "https://generativelanguage.googleapis.com/v1beta/models/%v:streamGenerateContent?alt=sse&key=%v", "the url for the gemini streaming api. it must expose two placeholders; one for the model and a second for the api key")
+	stream := flag.Bool("stream", false, "write the response to stdout as it is generated, rather than once it is complete")
+	cacheURL := flag.String("cache-url", "https://generativelanguage.googleapis.com/v1beta/%v?key=%v", "the url for the gemini api cache resources. it must expose two placeholders; one for the resource path and a second for the api key")
+	filesURL := flag.String("files-url", "https://generativelanguage.googleapis.com/v1beta/%v?key=%v", "the url for the gemini api file resources. it must expose two placeholders; one for the resource path and a second for the api key")
 	uploadURL := flag.String("upload-url", "https://generativelanguage.googleapis.com/upload/v1beta/files?key=%v", "the url for the gemini api file upload url. it must expose a placeholder for the api key")
 	systemPrompt := flag.String("system-prompt",
 		fmt.Sprintf("You are a command line assistant utility named '%v' running in a terminal on the OS '%v'. Factor that into the format and content of your responses and always ensure they are concise and "+
@@ -59,17 +92,63 @@ func main() {
 			"by a human; such as using dashes for list delimiters. You always ensure that, to the extent that you are reasonably able, that your answers are factually correct and you take caution regarding hallucinations. "+
 			"You only answer the specific question given and do not proactively include additional information that is not directly relevant to that question. ", app, runtime.GOOS),
 		"the base system prompt to use")
-	file := flag.String("files", "", "a comma separated list of files to attach to the prompt")
+	uploadConcurrency := flag.Int("upload-concurrency", 8, "the maximum number of attached files to upload at once")
+	inlineMaxBytes := flag.Int64("inline-max-bytes", 64*1024, "the size in bytes at or below which attached files are sent inline with the prompt, rather than uploaded. zero always uploads")
+	uploadsList := flag.Bool("uploads-list", false, "list all uploaded files held by the gemini files api, and the sessions that reference them")
+	uploadsDelete := flag.String("uploads-delete", "", "delete the uploaded file with the specified id or uri from the gemini files api")
+	uploadsDeleteAll := flag.Bool("uploads-delete-all", false, "delete all files uploaded by gen from the gemini files api")
+	noUploadCache := flag.Bool("no-upload-cache", false, "always upload attached files, rather than reusing previous uploads of the same content that have not yet expired")
+	file := flag.String("files", "", "a comma separated list of files, directories and globs, such as 'src/**/*.go', to attach to the prompt. prefix a glob with '!' to exclude matching files. files within directories, or matched by globs, are skipped if ignored by a .gitignore or .genignore file or if binary. '-' attaches stdin")
 	fileShort := flag.String("f", "", "shortform of --files")
+	stdinAs := flag.String("stdin-as", "", "attach stdin as a file with the specified name, such as 'changes.diff', whose extension determines its mime type")
+	noStdin := flag.Bool("no-stdin", false, "do not read piped stdin as the prompt when none is specified. stdin is still read when '-' is specified as the prompt or an attached file, or when --stdin-as is set")
+	filesDryRun := flag.Bool("files-dry-run", false, "list the files that would be attached by --files, without sending a prompt")
+	filesMaxCount := flag.Int("files-max-count", 1000, "the maximum number of files that can be attached to a prompt. zero means no limit")
+	filesMaxBytes := flag.Int64("files-max-bytes", 100*1024*1024, "the maximum total size, in bytes, of the files that can be attached to a prompt. zero means no limit")
+	retryAttempts := flag.Int("retry-attempts", 3, "the maximum number of attempts made for each api request that fails with a transient error")
+	retryBackoff := flag.Duration("retry-backoff", time.Second, "the delay before the first retry of a failed api request. the delay doubles with each subsequent retry, unless the api specifies otherwise")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 30*time.Second, "the maximum delay between retries of a failed api request, including any delay specified by the api")
+	retryJitter := flag.Float64("retry-jitter", 0.2, "the proportion, between 0 and 1, by which retry delays are randomly varied")
+	timeout := flag.Duration("timeout", 0, "the maximum time to wait for a response, including any file uploads and tool calls. for example, '90s' or '5m'. zero means no timeout")
+	historyBudget := flag.Int("history-budget", 200000, "the estimated number of tokens of session history above which the oldest exchanges are compacted. the removed exchanges are archived in the session file. zero disables compaction")
+	compaction := flag.String("compaction", llm.CompactionSummarise, fmt.Sprintf("how the session history is compacted when it exceeds --history-budget. either '%v', which replaces the oldest exchanges with a summary written by the model, or '%v', which removes them", llm.CompactionSummarise, llm.CompactionWindow))
+	continueOnTruncation := flag.Bool("continue-on-truncation", false, "when a response is truncated by the token limit, automatically request that the model continues it and join the parts")
+	cache := flag.String("cache", "", "the name of a cache, holding a system prompt and files, to include in the prompt. the model of the cache is used and grounding is disabled")
+	cacheCreate := flag.String("cache-create", "", "create a cache with the specified name from the files specified by --files and the system prompt")
+	cacheExtend := flag.String("cache-extend", "", "extend the expiry of the cache with the specified name to the --cache-ttl from now")
+	cacheDelete := flag.String("cache-delete", "", "delete the cache with the specified name")
+	cacheList := flag.Bool("cache-list", false, "list all caches by name")
+	cacheTTL := flag.Duration("cache-ttl", time.Hour, "the time to live of a cache when it is created or extended. for example, '30m' or '24h'")
+	toolFiles := flag.String("tools", "", "a comma separated list of json tool declaration files that the model may call")
+	toolPath := flag.String("tool-path", "", "a list of directories, separated in the same manner as $PATH, containing executable tools that the model may call")
 	newSession := flag.Bool("new", false, "save any existing session and start a new one")
 	newSessionShort := flag.Bool("n", false, "shortform of --new")
+	sessionName := flag.String("name", "", "with --new, the name of the new session, which can be used in place of its id")
+	renameSession := flag.String("rename", "", "set the name of the active session, or that selected by the GEN_SESSION environment variable")
 	listSessions := flag.Bool("list", false, "list all sessions by id")
 	listSessionsShort := flag.Bool("l", false, "shortform of --list")
-	restoreSession := flag.Int("restore", 0, "the session id to restore")
-	restoreSessionShort := flag.Int("r", 0, "shortform of --restore")
-	deleteSession := flag.Int("delete", 0, "the session id to delete")
-	deleteSessionShort := flag.Int("d", 0, "shortform of --delete")
+	restoreSession := flag.String("restore", "", "the id or name of the session to restore")
+	restoreSessionShort := flag.String("r", "", "shortform of --restore")
+	deleteSession := flag.String("delete", "", "the id or name of the session to delete")
+	deleteSessionShort := flag.String("d", "", "shortform of --delete")
 	deleteAllSessions := flag.Bool("delete-all", false, "delete all session data")
+	repairSessions := flag.Bool("repair", false, "repair the session directory, when it is corrupt or more than one session is active")
+	exportFormat := flag.String("export", "", fmt.Sprintf("write a transcript of the active session, or that selected by the GEN_SESSION environment variable, to stdout in the specified format. one of '%v'", strings.Join(transcript.Formats, "', '")))
+	exportAll := flag.Bool("export-all", false, "with --export, write a transcript of all sessions, rather than one")
+	search := flag.String("search", "", "list the turns of all sessions whose prompt or response contains a line matching the specified regular expression. matching is case-insensitive unless the expression begins with '(?-i)'")
+	searchFrom := flag.String("search-from", "", "with --search, only match turns on or after the specified date, in the form 'yyyy-mm-dd'")
+	searchTo := flag.String("search-to", "", "with --search, only match turns on or before the specified date, in the form 'yyyy-mm-dd'")
+	searchModel := flag.String("search-model", "", "with --search, only match turns whose response was written by a model whose name contains the specified text")
+	searchContext := flag.Int("search-context", 1, "with --search, the number of lines to display before and after each matching line")
+	undoTurn := flag.Bool("undo", false, "remove the last prompt, and its response, from the active session, or that selected by the GEN_SESSION environment variable")
+	retryTurn := flag.Bool("retry", false, "resend the last prompt of the active session, or that selected by the GEN_SESSION environment variable, and replace its response. model flags, such as --model or --temperature, can be changed")
+	editTurn := flag.Bool("edit", false, "open the last prompt of the active session, or that selected by the GEN_SESSION environment variable, in $EDITOR, then resend it and replace its response")
+	forkSession := &optionalFlag{}
+	flag.Var(forkSession, "fork", "copy the active session, that selected by the GEN_SESSION environment variable, or that with the id or name specified as --fork=<id|name>, to a new session and make it the active session. use --name to name the copy")
+	forkAt := flag.Int("fork-at", 0, "with --fork, copy only the turns up to and including the specified turn, numbered as in --search and --export, so that the conversation continues from that point, rather than the end")
+	importFile := flag.String("import", "", "create a stashed session from each transcript in the specified file, or stdin if '-'. the file may hold a json export of gen, a markdown transcript of 'User:' and 'Model:' messages or an openai-style messages array")
+	importFormat := flag.String("import-format", "", fmt.Sprintf("with --import, the format of the file. one of '%v'. by default, it is determined from the content", strings.Join(transcript.ImportFormats, "', '")))
+	withUploads := flag.Bool("with-uploads", false, "with --delete or --delete-all, also delete the uploaded files referenced by the deleted sessions, unless referenced by another session")
 
 	flag.Parse()
 
@@ -86,6 +165,41 @@ func main() {
 	config, err := cfg.Read(*appDir)
 	checkFatalf(err != nil, "unable to read config. %v", err)
 
+	scopeDir, projectDir := *appDir, "" // the directory holding the sessions and config in use, and that of the project, if any
+	{
+		appDirSet := false
+		flag.Visit(func(f *flag.Flag) { appDirSet = appDirSet || f.Name == "app-dir" })
+
+		wd, err := os.Getwd()
+		checkFatalf(err != nil, "unable to determine working directory. %v", err)
+
+		if *projectInit {
+			dir, err := cfg.InitProject(wd, "."+app)
+			checkFatalf(err != nil, "unable to initialise project. %v", err)
+			fmt.Printf("initialised project in %v\n", dir)
+			os.Exit(0)
+		}
+
+		if found, ok := cfg.FindProject(wd, "."+app, *appDir); ok && !*global && !appDirSet { // an explicit app directory is always used as specified
+			config, err = cfg.ReadProject(config, found)
+			checkFatalf(err != nil, "unable to read project config. %v", err)
+			scopeDir, projectDir = found, found
+		}
+	}
+
+	restoreRef, deleteRef, startNewSession := cmp.Or(*restoreSession, *restoreSessionShort), cmp.Or(*deleteSession, *deleteSessionShort), *newSession || *newSessionShort
+
+	checkFatalf(*sessionName != "" && !startNewSession && *importFile == "" && !forkSession.set, "a session name can only be specified with --new, --fork or --import. use --rename to name an existing session")
+	checkFatalf(*forkAt != 0 && !forkSession.set, "a turn can only be specified with --fork")
+	checkFatalf(forkSession.set && len(flag.Args()) > 0, "a prompt cannot be specified with --fork. to fork a session other than the active session, use --fork=<id|name>")
+	checkFatalf((*searchFrom != "" || *searchTo != "" || *searchModel != "") && *search == "", "dates and models can only be specified with --search")
+
+	replaceTurn := *retryTurn || *editTurn
+
+	checkFatalf(replaceTurn && (len(flag.Args()) > 0 || startNewSession), "--retry and --edit resend the last prompt of the session, so cannot be used with a prompt or --new")
+	checkFatalf(config.Session != "" && startNewSession, "a new session cannot be started while GEN_SESSION selects a session")
+	checkFatalf(*exportAll && *exportFormat == "", "an export format must be specified with --export")
+
 	{ // non-prompt commands
 		switch {
 		case *version || *versionShort:
@@ -93,112 +207,567 @@ func main() {
 			os.Exit(0)
 		case *configure:
 			cli.Configure(&config)
-			cfg.Save(config.User, config.Preferences, *appDir)
+			cfg.Save(config.User, config.Preferences, scopeDir)
+			os.Exit(0)
+		case restoreRef != "":
+			err := session.Restore(scopeDir, restoreRef)
+			checkFatalf(err != nil, "unable to restore session. %v", err)
+			os.Exit(0)
+		case *renameSession != "":
+			err := session.Rename(scopeDir, config.Session, *renameSession)
+			checkFatalf(err != nil, "unable to rename session. %v", err)
 			os.Exit(0)
-		case *newSession || *newSessionShort:
-			session.Stash(*appDir)
-		case *restoreSession > 0 || *restoreSessionShort > 0:
-			sessionID := *restoreSession + *restoreSessionShort
-			checkFatalf(session.Restore(*appDir, sessionID) != nil, "unable to restore session. %v", err)
+		case deleteRef != "" && !*withUploads:
+			err := session.Delete(scopeDir, deleteRef)
+			checkFatalf(err != nil, "unable to delete session. %v", err)
 			os.Exit(0)
-		case *deleteSession > 0 || *deleteSessionShort > 0:
-			sessionID := *deleteSession + *deleteSessionShort
-			checkFatalf(session.Delete(*appDir, sessionID) != nil, "unable to delete session. %v", err)
+		case *deleteAllSessions && !*withUploads:
+			err := session.DeleteAll(scopeDir)
+			checkFatalf(err != nil, "unable to delete sessions. %v", err)
 			os.Exit(0)
-		case *deleteAllSessions:
-			checkFatalf(session.DeleteAll(*appDir) != nil, "unable to delete sessions. %v", err)
+		case *repairSessions:
+			changes, err := session.Repair(scopeDir)
+			checkFatalf(err != nil, "unable to repair sessions. %v", err)
+			cli.ListChanges(changes)
+			os.Exit(0)
+		case *exportFormat != "":
+			transcripts := []session.Transcript{}
+			if *exportAll {
+				transcripts, err = session.ExportAll(scopeDir)
+			} else {
+				var t session.Transcript
+				t, err = session.Export(scopeDir, config.Session)
+				transcripts = append(transcripts, t)
+			}
+			checkFatalf(err != nil, "unable to export session. %v", err)
+			err = transcript.Write(os.Stdout, *exportFormat, transcripts)
+			checkFatalf(err != nil, "unable to export session. %v", err)
+			os.Exit(0)
+		case *search != "":
+			query := session.Query{Model: *searchModel, Context: *searchContext}
+			query.Pattern, err = regexp.Compile("(?i)" + *search)
+			checkFatalf(err != nil, "invalid search pattern. %v", err)
+			for _, date := range []struct {
+				value string
+				t     *time.Time
+				days  int
+			}{{*searchFrom, &query.From, 0}, {*searchTo, &query.To, 1}} { // the end date is inclusive
+				if date.value == "" {
+					continue
+				}
+				t, err := time.ParseInLocation(time.DateOnly, date.value, time.Local)
+				checkFatalf(err != nil, "invalid search date '%v'. dates must be in the form 'yyyy-mm-dd'", date.value)
+				*date.t = t.AddDate(0, 0, date.days)
+			}
+			matches, err := session.Search(scopeDir, query)
+			checkFatalf(err != nil, "unable to search sessions. %v", err)
+			cli.ListMatches(matches)
+			os.Exit(0)
+		case *undoTurn:
+			prompt, err := session.Undo(scopeDir, config.Session)
+			checkFatalf(err != nil, "unable to undo the last turn. %v", err)
+			cli.ListUndo(prompt)
+			os.Exit(0)
+		case forkSession.set:
+			record, err := session.Fork(scopeDir, cmp.Or(forkSession.value, config.Session), *forkAt, *sessionName)
+			checkFatalf(err != nil, "unable to fork session. %v", err)
+			cli.ListFork(record)
+			os.Exit(0)
+		case *importFile != "":
+			var r io.Reader = os.Stdin
+			if *importFile != "-" {
+				f, err := os.Open(*importFile)
+				checkFatalf(err != nil, "unable to open import file. %v", err)
+				r = f // closed on exit
+			}
+			transcripts, err := transcript.Read(r, *importFormat)
+			checkFatalf(err != nil, "unable to import sessions. %v", err)
+			if *sessionName != "" {
+				checkFatalf(len(transcripts) != 1, "a session name can only be specified when importing a single session")
+				transcripts[0].Name = *sessionName
+			}
+			records, err := session.Import(scopeDir, transcripts)
+			checkFatalf(err != nil, "unable to import sessions. %v", err)
+			cli.ListImports(records)
 			os.Exit(0)
 		case *listSessions || *listSessionsShort:
-			records, err := session.List(*appDir)
+			records, err := session.List(scopeDir)
 			checkFatalf(err != nil, "unable to list history. %v", err)
-			cli.ListSessions(records)
+			cli.ListSessions(projectDir, records)
 			os.Exit(0)
 		}
 	}
 
-	checkFatalf(len(flag.Args()) != 1, "a single prompt is required")
+	cacheCommand := *cacheCreate != "" || *cacheExtend != "" || *cacheDelete != "" || *cacheList
+	uploadsCommand := *uploadsList || *uploadsDelete != "" || *uploadsDeleteAll || (*withUploads && (deleteRef != "" || *deleteAllSessions))
+
+	patterns, attachStdin, promptStdin := []string{}, *stdinAs != "", flag.Arg(0) == "-"
+	{
+		if filePattern := *file + *fileShort; filePattern != "" {
+			for _, pattern := range strings.Split(filePattern, ",") {
+				if strings.TrimSpace(pattern) == "-" {
+					attachStdin = true
+					continue
+				}
+				patterns = append(patterns, pattern)
+			}
+		}
+
+		if cli.StdinPiped() && !*noStdin && len(flag.Args()) == 0 && !attachStdin && !cacheCommand && !uploadsCommand && !replaceTurn {
+			promptStdin = true // piped input is only read, unless requested, when no prompt is specified, in which case it is the prompt
+		}
+
+		checkFatalf(attachStdin && promptStdin, "stdin cannot be used as both the prompt and an attached file")
+	}
+
 	prompt := flag.Arg(0)
+	{
+		if promptStdin {
+			data, err := io.ReadAll(os.Stdin)
+			checkFatalf(err != nil, "unable to read prompt from stdin. %v", err)
+			prompt = strings.TrimSpace(string(data))
+		}
+	}
+
+	messages, history, resend := []llm.Message{}, []llm.Message{}, []string{} // the messages of the session, those sent with the prompt and the files of a resent prompt
+	{
+		if !startNewSession && !cacheCommand && !uploadsCommand && !*filesDryRun { // when starting a new session, the existing one is only stashed once a response has been received
+			messages, err = session.Read(scopeDir, config.Session)
+			checkFatalf(err != nil, "unable to read history. %v", err)
+		}
+
+		history = messages
+
+		if replaceTurn { // the last turn is replaced, as the history sent excludes it and all messages read are replaced when the session is written
+			i := session.LastTurn(messages)
+			checkFatalf(i == -1, "unable to resend the last prompt. the session has no prompts")
+
+			prompt, history = messages[i].Text, messages[:i]
+
+			for _, f := range messages[i].Files {
+				checkFatalf(f.Path == "", "unable to resend the last prompt. the attached file '%v' is no longer available", f.Label)
+				resend = append(resend, f.Path)
+			}
+
+			if *editTurn {
+				prompt, err = cli.Edit(prompt)
+				checkFatalf(err != nil, "unable to edit the last prompt. %v", err)
+				prompt = strings.TrimSpace(prompt)
+				checkFatalf(prompt == "", "the edited prompt is empty. the session has not been updated")
+			}
+		}
+	}
+
+	files := slices.Clone(resend)
+	{
+		selected := []fileset.File{}
+
+		if len(patterns) > 0 {
+			selected, err = fileset.Expand(patterns, fileset.Limits{MaxFiles: *filesMaxCount, MaxBytes: *filesMaxBytes})
+			checkFatalf(err != nil, "unable to select files to attach. %v", err)
+		}
+
+		if attachStdin {
+			name := *stdinAs
+			if name == "" {
+				name = "stdin"
+			}
+
+			stdinFile, err := fileset.Stdin(path.Join(*appDir, "stdin"), name, os.Stdin)
+			checkFatalf(err != nil, "unable to attach stdin. %v", err)
+
+			selected = append(selected, stdinFile)
+		}
+
+		if *filesDryRun {
+			cli.ListFiles(selected)
+			os.Exit(0)
+		}
+
+		for _, f := range selected {
+			files = append(files, f.Path)
+		}
+	}
+
+	checkFatalf(!cacheCommand && !uploadsCommand && (len(flag.Args()) > 1 || prompt == ""), "a single prompt is required")
 
 	var stopSpinner = func() {}
 	{
 		if !scriptMode {
-			stopSpinner = cli.Spin()
+			stopSpinner = sync.OnceFunc(cli.Spin())
 		}
 	}
 
-	schema, err := schema.Build(*schemaDefinition)
-	checkFatalf(err != nil, "invalid schema definition. %v", err)
+	providerDefaults, ok := llm.Providers[*provider]
+	checkFatalf(!ok, "invalid provider '%v'", *provider)
 
-	messages, err := session.Read(*appDir)
-	checkFatalf(err != nil, "unable to read history. %v", err)
+	apiKey := ""
+	{
+		switch *provider {
+		case llm.ProviderGemini:
+			apiKey = config.Credentials.APIKey
+			checkFatalf(apiKey == "", "unable to read the gemini-api-key from the GEMINI_API_KEY environment variable")
+		case llm.ProviderOpenAI:
+			apiKey = config.Credentials.OpenAIAPIKey // not required by self-hosted openai-compatible apis
+		case llm.ProviderAnthropic:
+			apiKey = config.Credentials.AnthropicAPIKey
+			checkFatalf(apiKey == "", "unable to read the anthropic-api-key from the ANTHROPIC_API_KEY environment variable")
+		}
+	}
 
 	useModel := *model
 	{
 		if useModel == "" {
-			useModel = llm.Models.Pro
+			useModel = providerDefaults.Models.Pro
 		}
 		if *flashModel {
-			useModel = llm.Models.Flash
+			useModel = providerDefaults.Models.Flash
 		}
 	}
 
-	files := []string{}
+	declarations := []string{}
 	{
-		if filePattern := *file + *fileShort; filePattern != "" {
-			files = strings.Split(filePattern, ",")
-			for i := range files {
-				files[i] = strings.TrimSpace(files[i])
+		if *toolFiles != "" {
+			declarations = strings.Split(*toolFiles, ",")
+			for i := range declarations {
+				declarations[i] = strings.TrimSpace(declarations[i])
 			}
 		}
 	}
 
-	rs, err := llm.Generate(
-		llm.Config{
-			APIKey:        config.Credentials.APIKey,
-			APIURL:        *apiURL,
-			UploadURL:     *uploadURL,
-			SystemPrompt:  *systemPrompt,
-			ResponseStyle: config.Preferences.ResponseStyle,
-			Model:         useModel,
-			MaxTokens:     *maxTokens,
-			Temperature:   *temperature,
-			TopP:          *topP,
-			Grounding:     !*disableGrounding,
-			User: llm.User{
-				Name:        config.User.Name,
-				Location:    config.User.Location,
-				Description: config.User.Description,
-			},
-			DebugPrintf: slog.Debug,
+	tools, err := tool.Load(declarations, *toolPath)
+	checkFatalf(err != nil, "unable to load tools. %v", err)
+
+	var streamFunc func(text string)
+	{
+		if *stream {
+			streamFunc = func(text string) {
+				stopSpinner()
+				fmt.Print(text)
+			}
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	var uploadProgress func(file string, completed, total int)
+	{
+		if !scriptMode {
+			uploadProgress = func(file string, completed, total int) {
+				if completed == total {
+					cli.SetStatus("")
+					return
+				}
+				cli.SetStatus(fmt.Sprintf("uploaded %v of %v files: %v", completed, total, file))
+			}
+		}
+	}
+
+	systemPromptText := *systemPrompt
+	{
+		systemPromptSet := false
+		flag.Visit(func(f *flag.Flag) { systemPromptSet = systemPromptSet || f.Name == "system-prompt" })
+
+		if config.SystemPrompt != "" && !systemPromptSet { // an explicit system prompt replaces that of the project, as well as the default
+			systemPromptText += config.SystemPrompt
+		}
+	}
+
+	uploadIndexFile := path.Join(*appDir, "uploads")
+
+	uploadIndex := ""
+	{
+		if !*noUploadCache {
+			uploadIndex = uploadIndexFile
+		}
+	}
+
+	llmConfig := llm.Config{
+		Provider:             *provider,
+		APIKey:               apiKey,
+		APIURL:               *apiURL,
+		StreamURL:            *streamURL,
+		UploadURL:            *uploadURL,
+		UploadIndex:          uploadIndex,
+		UploadConcurrency:    *uploadConcurrency,
+		InlineMaxBytes:       *inlineMaxBytes,
+		UploadProgress:       uploadProgress,
+		CacheURL:             *cacheURL,
+		FilesURL:             *filesURL,
+		Cache:                *cache,
+		SystemPrompt:         systemPromptText,
+		ResponseStyle:        config.Preferences.ResponseStyle,
+		Model:                useModel,
+		MaxTokens:            *maxTokens,
+		Temperature:          *temperature,
+		TopP:                 *topP,
+		Grounding:            !*disableGrounding,
+		Tools:                tools,
+		ContinueOnTruncation: *continueOnTruncation,
+		Compaction:           llm.Compaction{Budget: *historyBudget, Strategy: *compaction},
+		Retry: llm.RetryPolicy{
+			MaxAttempts: *retryAttempts,
+			Backoff:     *retryBackoff,
+			MaxBackoff:  *retryMaxBackoff,
+			Jitter:      *retryJitter,
+		},
+		User: llm.User{
+			Name:        config.User.Name,
+			Location:    config.User.Location,
+			Description: config.User.Description,
 		},
+		DebugPrintf: slog.Debug,
+		Stream:      streamFunc,
+	}
+
+	{ // cache commands
+		switch {
+		case *cacheCreate != "":
+			c, err := llm.CreateCache(ctx, llmConfig, *cacheCreate, files, *cacheTTL)
+			stopSpinner()
+			checkFatalf(err != nil, "unable to create cache. %v", err)
+			cli.ListCaches([]llm.Cache{c})
+			os.Exit(0)
+		case *cacheExtend != "":
+			c, err := llm.ExtendCache(ctx, llmConfig, *cacheExtend, *cacheTTL)
+			stopSpinner()
+			checkFatalf(err != nil, "unable to extend cache. %v", err)
+			cli.ListCaches([]llm.Cache{c})
+			os.Exit(0)
+		case *cacheDelete != "":
+			err := llm.DeleteCache(ctx, llmConfig, *cacheDelete)
+			stopSpinner()
+			checkFatalf(err != nil, "unable to delete cache. %v", err)
+			os.Exit(0)
+		case *cacheList:
+			caches, err := llm.ListCaches(ctx, llmConfig)
+			stopSpinner()
+			checkFatalf(err != nil, "unable to list caches. %v", err)
+			cli.ListCaches(caches)
+			os.Exit(0)
+		}
+	}
+
+	{ // upload commands
+		uploadsConfig := llmConfig
+		uploadsConfig.UploadIndex = uploadIndexFile // deleted uploads are removed from the index, even when it is not used to reuse uploads
+
+		switch {
+		case *uploadsList:
+			remoteFiles, err := llm.ListRemoteFiles(ctx, uploadsConfig)
+			stopSpinner()
+			checkFatalf(err != nil, "unable to list uploaded files. %v", err)
+			references, err := session.References(scopeDir)
+			checkFatalf(err != nil, "unable to read session references. %v", err)
+			cli.ListRemoteFiles(remoteFiles, references)
+			os.Exit(0)
+		case *uploadsDelete != "":
+			deleted, err := deleteUploads(ctx, uploadsConfig, scopeDir, func(f llm.RemoteFile) bool {
+				return f.ID == *uploadsDelete || f.ID == "files/"+*uploadsDelete || f.URI == *uploadsDelete
+			})
+			stopSpinner()
+			checkFatalf(err != nil, "unable to delete uploaded file. %v", err)
+			checkFatalf(deleted == 0, "unable to delete uploaded file. no uploaded file '%v' exists", *uploadsDelete)
+			os.Exit(0)
+		case *uploadsDeleteAll:
+			references, err := session.References(scopeDir)
+			checkFatalf(err != nil, "unable to read session references. %v", err)
+			uploads := llm.Uploads(uploadsConfig)
+			_, err = deleteUploads(ctx, uploadsConfig, scopeDir, func(f llm.RemoteFile) bool {
+				return len(references[f.URI]) > 0 || slices.Contains(uploads, f.URI)
+			})
+			stopSpinner()
+			checkFatalf(err != nil, "unable to delete uploaded files. %v", err)
+			os.Exit(0)
+		case *withUploads && deleteRef != "":
+			record, err := session.Find(scopeDir, deleteRef)
+			checkFatalf(err != nil, "unable to delete session. %v", err)
+			references, err := session.References(scopeDir)
+			checkFatalf(err != nil, "unable to read session references. %v", err)
+			_, err = deleteUploads(ctx, uploadsConfig, scopeDir, func(f llm.RemoteFile) bool {
+				return slices.Equal(references[f.URI], []int{record.ID}) // uploads also referenced by other sessions are retained
+			})
+			stopSpinner()
+			checkFatalf(err != nil, "unable to delete uploaded files. %v", err)
+			err = session.Delete(scopeDir, deleteRef)
+			checkFatalf(err != nil, "unable to delete session. %v", err)
+			os.Exit(0)
+		case *withUploads && *deleteAllSessions:
+			references, err := session.References(scopeDir)
+			checkFatalf(err != nil, "unable to read session references. %v", err)
+			_, err = deleteUploads(ctx, uploadsConfig, scopeDir, func(f llm.RemoteFile) bool { return len(references[f.URI]) > 0 })
+			stopSpinner()
+			checkFatalf(err != nil, "unable to delete uploaded files. %v", err)
+			err = session.DeleteAll(scopeDir)
+			checkFatalf(err != nil, "unable to delete sessions. %v", err)
+			os.Exit(0)
+		}
+	}
+
+	schema, err := schema.Build(*schemaDefinition)
+	checkFatalf(err != nil, "invalid schema definition. %v", err)
+
+	if *sessionName != "" {
+		err = session.CheckName(scopeDir, *sessionName)
+		checkFatalf(err != nil, "unable to start new session. %v", err)
+	}
+
+	rs, err := llm.Generate(ctx, llmConfig,
 		llm.Prompt{
 			Text:    prompt,
 			Files:   files,
-			History: messages,
+			History: history,
 			Schema:  schema,
 		})
 
+	stopSpinner()
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		checkFatalf(true, "no response received within the %v timeout. the active session has not been updated", *timeout)
+	case errors.Is(err, context.Canceled):
+		fmt.Printf("cancelled. the active session has not been updated\n")
+		os.Exit(130)
+	}
+
 	checkFatalf(err != nil, "error with llm api. %v", err)
 
-	checkFatalf(session.Write(*appDir, session.Entry{
-		Prompt:   prompt,
-		Response: rs.Text,
-		Files:    rs.Files,
-	}) != nil, "unable to update session. %v", err)
+	for _, warning := range rs.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
 
-	stopSpinner()
+	if startNewSession {
+		err = session.New(scopeDir, *sessionName)
+		checkFatalf(err != nil, "unable to start new session. %v", err)
+	}
 
-	fmt.Printf("%v\n\n", rs.Text)
+	if rs.FinishReason == llm.FinishReasonStop || rs.Text != "" { // partial responses are recorded, but blocked prompts that returned nothing are not
+		err = session.Write(scopeDir, config.Session, session.Entry{
+			Prompt:    prompt,
+			Response:  rs.Text,
+			Files:     rs.Files,
+			Turns:     rs.Turns,
+			Grounding: rs.Grounding,
+			History:   rs.History,
+			Read:      len(messages),
+			Archived:  rs.Archived,
+			Model:     rs.Model,
+			Tokens:    rs.Tokens,
+		})
+		checkFatalf(err != nil, "unable to update session. %v", err)
+	}
+
+	switch {
+	case *stream:
+		fmt.Print("\n\n") // markers cannot be inserted into text that has already been written
+	case *citations:
+		fmt.Printf("%v\n\n", cli.Cite(rs.Text, rs.Grounding))
+	default:
+		fmt.Printf("%v\n\n", rs.Text)
+	}
+
+	if *citations {
+		cli.ListSources(rs.Grounding)
+	}
 
 	if *stats {
+		toolCalls := 0
+		for _, turn := range rs.Turns {
+			toolCalls += len(turn.FunctionCalls)
+		}
+
 		_ = json.NewEncoder(os.Stderr).Encode(map[string]map[string]string{
 			"stats": {
-				"systemPromptBytes": fmt.Sprintf("%v", len(*systemPrompt)),
+				"systemPromptBytes": fmt.Sprintf("%v", len(systemPromptText)),
 				"promptBytes":       fmt.Sprintf("%v", len(prompt)),
 				"responseBytes":     fmt.Sprintf("%v", len(rs.Text)),
 				"tokens":            fmt.Sprintf("%v", rs.Tokens),
+				"cachedTokens":      fmt.Sprintf("%v", rs.CachedTokens),
+				"uncachedTokens":    fmt.Sprintf("%v", rs.Tokens-rs.CachedTokens),
 				"files":             fmt.Sprintf("%v", len(rs.Files)),
+				"toolCalls":         fmt.Sprintf("%v", toolCalls),
+				"archivedMessages":  fmt.Sprintf("%v", len(rs.Archived)),
+				"finishReason":      string(rs.FinishReason),
 			},
 		})
 	}
+
+	if rs.FinishReason != llm.FinishReasonStop {
+		fmt.Fprintf(os.Stderr, "response incomplete. finish reason: %v (%v)\n", rs.FinishReason, rs.FinishDetail)
+
+		switch rs.FinishReason {
+		case llm.FinishReasonMaxTokens:
+			os.Exit(exitCodeTruncated)
+		case llm.FinishReasonSafety:
+			os.Exit(exitCodeBlocked)
+		default:
+			os.Exit(exitCodeIncomplete)
+		}
+	}
+}
+
+// deleteUploads deletes the uploaded files, held by the gemini files api, that are matched by match and returns the number deleted.
+// references to the deleted files within sessions are marked as expired, so that they are uploaded again if those sessions are continued
+func deleteUploads(ctx context.Context, cfg llm.Config, appDir string, match func(llm.RemoteFile) bool) (int, error) {
+	remoteFiles, err := llm.ListRemoteFiles(ctx, cfg)
+
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, errs := []string{}, []error{}
+
+	for _, f := range remoteFiles {
+		if !match(f) {
+			continue
+		}
+
+		if err := llm.DeleteRemoteFile(ctx, cfg, f.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		deleted = append(deleted, f.URI)
+	}
+
+	if err := session.Expire(appDir, deleted); err != nil {
+		errs = append(errs, err)
+	}
+
+	return len(deleted), errors.Join(errs...)
+}
+
+// optionalFlag is a flag that can be specified alone, in the manner of a boolean flag, or with a value, in the form --flag=value
+type optionalFlag struct {
+	set   bool
+	value string
+}
+
+func (f *optionalFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *optionalFlag) Set(value string) error {
+	switch value {
+	case "true":
+		f.set, f.value = true, ""
+	case "false":
+		f.set, f.value = false, ""
+	default:
+		f.set, f.value = true, value
+	}
+	return nil
+}
+
+func (f *optionalFlag) IsBoolFlag() bool {
+	return true
 }
@@ -1,13 +1,26 @@
 package session
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand/v2"
 	"os"
 	"path"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+	"github.com/comradequinn/gen/llm"
+)
+
+const (
+	lockFileName   = ".lock"
+	idFileName     = ".id"
+	corruptDirName = "corrupt"
 )
 
 func sessionDir(appDir string) (string, error) {
@@ -26,54 +39,318 @@ func sessionDir(appDir string) (string, error) {
 	return sessionDir, nil
 }
 
-func activeSessionFilePath(appDir string) (string, bool, error) {
+// withLock calls fn with the session directory of the specified app directory, while holding an exclusive lock on it, so that
+// concurrent processes do not interleave their changes to the sessions within it
+func withLock(appDir string, fn func(sessionDir string) error) error {
+	_, err := locked(appDir, func(sessionDir string) (struct{}, error) {
+		return struct{}{}, fn(sessionDir)
+	})
+
+	return err
+}
+
+// locked calls fn with the session directory of the specified app directory, while holding an exclusive lock on it, and returns its result
+func locked[T any](appDir string, fn func(sessionDir string) (T, error)) (T, error) {
+	var result T
+
 	sessionDir, err := sessionDir(appDir)
 	if err != nil {
-		return "", false, err
+		return result, err
 	}
 
+	unlock, err := fsutil.Lock(path.Join(sessionDir, lockFileName))
+	if err != nil {
+		return result, fmt.Errorf("unable to lock session directory. %v", err)
+	}
+
+	defer unlock()
+
+	return fn(sessionDir)
+}
+
+func activeSessionFilePath(sessionDir string) (string, bool, error) {
 	files, err := os.ReadDir(sessionDir)
 
 	if err != nil {
 		return "", false, fmt.Errorf("unable to read session directory. %v", err)
 	}
 
+	active := []string{}
+
 	for _, f := range files {
-		if !f.Type().IsRegular() {
+		if !f.Type().IsRegular() || strings.HasPrefix(f.Name(), ".") {
 			continue
 		}
 
 		if strings.HasSuffix(f.Name(), ActiveSessionFileSuffix) {
-			return path.Join(sessionDir, f.Name()), true, nil
+			active = append(active, f.Name())
 		}
 	}
 
-	return "", false, nil
+	switch len(active) {
+	case 0:
+		return "", false, nil
+	case 1:
+		return path.Join(sessionDir, active[0]), true, nil
+	default:
+		return "", false, fmt.Errorf("%w. %v sessions are active, rather than one", ErrRepairRequired, len(active))
+	}
 }
 
-func openActiveSessionFile(appDir string, flag int) (*os.File, error) {
-	sessionDir, err := sessionDir(appDir)
+// load returns the path and content of the session file with the specified id or name or, if none is specified, the active session.
+// if there is no active session, the path at which it should be created is returned, with an empty document
+func load(sessionDir, ref string) (string, document, error) {
+	if ref != "" {
+		record, err := find(sessionDir, ref)
+		if err != nil {
+			return "", document{}, err
+		}
+
+		sessionFilePath := path.Join(sessionDir, record.file)
+		doc, err := readSessionFile(sessionFilePath)
+
+		return sessionFilePath, doc, err
+	}
+
+	sessionFilePath, exists, err := activeSessionFilePath(sessionDir)
 	if err != nil {
-		return nil, err
+		return "", document{}, err
+	}
+
+	if !exists {
+		return path.Join(sessionDir, newSessionFileName()+ActiveSessionFileSuffix), document{Messages: []llm.Message{}}, nil
 	}
 
-	sessionFilePath, exists, err := activeSessionFilePath(appDir)
+	doc, err := readSessionFile(sessionFilePath)
+
+	return sessionFilePath, doc, err
+}
+
+func list(sessionDir string) ([]Record, error) {
+	files, err := os.ReadDir(sessionDir)
+
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to read session directory. %v", err)
 	}
 
-	if exists {
-		sessionFile, err := os.OpenFile(sessionFilePath, flag, 0600)
+	summarise := func(messages []llm.Message) string {
+		if len(messages) == 0 {
+			return "[ no content ]"
+		}
+
+		const limit = 50
+
+		if len(messages[0].Text) < limit {
+			return messages[0].Text
+		}
+
+		return messages[0].Text[:limit] + "..."
+	}
+
+	records, unassigned := make([]Record, 0, len(files)), []Record{}
+
+	for _, f := range files {
+		if !f.Type().IsRegular() || strings.HasPrefix(f.Name(), ".") { // hidden files hold data about the sessions, rather than sessions
+			continue
+		}
+
+		doc, err := readSessionFile(path.Join(sessionDir, f.Name()))
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to summarise session file %v. %w", f.Name(), err)
+		}
+
+		info, err := f.Info()
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to get timestamp for session file %v. %v", f.Name(), err)
+		}
+
+		record := Record{
+			ID:        doc.ID,
+			Name:      doc.Name,
+			Summary:   summarise(doc.Messages),
+			TimeStamp: info.ModTime(),
+			Active:    strings.HasSuffix(f.Name(), ActiveSessionFileSuffix),
+			Parent:    doc.Parent,
+			file:      f.Name(),
+		}
+
+		if record.ID == 0 {
+			unassigned = append(unassigned, record)
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	sort.SliceStable(unassigned, func(i, j int) bool { // the order in which sessions were listed before they were assigned ids
+		return unassigned[i].TimeStamp.Before(unassigned[j].TimeStamp)
+	})
+
+	for _, record := range unassigned {
+		sessionFile := path.Join(sessionDir, record.file)
+
+		doc, err := readSessionFile(sessionFile)
+
 		if err != nil {
-			return nil, fmt.Errorf("unable to open session file. %v", err)
+			return nil, err
+		}
+
+		if doc.ID, err = nextID(sessionDir, records); err != nil {
+			return nil, err
+		}
+
+		if err := writeSessionFile(sessionFile, doc); err != nil {
+			return nil, err
+		}
+
+		record.ID = doc.ID
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+
+	return records, nil
+}
+
+func find(sessionDir, ref string) (Record, error) {
+	records, err := list(sessionDir)
+
+	if err != nil {
+		return Record{}, err
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+
+	for _, record := range records {
+		if (err == nil && record.ID == id) || (record.Name != "" && record.Name == ref) {
+			return record, nil
 		}
-		return sessionFile, nil
 	}
 
-	sessionFile, err := os.OpenFile(path.Join(sessionDir, strconv.FormatInt(time.Now().UnixNano(), 10)+"_"+strconv.Itoa(rand.Int())+ActiveSessionFileSuffix), flag|os.O_CREATE, 0600)
+	return Record{}, fmt.Errorf("invalid session '%v'. no session with that id or name exists", ref)
+}
+
+func checkName(sessionDir, name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid session name '%v'. names must start with a letter or digit and contain only letters, digits, '.', '_' and '-'", name)
+	}
+
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("invalid session name '%v'. names cannot consist only of digits, as they would be indistinguishable from ids", name)
+	}
+
+	records, err := list(sessionDir)
+
 	if err != nil {
-		return nil, fmt.Errorf("unable to open session file. %v", err)
+		return err
+	}
+
+	if slices.ContainsFunc(records, func(r Record) bool { return r.Name == name }) {
+		return fmt.Errorf("invalid session name '%v'. a session with that name already exists", name)
+	}
+
+	return nil
+}
+
+func stash(sessionDir string) error {
+	sessionFile, exists, err := activeSessionFilePath(sessionDir)
+
+	if !exists || err != nil {
+		return err
+	}
+
+	if err := os.Rename(sessionFile, strings.TrimSuffix(sessionFile, ActiveSessionFileSuffix)); err != nil {
+		return fmt.Errorf("unable to rename existing active	session file. %w", err)
+	}
+
+	return nil
+}
+
+// assignID returns the id of the session in the specified file, first assigning ids to any sessions without them, or a newly
+// allocated id if the file does not exist
+func assignID(sessionDir, sessionFilePath string) (int, error) {
+	records, err := list(sessionDir)
+	if err != nil {
+		return 0, err
+	}
+
+	if i := slices.IndexFunc(records, func(r Record) bool { return r.file == path.Base(sessionFilePath) }); i != -1 {
+		return records[i].ID, nil
+	}
+
+	return nextID(sessionDir, records)
+}
+
+// nextID allocates a session id that is greater than that of any existing, or previously deleted, session. the greatest id allocated
+// is recorded in a hidden file in the session directory, so that the ids of deleted sessions are not reused
+func nextID(sessionDir string, records []Record) (int, error) {
+	idFilePath := path.Join(sessionDir, idFileName)
+	id := 0
+
+	if data, err := os.ReadFile(idFilePath); err == nil {
+		id, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	for _, record := range records {
+		id = max(id, record.ID)
+	}
+
+	id++
+
+	if err := fsutil.WriteFile(idFilePath, []byte(strconv.Itoa(id))); err != nil {
+		return 0, fmt.Errorf("unable to record session id. %v", err)
+	}
+
+	return id, nil
+}
+
+func newSessionFileName() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + strconv.Itoa(rand.Int())
+}
+
+// readSessionFile returns the content of the specified session file. files written before sessions were assigned ids, which hold
+// only an array of messages, are returned with an id of zero
+func readSessionFile(sessionFilePath string) (document, error) {
+	data, err := os.ReadFile(sessionFilePath)
+	if err != nil {
+		return document{}, fmt.Errorf("unable to read session file. %v", err)
+	}
+
+	doc := document{Messages: []llm.Message{}}
+
+	switch data = bytes.TrimSpace(data); {
+	case len(data) == 0:
+		return doc, nil
+	case data[0] == '[':
+		err = json.Unmarshal(data, &doc.Messages)
+	default:
+		err = json.Unmarshal(data, &doc)
+	}
+
+	if err != nil {
+		return document{}, fmt.Errorf("%w. unable to decode session file. %v", ErrRepairRequired, err)
+	}
+
+	if doc.Messages == nil {
+		doc.Messages = []llm.Message{}
+	}
+
+	return doc, nil
+}
+
+func writeSessionFile(sessionFilePath string, doc document) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode session file. %w", err)
+	}
+
+	if err := fsutil.WriteFile(sessionFilePath, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write session file. %v", err)
 	}
 
-	return sessionFile, nil
+	return nil
 }
@@ -0,0 +1,354 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/internal/fsutil"
+)
+
+type (
+	// Query selects the turns returned by Search
+	Query struct {
+		Pattern *regexp.Regexp // matched against each line of the prompt and response of each turn
+		From    time.Time      // if set, only turns at or after this time are matched
+		To      time.Time      // if set, only turns before this time are matched
+		Model   string         // if set, only turns whose response was written by a model whose name contains this are matched
+		Context int            // the number of lines before and after each matching line to include in excerpts
+	}
+	// Match is a turn matched by Search
+	Match struct {
+		ID       int
+		Name     string
+		Turn     int  // the number of the turn, counting any archived turns first, as in a transcript
+		Archived bool // whether the turn was archived by compaction
+		Time     time.Time
+		Model    string
+		Prompt   []string // the matching lines of the prompt, with context. non-adjacent excerpts are separated by '...'
+		Response []string // the matching lines of the response, with context. non-adjacent excerpts are separated by '...'
+	}
+	// index holds the metadata of the turns of each session file, so that sessions with no turns in the date range or of the model searched
+	// for are not read. the text of the turns is not held, so that it is not duplicated, and is instead read from the session files when
+	// matching. entries are keyed by the name of the file without the active session suffix, so that they remain valid when sessions are
+	// stashed and restored
+	index struct {
+		Sessions map[string]indexEntry `json:"sessions"`
+	}
+	indexEntry struct {
+		ModTime time.Time   `json:"modTime"`
+		Size    int64       `json:"size"`
+		ID      int         `json:"id"`
+		Name    string      `json:"name,omitempty"`
+		Turns   []indexTurn `json:"turns"`
+	}
+	indexTurn struct {
+		Hash     string    `json:"hash"` // a hash of the prompt and response, so that excerpts of turns copied by forks are only computed once
+		Model    string    `json:"model,omitempty"`
+		Time     time.Time `json:"time,omitzero"`
+		Archived bool      `json:"archived,omitempty"`
+	}
+)
+
+const indexFileName = ".index"
+
+// Search returns the turns of all sessions whose prompt or response matches the specified query, ordered by session id and turn. Turns
+// recorded before times were recorded are matched by date using the time their session was last used. The metadata of each turn is held
+// in an index in the session directory, which is updated with any sessions changed since the last search, so that only sessions with turns
+// in the date range, and of the model, searched for are read. The pattern is matched against the text of each of those sessions in turn,
+// as the text is not indexed. Turns copied by forks are listed for each session that holds them. A session found to differ from its entry
+// in the index is indexed again before it is searched
+func Search(appDir string, query Query) ([]Match, error) {
+	if query.Pattern == nil {
+		return nil, fmt.Errorf("invalid search. a pattern must be specified")
+	}
+
+	return locked(appDir, func(sessionDir string) ([]Match, error) {
+		idx, err := updateIndex(sessionDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		matches, excerpts := []Match{}, map[string][2][]string{} // the excerpts of each turn, by hash, as forks hold copies of the same turns
+
+		for file, entry := range idx.Sessions {
+			candidates := entry.candidates(query)
+
+			if len(candidates) == 0 {
+				continue
+			}
+
+			sessionFile := indexedFile(sessionDir, file)
+			doc, err := readSessionFile(sessionFile)
+
+			if err != nil {
+				return nil, err
+			}
+
+			content := append(turns(doc.Archive), turns(doc.Messages)...)
+
+			if !entry.current(content) { // the session was changed without its size or timestamp changing, so it is indexed again
+				info, err := os.Stat(sessionFile)
+
+				if err != nil {
+					return nil, fmt.Errorf("unable to get timestamp for session file %v. %v", file, err)
+				}
+
+				entry = indexEntryOf(doc, info)
+				idx.Sessions[file] = entry
+
+				if err := writeIndex(sessionDir, idx); err != nil {
+					return nil, err
+				}
+
+				candidates = entry.candidates(query)
+			}
+
+			for _, i := range candidates {
+				turn := entry.Turns[i]
+				e, ok := excerpts[turn.Hash]
+
+				if !ok {
+					e = [2][]string{excerpt(content[i].Prompt, query.Pattern, query.Context), excerpt(content[i].Response, query.Pattern, query.Context)}
+					excerpts[turn.Hash] = e
+				}
+
+				if len(e[0]) == 0 && len(e[1]) == 0 {
+					continue
+				}
+
+				matches = append(matches, Match{
+					ID:       entry.ID,
+					Name:     entry.Name,
+					Turn:     i + 1,
+					Archived: turn.Archived,
+					Time:     entry.time(i),
+					Model:    turn.Model,
+					Prompt:   e[0],
+					Response: e[1],
+				})
+			}
+		}
+
+		sort.Slice(matches, func(i, j int) bool {
+			if matches[i].ID != matches[j].ID {
+				return matches[i].ID < matches[j].ID
+			}
+			return matches[i].Turn < matches[j].Turn
+		})
+
+		return matches, nil
+	})
+}
+
+// indexedFile returns the path of the session file with the specified index key, whether it is active or stashed
+func indexedFile(sessionDir, key string) string {
+	sessionFile := path.Join(sessionDir, key+ActiveSessionFileSuffix)
+
+	if _, err := os.Stat(sessionFile); err != nil {
+		sessionFile = path.Join(sessionDir, key)
+	}
+
+	return sessionFile
+}
+
+// indexEntryOf returns the index entry of the specified session document, read from a file with the specified info
+func indexEntryOf(doc document, info os.FileInfo) indexEntry {
+	entry := indexEntry{ModTime: info.ModTime(), Size: info.Size(), ID: doc.ID, Name: doc.Name}
+
+	for _, turn := range turns(doc.Archive) {
+		entry.Turns = append(entry.Turns, indexTurn{Hash: hash(turn), Model: turn.Model, Time: turn.Time, Archived: true})
+	}
+
+	for _, turn := range turns(doc.Messages) {
+		entry.Turns = append(entry.Turns, indexTurn{Hash: hash(turn), Model: turn.Model, Time: turn.Time})
+	}
+
+	return entry
+}
+
+// candidates returns the positions of the turns of the entry in the date range, and of the model, of the specified query
+func (entry indexEntry) candidates(query Query) []int {
+	candidates := []int{}
+
+	for i, turn := range entry.Turns {
+		switch t := entry.time(i); {
+		case !query.From.IsZero() && t.Before(query.From),
+			!query.To.IsZero() && !t.Before(query.To),
+			query.Model != "" && !strings.Contains(turn.Model, query.Model):
+			continue
+		}
+
+		candidates = append(candidates, i)
+	}
+
+	return candidates
+}
+
+// time returns the time of the turn of the entry at the specified position. turns recorded before times were recorded are given the
+// time their session was last used
+func (entry indexEntry) time(i int) time.Time {
+	if entry.Turns[i].Time.IsZero() {
+		return entry.ModTime
+	}
+
+	return entry.Turns[i].Time
+}
+
+// current reports whether the entry holds the specified turns of its session, as read from the session file
+func (entry indexEntry) current(content []Turn) bool {
+	if len(content) != len(entry.Turns) {
+		return false
+	}
+
+	for i, turn := range content {
+		if hash(turn) != entry.Turns[i].Hash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hash returns a hash of the prompt and response of the specified turn
+func hash(turn Turn) string {
+	h := sha256.Sum256([]byte(turn.Prompt + "\x00" + turn.Response))
+	return hex.EncodeToString(h[:8])
+}
+
+// updateIndex returns the search index of the specified session directory, first updating it with any session files that have been added,
+// changed or removed since it was written
+func updateIndex(sessionDir string) (index, error) {
+	idx := index{}
+
+	if data, err := os.ReadFile(path.Join(sessionDir, indexFileName)); err == nil {
+		_ = json.Unmarshal(data, &idx) // an unreadable index is rebuilt
+	}
+
+	if idx.Sessions == nil {
+		idx.Sessions = map[string]indexEntry{}
+	}
+
+	files, err := os.ReadDir(sessionDir)
+
+	if err != nil {
+		return index{}, fmt.Errorf("unable to read session directory. %v", err)
+	}
+
+	changed, current := false, map[string]bool{}
+
+	for _, f := range files {
+		if !f.Type().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		key := strings.TrimSuffix(f.Name(), ActiveSessionFileSuffix)
+		current[key] = true
+
+		info, err := f.Info()
+
+		if err != nil {
+			return index{}, fmt.Errorf("unable to get timestamp for session file %v. %v", f.Name(), err)
+		}
+
+		if entry, ok := idx.Sessions[key]; ok && entry.ModTime.Equal(info.ModTime()) && entry.Size == info.Size() {
+			continue
+		}
+
+		doc, err := readSessionFile(path.Join(sessionDir, f.Name()))
+
+		if err != nil {
+			return index{}, fmt.Errorf("unable to index session file %v. %w", f.Name(), err)
+		}
+
+		if doc.ID == 0 { // the session was written before sessions were assigned ids, so all such sessions are assigned them and indexing restarts
+			if _, err := list(sessionDir); err != nil {
+				return index{}, err
+			}
+
+			return updateIndex(sessionDir)
+		}
+
+		idx.Sessions[key], changed = indexEntryOf(doc, info), true
+	}
+
+	for key := range idx.Sessions {
+		if !current[key] {
+			delete(idx.Sessions, key)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return idx, nil
+	}
+
+	if err := writeIndex(sessionDir, idx); err != nil {
+		return index{}, err
+	}
+
+	return idx, nil
+}
+
+// writeIndex writes the specified search index to the specified session directory
+func writeIndex(sessionDir string, idx index) error {
+	data, err := json.Marshal(idx)
+
+	if err != nil {
+		return fmt.Errorf("unable to encode search index. %w", err)
+	}
+
+	if err := fsutil.WriteFile(path.Join(sessionDir, indexFileName), data); err != nil {
+		return fmt.Errorf("unable to write search index. %v", err)
+	}
+
+	return nil
+}
+
+// excerpt returns the lines of the specified text that match the specified pattern, along with the specified number of lines before and
+// after each, or nil if no line matches. non-adjacent groups of lines are separated by '...'
+func excerpt(text string, pattern *regexp.Regexp, context int) []string {
+	lines := strings.Split(text, "\n")
+	include := make([]bool, len(lines))
+	matched := false
+
+	for i, line := range lines {
+		if !pattern.MatchString(line) {
+			continue
+		}
+
+		matched = true
+
+		for j := max(0, i-context); j <= min(len(lines)-1, i+context); j++ {
+			include[j] = true
+		}
+	}
+
+	if !matched {
+		return nil
+	}
+
+	excerpts, last := []string{}, -1
+
+	for i, line := range lines {
+		if !include[i] {
+			continue
+		}
+
+		if last != -1 && i > last+1 {
+			excerpts = append(excerpts, "...")
+		}
+
+		excerpts, last = append(excerpts, line), i
+	}
+
+	return excerpts
+}
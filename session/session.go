@@ -1,23 +1,32 @@
 package session
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"maps"
 	"os"
 	"path"
-	"sort"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/comradequinn/gen/internal/fsutil"
 	"github.com/comradequinn/gen/llm"
 )
 
 type (
 	Entry struct {
-		Prompt   string
-		Files    []llm.FileReference
-		Response string
+		Prompt    string
+		Files     []llm.FileReference
+		Turns     []llm.Message
+		Response  string
+		Grounding *llm.Grounding
+		History   []llm.Message
+		Read      int           // the number of messages in the session when the messages that History replaces were read
+		Archived  []llm.Message // messages removed from History by compaction, which are retained in the archive of the session
+		Model     string
+		Tokens    int
 	}
 	Record struct {
 		ID        int
@@ -25,230 +34,533 @@ type (
 		Summary   string
 		TimeStamp time.Time
 		Active    bool
+		Parent    int // the id of the session from which this session was forked, if any
+		file      string
+	}
+	// document is the content of a session file
+	document struct {
+		ID       int           `json:"id"`
+		Name     string        `json:"name,omitempty"`
+		Parent   int           `json:"parent,omitempty"`
+		Messages []llm.Message `json:"messages"`
+		Archive  []llm.Message `json:"archive,omitempty"` // messages no longer sent with prompts, as the history was compacted
 	}
 )
 
 const ActiveSessionFileSuffix = ".active"
 
-// Write adds the specified entry to the active session
-func Write(appDir string, entry Entry) error {
-	messages, err := Read(appDir)
+// ErrRepairRequired is returned when the session directory is in a state that requires Repair to be called before it can be used
+var ErrRepairRequired = errors.New("the session directory requires repair")
 
-	if err != nil {
-		return err
-	}
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
 
-	f, err := openActiveSessionFile(appDir, os.O_WRONLY|os.O_TRUNC)
+// Write adds the specified entry to the session with the specified id or name or, if none is specified, the active session. If the entry
+// specifies a history, it replaces the messages of the session that were read, such as when the file references within them have been
+// refreshed or the history compacted. Any messages added to the session by another process since they were read are retained, as are any
+// archived messages, which are added to the archive of the session
+func Write(appDir, ref string, entry Entry) error {
+	return withLock(appDir, func(sessionDir string) error {
+		sessionFile, doc, err := load(sessionDir, ref)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	defer f.Close()
+		if doc.ID == 0 { // a new session, or one written before sessions were assigned ids
+			if doc.ID, err = assignID(sessionDir, sessionFile); err != nil {
+				return err
+			}
+		}
 
-	jsonEncoder := json.NewEncoder(f)
-	jsonEncoder.SetIndent("", "  ")
+		if entry.History != nil {
+			doc.Messages = append(slices.Clone(entry.History), doc.Messages[min(entry.Read, len(doc.Messages)):]...)
+		}
 
-	if err := jsonEncoder.Encode(append(messages, llm.Message{
-		Role:  llm.RoleUser,
-		Text:  entry.Prompt,
-		Files: entry.Files,
-	}, llm.Message{
-		Role: llm.RoleModel,
-		Text: entry.Response,
-	})); err != nil {
-		return fmt.Errorf("unable to encode session file. %w", err)
-	}
+		doc.Archive = append(doc.Archive, entry.Archived...)
 
-	return nil
-}
+		doc.Messages = append(doc.Messages, llm.Message{
+			Role:  llm.RoleUser,
+			Text:  entry.Prompt,
+			Files: entry.Files,
+			Time:  time.Now(),
+		})
 
-// Read returns all messages in the active session
-func Read(appDir string) ([]llm.Message, error) {
-	f, err := openActiveSessionFile(appDir, os.O_RDONLY)
+		doc.Messages = append(doc.Messages, entry.Turns...)
 
-	if err != nil {
-		return nil, err
-	}
+		doc.Messages = append(doc.Messages, llm.Message{
+			Role:      llm.RoleModel,
+			Text:      entry.Response,
+			Grounding: entry.Grounding,
+			Model:     entry.Model,
+			Tokens:    entry.Tokens,
+			Time:      time.Now(),
+		})
 
-	defer f.Close()
+		return writeSessionFile(sessionFile, doc)
+	})
+}
 
-	messages := []llm.Message{}
+// Read returns all messages in the session with the specified id or name or, if none is specified, the active session
+func Read(appDir, ref string) ([]llm.Message, error) {
+	return locked(appDir, func(sessionDir string) ([]llm.Message, error) {
+		_, doc, err := load(sessionDir, ref)
 
-	if err := json.NewDecoder(f).Decode(&messages); err != nil {
-		if err == io.EOF {
-			return []llm.Message{}, nil
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, fmt.Errorf("unable to decode session file. %w", err)
-	}
-
-	return messages, nil
+		return doc.Messages, nil
+	})
 }
 
-// List returns summary and meta data for all saved sessions and the active one
+// List returns summary and meta data for all saved sessions and the active one, ordered by id. Any sessions written before
+// sessions were assigned ids are first assigned them, in the order in which they were last used
 func List(appDir string) ([]Record, error) {
-	sessionDir, err := sessionDir(appDir)
+	return locked(appDir, list)
+}
 
-	if err != nil {
-		return nil, err
-	}
+// Find returns the record of the session with the specified id or name. An id may optionally be prefixed with '#'
+func Find(appDir, ref string) (Record, error) {
+	return locked(appDir, func(sessionDir string) (Record, error) {
+		return find(sessionDir, ref)
+	})
+}
 
-	files, err := os.ReadDir(sessionDir)
+// CheckName returns an error if the specified name cannot be given to a session, either because it is not valid or is already in use.
+// Names must start with a letter or digit, contain only letters, digits, '.', '_' and '-', and not consist only of digits
+func CheckName(appDir, name string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		return checkName(sessionDir, name)
+	})
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("unable to read session directory. %v", err)
-	}
+// New saves the current session and starts a new, empty one with the specified name. An empty name starts an unnamed session
+func New(appDir, name string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		if name != "" {
+			if err := checkName(sessionDir, name); err != nil {
+				return err
+			}
+		}
 
-	summarise := func(f string) (string, error) {
-		sessionFile, err := os.Open(path.Join(sessionDir, f))
+		if err := stash(sessionDir); err != nil {
+			return err
+		}
+
+		sessionFile, _, err := load(sessionDir, "")
 
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		defer sessionFile.Close()
+		id, err := assignID(sessionDir, sessionFile)
+
+		if err != nil {
+			return err
+		}
 
-		messages := []llm.Message{}
+		return writeSessionFile(sessionFile, document{ID: id, Name: name, Messages: []llm.Message{}})
+	})
+}
 
-		if err := json.NewDecoder(sessionFile).Decode(&messages); err != nil && err != io.EOF {
-			return "", fmt.Errorf("unable to decode session file. %v %v", sessionFile, err)
+// Rename sets the name of the session with the specified id or name or, if none is specified, the active session
+func Rename(appDir, ref, name string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		if err := checkName(sessionDir, name); err != nil {
+			return err
 		}
 
-		if len(messages) == 0 {
-			return "[ no content ]", nil
+		sessionFile, doc, err := load(sessionDir, ref)
+
+		if err != nil {
+			return err
 		}
 
-		const limit = 50
+		if doc.ID == 0 {
+			if _, err := os.Stat(sessionFile); err != nil {
+				return fmt.Errorf("invalid session. there is no active session to rename")
+			}
 
-		if len(messages[0].Text) < limit {
-			return messages[0].Text, nil
+			if doc.ID, err = assignID(sessionDir, sessionFile); err != nil { // the session was written before sessions were assigned ids
+				return err
+			}
 		}
 
-		return messages[0].Text[:limit] + "...", nil
-	}
+		doc.Name = name
 
-	records := make([]Record, 0, len(files))
+		return writeSessionFile(sessionFile, doc)
+	})
+}
 
-	for i, f := range files { // files are sorted by file name which is based on the unixnano time at the point of writing; which is the sort order required
-		if !f.Type().IsRegular() {
-			continue
+// Fork copies the session with the specified id or name or, if none is specified, the active session, to a new session with the specified
+// name, and makes the copy the active session. When turn is greater than zero, only the turns up to and including it are copied, so that
+// the conversation can continue from that point. Turns are numbered as in a Transcript, with any archived turns first, so that the numbers
+// reported by Search and Export can be used. Forking at an archived turn restores the archived turns up to it as the history of the copy.
+// The copied session is recorded as the parent of the copy. An empty name creates an unnamed session
+func Fork(appDir, ref string, turn int, name string) (Record, error) {
+	return locked(appDir, func(sessionDir string) (Record, error) {
+		if name != "" {
+			if err := checkName(sessionDir, name); err != nil {
+				return Record{}, err
+			}
 		}
 
-		summary, err := summarise(f.Name())
+		if turn < 0 {
+			return Record{}, fmt.Errorf("invalid turn %v. turns are numbered from 1", turn)
+		}
+
+		sessionFile, doc, err := load(sessionDir, ref)
 
 		if err != nil {
-			return nil, fmt.Errorf("unable to summarise session file %v. %v", f.Name(), err)
+			return Record{}, err
 		}
 
-		info, err := f.Info()
+		if _, err := os.Stat(sessionFile); err != nil {
+			return Record{}, fmt.Errorf("invalid session. there is no active session to fork")
+		}
+
+		if doc.ID == 0 {
+			if doc.ID, err = assignID(sessionDir, sessionFile); err != nil { // the session was written before sessions were assigned ids
+				return Record{}, err
+			}
+
+			if err := writeSessionFile(sessionFile, doc); err != nil {
+				return Record{}, err
+			}
+		}
+
+		messages, archive := doc.Messages, doc.Archive
+
+		if turn > 0 {
+			archived, archivedTurns := throughTurn(doc.Archive, turn)
+			current, currentTurns := throughTurn(doc.Messages, turn-archivedTurns)
+
+			switch {
+			case turn > archivedTurns+currentTurns:
+				return Record{}, fmt.Errorf("invalid turn %v. the session has %v turns", turn, archivedTurns+currentTurns)
+			case turn <= archivedTurns:
+				messages, archive = archived, nil
+			default:
+				messages = current
+			}
+		}
+
+		if err := stash(sessionDir); err != nil {
+			return Record{}, err
+		}
+
+		records, err := list(sessionDir)
 
 		if err != nil {
-			return nil, fmt.Errorf("unable to get timestamp for session file %v. %v", f.Name(), err)
+			return Record{}, err
 		}
 
-		records = append(records, Record{
-			ID:        i + 1,
-			Name:      f.Name(),
-			Summary:   summary,
-			TimeStamp: info.ModTime(),
-			Active:    strings.HasSuffix(f.Name(), ActiveSessionFileSuffix),
-		})
+		fork := document{Name: name, Parent: doc.ID, Messages: slices.Clone(messages), Archive: slices.Clone(archive)}
+
+		if fork.ID, err = nextID(sessionDir, records); err != nil {
+			return Record{}, err
+		}
+
+		forkFile := newSessionFileName() + ActiveSessionFileSuffix
+
+		if err := writeSessionFile(path.Join(sessionDir, forkFile), fork); err != nil {
+			return Record{}, err
+		}
+
+		return Record{ID: fork.ID, Name: fork.Name, Active: true, Parent: fork.Parent, file: forkFile}, nil
+	})
+}
+
+// throughTurn returns the specified messages up to the end of the specified turn, numbered from 1, along with the number of turns in all of
+// the messages. turns are counted in the same manner as they are grouped by turns, so that the numbers match those of a Transcript
+func throughTurn(messages []llm.Message, turn int) ([]llm.Message, int) {
+	started, end := 0, len(messages)
+
+	for i, message := range messages {
+		if i == 0 || startsTurn(message) {
+			started++
+
+			if started == turn+1 {
+				end = i
+			}
+		}
 	}
 
-	sort.SliceStable(records, func(i, j int) bool {
-		return records[i].TimeStamp.Before(records[j].TimeStamp)
+	return messages[:end], started
+}
+
+// Undo removes the last turn, being the last prompt and its response, from the session with the specified id or name or, if none is
+// specified, the active session, and returns the prompt that was removed
+func Undo(appDir, ref string) (llm.Message, error) {
+	return locked(appDir, func(sessionDir string) (llm.Message, error) {
+		sessionFile, doc, err := load(sessionDir, ref)
+
+		if err != nil {
+			return llm.Message{}, err
+		}
+
+		i := LastTurn(doc.Messages)
+
+		if i == -1 {
+			return llm.Message{}, fmt.Errorf("invalid session. there is no turn to undo")
+		}
+
+		prompt := doc.Messages[i]
+		doc.Messages = doc.Messages[:i]
+
+		return prompt, writeSessionFile(sessionFile, doc)
 	})
+}
+
+// LastTurn returns the index of the prompt that begins the last turn of the specified messages, or -1 if there are no turns. The messages
+// before it are the history of that prompt
+func LastTurn(messages []llm.Message) int {
+	for i, message := range slices.Backward(messages) {
+		if startsTurn(message) {
+			return i
+		}
+	}
 
-	return records, nil
+	return -1
 }
 
 // Stash saves the current session and starts a new one
 func Stash(appDir string) error {
-	sessionFile, exists, err := activeSessionFilePath(appDir)
+	return withLock(appDir, stash)
+}
 
-	if !exists || err != nil {
-		return err
-	}
+// Restore sets the stashed session with the specified id or name as the active session
+func Restore(appDir, ref string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		record, err := find(sessionDir, ref)
 
-	if err := os.Rename(sessionFile, strings.TrimSuffix(sessionFile, ActiveSessionFileSuffix)); err != nil {
-		return fmt.Errorf("unable to rename existing active	session file. %w", err)
-	}
+		if err != nil {
+			return err
+		}
 
-	return nil
-}
+		if record.Active {
+			return nil
+		}
 
-// Restore sets the specified stashed session as the active session
-func Restore(appDir string, recordID int) error {
-	records, err := List(appDir)
+		if err := stash(sessionDir); err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
-	}
+		if err := os.Rename(path.Join(sessionDir, record.file), path.Join(sessionDir, record.file+ActiveSessionFileSuffix)); err != nil {
+			return fmt.Errorf("unable to restore session file. %w", err)
+		}
 
-	if recordID > len(records) {
-		return fmt.Errorf("invalid record id %v", recordID)
-	}
+		return nil
+	})
+}
+
+// Delete removes the session with the specified id or name
+func Delete(appDir, ref string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		record, err := find(sessionDir, ref)
+
+		if err != nil {
+			return err
+		}
 
-	record := records[recordID-1]
+		if err := os.Remove(path.Join(sessionDir, record.file)); err != nil {
+			return fmt.Errorf("unable to delete session file. %w", err)
+		}
 
-	if record.Active {
 		return nil
-	}
+	})
+}
 
-	sessionDir, err := sessionDir(appDir)
-	if err != nil {
-		return err
-	}
+// References returns the ids of the sessions that reference each uploaded file, keyed by the uri of the file
+func References(appDir string) (map[string][]int, error) {
+	return locked(appDir, func(sessionDir string) (map[string][]int, error) {
+		records, err := list(sessionDir)
 
-	if err := Stash(appDir); err != nil {
-		return err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	if err := os.Rename(path.Join(sessionDir, record.Name), path.Join(sessionDir, record.Name+ActiveSessionFileSuffix)); err != nil {
-		return fmt.Errorf("unable to restore session file. %w", err)
-	}
+		references := map[string][]int{}
+
+		for _, record := range records {
+			doc, err := readSessionFile(path.Join(sessionDir, record.file))
 
-	return nil
+			if err != nil {
+				return nil, err
+			}
+
+			for _, message := range doc.Messages {
+				for _, fileReference := range message.Files {
+					if fileReference.URI != "" && !slices.Contains(references[fileReference.URI], record.ID) {
+						references[fileReference.URI] = append(references[fileReference.URI], record.ID)
+					}
+				}
+			}
+		}
+
+		return references, nil
+	})
 }
 
-// Delete removes the specified session
-func Delete(appDir string, recordID int) error {
-	records, err := List(appDir)
+// Expire marks any references to the specified uploaded files, in all sessions, as expired. This ensures the files are uploaded again,
+// if still available, rather than reused, when a session is next continued, such as when the uploads have been deleted
+func Expire(appDir string, uris []string) error {
+	return withLock(appDir, func(sessionDir string) error {
+		records, err := list(sessionDir)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if recordID > len(records) {
-		return fmt.Errorf("invalid record id %v", recordID)
-	}
+		for _, record := range records {
+			sessionFilePath := path.Join(sessionDir, record.file)
+			doc, err := readSessionFile(sessionFilePath)
 
-	record := records[recordID-1]
+			if err != nil {
+				return err
+			}
 
-	sessionDir, err := sessionDir(appDir)
-	if err != nil {
-		return err
-	}
+			expired := false
 
-	if err := os.Remove(path.Join(sessionDir, record.Name)); err != nil {
-		return fmt.Errorf("unable to delete session file. %w", err)
-	}
+			for i := range doc.Messages {
+				for j := range doc.Messages[i].Files {
+					if slices.Contains(uris, doc.Messages[i].Files[j].URI) {
+						doc.Messages[i].Files[j].Expires, expired = time.Now(), true
+					}
+				}
+			}
 
-	return nil
+			if !expired {
+				continue
+			}
+
+			if err := writeSessionFile(sessionFilePath, doc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
-// DeleteAll removes all stashed sessions
+// DeleteAll removes all stashed sessions. The record of the ids previously allocated is retained, so that they are not reused
 func DeleteAll(appDir string) error {
-	sessionDir, err := sessionDir(appDir)
+	return withLock(appDir, func(sessionDir string) error {
+		files, err := os.ReadDir(sessionDir)
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return fmt.Errorf("unable to read session directory. %v", err)
+		}
 
-	if err := os.RemoveAll(sessionDir); err != nil {
-		return fmt.Errorf("unable to delete all session data. %w", err)
-	}
+		for _, f := range files {
+			if f.Name() == lockFileName || f.Name() == idFileName {
+				continue
+			}
+
+			if err := os.RemoveAll(path.Join(sessionDir, f.Name())); err != nil {
+				return fmt.Errorf("unable to delete all session data. %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// Repair restores the session directory to a usable state and returns a description of each change made. Session files that cannot be
+// decoded are moved to a 'corrupt' subdirectory, all but the most recently used of multiple active sessions are stashed, sessions that share
+// an id with another are assigned new ids and any temporary files left by interrupted writes are removed
+func Repair(appDir string) ([]string, error) {
+	return locked(appDir, func(sessionDir string) ([]string, error) {
+		files, err := os.ReadDir(sessionDir)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read session directory. %v", err)
+		}
+
+		changes, active, decoded := []string{}, []os.DirEntry{}, map[string]document{}
+
+		for _, f := range files {
+			file := path.Join(sessionDir, f.Name())
+
+			switch {
+			case strings.HasPrefix(f.Name(), fsutil.TempFilePrefix):
+				if err := os.Remove(file); err != nil {
+					return nil, fmt.Errorf("unable to remove temporary file %v. %w", f.Name(), err)
+				}
+				changes = append(changes, fmt.Sprintf("removed temporary file %v", f.Name()))
+				continue
+			case !f.Type().IsRegular() || strings.HasPrefix(f.Name(), "."):
+				continue
+			}
+
+			doc, err := readSessionFile(file)
+
+			if err != nil {
+				corruptDir := path.Join(sessionDir, corruptDirName)
+
+				if err := os.MkdirAll(corruptDir, 0755); err != nil {
+					return nil, fmt.Errorf("unable to create directory for corrupt session files. %w", err)
+				}
 
-	return nil
+				if err := os.Rename(file, path.Join(corruptDir, f.Name())); err != nil {
+					return nil, fmt.Errorf("unable to move corrupt session file %v. %w", f.Name(), err)
+				}
+
+				changes = append(changes, fmt.Sprintf("moved corrupt session file %v to %v", f.Name(), path.Join(corruptDir, f.Name())))
+				continue
+			}
+
+			decoded[f.Name()] = doc
+
+			if strings.HasSuffix(f.Name(), ActiveSessionFileSuffix) {
+				active = append(active, f)
+			}
+		}
+
+		records, seen := []Record{}, map[int]bool{}
+
+		for _, doc := range decoded {
+			records = append(records, Record{ID: doc.ID})
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(decoded)) { // files are named by creation time, so the first to use an id retains it
+			doc := decoded[name]
+
+			if doc.ID == 0 || !seen[doc.ID] {
+				seen[doc.ID] = true
+				continue
+			}
+
+			id := doc.ID
+
+			if doc.ID, err = nextID(sessionDir, records); err != nil {
+				return nil, err
+			}
+
+			if err := writeSessionFile(path.Join(sessionDir, name), doc); err != nil {
+				return nil, err
+			}
+
+			records = append(records, Record{ID: doc.ID})
+			changes = append(changes, fmt.Sprintf("assigned session file %v the id #%v, as #%v was in use", name, doc.ID, id))
+		}
+
+		if len(active) > 1 {
+			slices.SortFunc(active, func(a, b os.DirEntry) int {
+				aInfo, _ := a.Info()
+				bInfo, _ := b.Info()
+				return bInfo.ModTime().Compare(aInfo.ModTime())
+			})
+
+			for _, f := range active[1:] {
+				if err := os.Rename(path.Join(sessionDir, f.Name()), path.Join(sessionDir, strings.TrimSuffix(f.Name(), ActiveSessionFileSuffix))); err != nil {
+					return nil, fmt.Errorf("unable to stash session file %v. %w", f.Name(), err)
+				}
+
+				changes = append(changes, fmt.Sprintf("stashed session file %v, as %v is the most recently used active session", f.Name(), active[0].Name()))
+			}
+		}
+
+		return changes, nil
+	})
 }
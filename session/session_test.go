@@ -1,9 +1,20 @@
 package session_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/comradequinn/gen/llm"
 	"github.com/comradequinn/gen/session"
 )
 
@@ -14,7 +25,7 @@ func TestSession(t *testing.T) {
 	defer os.RemoveAll(testDir)
 
 	writeSession := func(prompt, response string) {
-		if err := session.Write(testDir, session.Entry{
+		if err := session.Write(testDir, "", session.Entry{
 			Prompt:   prompt,
 			Response: response,
 		}); err != nil {
@@ -26,7 +37,7 @@ func TestSession(t *testing.T) {
 	writeSession("test-prompt-2", "test-response-2")
 	writeSession("test-prompt-3", "test-response-3")
 
-	actualsession, err := session.Read(testDir)
+	actualsession, err := session.Read(testDir, "")
 
 	if err != nil {
 		t.Fatalf("expected no error reading session. got %v", err)
@@ -53,11 +64,28 @@ func TestSession(t *testing.T) {
 	assertString(actualsession[4].Text, "test-prompt-3", "third prompt")
 	assertString(actualsession[5].Text, "test-response-3", "third response")
 
+	if err := session.Write(testDir, "", session.Entry{
+		Prompt:   "test-prompt-4",
+		Response: "test-response-4",
+		History:  actualsession[2:],
+		Read:     len(actualsession),
+	}); err != nil {
+		t.Fatalf("expected no error writing session with history. got %v", err)
+	}
+
+	if actualsession, err = session.Read(testDir, ""); err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	assertInt(len(actualsession), 6, "session count after history replaced")
+	assertString(actualsession[0].Text, "test-prompt-2", "first prompt after history replaced")
+	assertString(actualsession[5].Text, "test-response-4", "last response after history replaced")
+
 	if err := session.Stash(testDir); err != nil {
 		t.Fatalf("expected no error stashing session. got %v", err)
 	}
 
-	if actualsession, err = session.Read(testDir); err != nil {
+	if actualsession, err = session.Read(testDir, ""); err != nil {
 		t.Fatalf("expected no error reading session. got %v", err)
 	}
 
@@ -77,7 +105,7 @@ func TestSession(t *testing.T) {
 		t.Fatalf("expected latest session to be active. got %+v", records)
 	}
 
-	if err := session.Restore(testDir, 1); err != nil {
+	if err := session.Restore(testDir, "1"); err != nil {
 		t.Fatalf("expected no error restoring session. got %v", err)
 	}
 
@@ -91,7 +119,7 @@ func TestSession(t *testing.T) {
 		t.Fatalf("expected restored session to be active. got %+v", records)
 	}
 
-	if err := session.Delete(testDir, 2); err != nil {
+	if err := session.Delete(testDir, "2"); err != nil {
 		t.Fatalf("expected no error deleting session. got %v", err)
 	}
 
@@ -115,3 +143,781 @@ func TestSession(t *testing.T) {
 
 	assertInt(len(records), 0, "record count")
 }
+
+func TestSessionReferences(t *testing.T) {
+	testDir := "./test-references"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	writeSession := func(prompt string, uris ...string) {
+		files := []llm.FileReference{}
+		for _, uri := range uris {
+			files = append(files, llm.FileReference{URI: uri, Expires: time.Now().Add(time.Hour * 24)})
+		}
+
+		if err := session.Write(testDir, "", session.Entry{Prompt: prompt, Response: "test-response", Files: files}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	writeSession("test-prompt-1", "test-uri-a", "test-uri-b")
+
+	if err := session.Stash(testDir); err != nil {
+		t.Fatalf("expected no error stashing session. got %v", err)
+	}
+
+	writeSession("test-prompt-2", "test-uri-b")
+
+	references, err := session.References(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error reading references. got %v", err)
+	}
+
+	if len(references) != 2 || !slices.Equal(references["test-uri-a"], []int{1}) || !slices.Equal(references["test-uri-b"], []int{1, 2}) {
+		t.Fatalf("expected references to be keyed by uri with the ids of each referencing session. got %v", references)
+	}
+
+	if err := session.Expire(testDir, []string{"test-uri-b"}); err != nil {
+		t.Fatalf("expected no error expiring references. got %v", err)
+	}
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	if expires := messages[0].Files[0].Expires; time.Until(expires) > 0 {
+		t.Fatalf("expected the reference to be expired. got expiry of %v", expires)
+	}
+
+	if err := session.Restore(testDir, "1"); err != nil {
+		t.Fatalf("expected no error restoring session. got %v", err)
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	if time.Until(messages[0].Files[0].Expires) <= 0 || time.Until(messages[0].Files[1].Expires) > 0 {
+		t.Fatalf("expected only the specified reference to be expired. got %+v", messages[0].Files)
+	}
+}
+
+func TestSessionIDs(t *testing.T) {
+	testDir := "./test-ids"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if err := os.MkdirAll(testDir+"/session", 0755); err != nil {
+		t.Fatalf("unable to create test directory. %v", err)
+	}
+
+	if err := os.WriteFile(testDir+"/session/1_1", []byte(`[{"role":"user","text":"test-legacy-prompt"}]`), 0600); err != nil {
+		t.Fatalf("unable to write legacy session file. %v", err)
+	}
+
+	writeSession := func(ref, prompt string) {
+		if err := session.Write(testDir, ref, session.Entry{Prompt: prompt, Response: "test-response"}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	writeSession("", "test-prompt-2")
+
+	if err := session.New(testDir, "test-name"); err != nil {
+		t.Fatalf("expected no error starting named session. got %v", err)
+	}
+
+	writeSession("", "test-prompt-3")
+
+	records, err := session.List(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error listing sessions. got %v", err)
+	}
+
+	if len(records) != 3 || records[0].ID != 1 || records[0].Summary != "test-legacy-prompt" || records[2].ID != 3 || records[2].Name != "test-name" || !records[2].Active {
+		t.Fatalf("expected the legacy session to be assigned the first id and the named session to be active. got %+v", records)
+	}
+
+	if err := session.Delete(testDir, "2"); err != nil {
+		t.Fatalf("expected no error deleting session. got %v", err)
+	}
+
+	if err := session.New(testDir, ""); err != nil {
+		t.Fatalf("expected no error starting session. got %v", err)
+	}
+
+	writeSession("", "test-prompt-4")
+	writeSession("test-name", "test-prompt-5")
+
+	if records, err = session.List(testDir); err != nil {
+		t.Fatalf("expected no error listing sessions. got %v", err)
+	}
+
+	if len(records) != 3 || records[1].ID != 3 || records[2].ID != 4 || !records[2].Active {
+		t.Fatalf("expected ids to be unchanged by deletion and not reused. got %+v", records)
+	}
+
+	messages, err := session.Read(testDir, "test-name")
+
+	if err != nil || len(messages) != 4 || messages[2].Text != "test-prompt-5" {
+		t.Fatalf("expected the named session to be written without becoming active. got %+v. %v", messages, err)
+	}
+
+	if err := session.CheckName(testDir, "test-name"); err == nil {
+		t.Fatalf("expected an error for a name already in use")
+	}
+
+	for _, name := range []string{"42", "-test", "test name", ""} {
+		if err := session.CheckName(testDir, name); err == nil {
+			t.Fatalf("expected an error for invalid name %q", name)
+		}
+	}
+
+	if err := session.Rename(testDir, "#1", "test-renamed"); err != nil {
+		t.Fatalf("expected no error renaming session. got %v", err)
+	}
+
+	if err := session.Restore(testDir, "test-renamed"); err != nil {
+		t.Fatalf("expected no error restoring session by name. got %v", err)
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil || len(messages) != 1 || messages[0].Text != "test-legacy-prompt" {
+		t.Fatalf("expected the renamed session to be active. got %+v. %v", messages, err)
+	}
+
+	if _, err := session.Find(testDir, "2"); err == nil {
+		t.Fatalf("expected an error finding a deleted session")
+	}
+}
+
+func TestSessionConcurrentWrites(t *testing.T) {
+	testDir := "./test-concurrent"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	const writers = 20
+
+	wg := sync.WaitGroup{}
+
+	for i := range writers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			messages, err := session.Read(testDir, "")
+
+			if err != nil {
+				t.Errorf("expected no error reading session. got %v", err)
+				return
+			}
+
+			if err := session.Write(testDir, "", session.Entry{Prompt: fmt.Sprintf("test-prompt-%v", i), Response: "test-response", History: messages, Read: len(messages)}); err != nil {
+				t.Errorf("expected no error writing session. got %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	if len(messages) != writers*2 {
+		t.Fatalf("expected every concurrent write to be retained. got %v messages", len(messages))
+	}
+
+	files, err := filepath.Glob(filepath.Join(testDir, "session", "*"+session.ActiveSessionFileSuffix))
+
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a single active session file. got %v (%v)", files, err)
+	}
+
+	for _, file := range append(files, filepath.Join(testDir, "session", ".id")) {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			t.Fatalf("expected no error reading file info. got %v", err)
+		}
+
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("expected %v to be written with a mode of 0600. got %v", file, info.Mode().Perm())
+		}
+	}
+
+	if err := os.Chmod(files[0], 0644); err != nil {
+		t.Fatalf("unable to change mode of session file. %v", err)
+	}
+
+	if err := session.Write(testDir, "", session.Entry{Prompt: "test-prompt", Response: "test-response"}); err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	info, err := os.Stat(files[0])
+
+	if err != nil {
+		t.Fatalf("expected no error reading file info. got %v", err)
+	}
+
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("expected a session file to retain its mode when rewritten. got %v", info.Mode().Perm())
+	}
+}
+
+func TestSessionRepair(t *testing.T) {
+	testDir := "./test-repair"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if err := os.MkdirAll(testDir+"/session", 0755); err != nil {
+		t.Fatalf("unable to create test directory. %v", err)
+	}
+
+	testFiles := map[string]string{
+		"1_1.active":  `{"id":1,"messages":[{"role":"user","text":"test-prompt-1"}]}`,
+		"2_2":         `{"id":1,"messages":[{"role":"user","text":"test-prompt-2"}]}`,
+		"3_3.active":  `{"id":3,"messages":[{"role":"user","text":"test-prompt-3"}]}`,
+		"4_4":         `{"id":4,"messages":[{"role":"user","te`,
+		".tmp-123456": `{"id":5}`,
+	}
+
+	for name, content := range testFiles {
+		if err := os.WriteFile(testDir+"/session/"+name, []byte(content), 0600); err != nil {
+			t.Fatalf("unable to write test session file. %v", err)
+		}
+	}
+
+	if err := os.Chtimes(testDir+"/session/1_1.active", time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("unable to age test session file. %v", err)
+	}
+
+	if _, err := session.Read(testDir, ""); !errors.Is(err, session.ErrRepairRequired) {
+		t.Fatalf("expected multiple active sessions to require repair. got %v", err)
+	}
+
+	changes, err := session.Repair(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error repairing sessions. got %v", err)
+	}
+
+	if len(changes) != 4 {
+		t.Fatalf("expected 4 changes to be made. got %v", changes)
+	}
+
+	records, err := session.List(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error listing repaired sessions. got %v", err)
+	}
+
+	if len(records) != 3 || records[0].ID != 1 || records[1].ID != 3 || !records[1].Active || records[2].ID != 4 || records[2].Summary != "test-prompt-2" {
+		t.Fatalf("expected duplicate ids to be reassigned and only the most recent active session to remain active. got %+v", records)
+	}
+
+	if _, err := os.Stat(testDir + "/session/corrupt/4_4"); err != nil {
+		t.Fatalf("expected corrupt session file to be moved. got %v", err)
+	}
+
+	if changes, err = session.Repair(testDir); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no further changes to be required. got %v. %v", changes, err)
+	}
+}
+
+func TestSessionArchive(t *testing.T) {
+	testDir := "./test-archive"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	for _, prompt := range []string{"test-prompt-1", "test-prompt-2"} {
+		if err := session.Write(testDir, "", session.Entry{Prompt: prompt, Response: "test-response"}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	err = session.Write(testDir, "", session.Entry{
+		Prompt:   "test-prompt-3",
+		Response: "test-response",
+		History:  messages[2:],
+		Read:     len(messages),
+		Archived: messages[:2],
+	})
+
+	if err != nil {
+		t.Fatalf("expected no error writing compacted session. got %v", err)
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	if len(messages) != 4 || messages[0].Text != "test-prompt-2" || messages[2].Text != "test-prompt-3" {
+		t.Fatalf("expected the archived messages to be removed from the session. got %+v", messages)
+	}
+
+	files, err := filepath.Glob(filepath.Join(testDir, "session", "*"+session.ActiveSessionFileSuffix))
+
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a single active session file. got %v (%v)", files, err)
+	}
+
+	data, err := os.ReadFile(files[0])
+
+	if err != nil {
+		t.Fatalf("expected no error reading session file. got %v", err)
+	}
+
+	doc := struct{ Archive []llm.Message }{}
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("expected no error decoding session file. got %v", err)
+	}
+
+	if len(doc.Archive) != 2 || doc.Archive[0].Text != "test-prompt-1" {
+		t.Fatalf("expected the archived messages to be retained in the session file. got %+v", doc.Archive)
+	}
+}
+
+func TestSessionExport(t *testing.T) {
+	testDir := "./test-export"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if _, err := session.Export(testDir, ""); err == nil {
+		t.Fatalf("expected an error exporting without an active session")
+	}
+
+	err := session.Write(testDir, "", session.Entry{
+		Prompt: "test-prompt-1",
+		Files:  []llm.FileReference{{Label: "test-file", MIMEType: "text/plain", URI: "test-uri"}},
+		Turns: []llm.Message{
+			{Role: llm.RoleModel, Text: "test-preamble", FunctionCalls: []llm.FunctionCall{{Name: "test-tool", Args: json.RawMessage(`{"id":1}`)}}},
+			{Role: llm.RoleUser, FunctionResponses: []llm.FunctionResponse{{Name: "test-tool", Response: json.RawMessage(`{"output":"test-output"}`)}}},
+		},
+		Response:  "test-response-1",
+		Grounding: &llm.Grounding{Sources: []llm.Source{{URI: "test-source-uri", Title: "test-source"}}},
+		Model:     "test-model",
+		Tokens:    10,
+	})
+
+	if err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	if err := session.Write(testDir, "", session.Entry{Prompt: "test-prompt-2", Response: "test-response-2"}); err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	transcript, err := session.Export(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error exporting session. got %v", err)
+	}
+
+	if transcript.ID != 1 || !transcript.Active || len(transcript.Turns) != 2 {
+		t.Fatalf("expected the active session to be exported with 2 turns. got %+v", transcript)
+	}
+
+	turn := transcript.Turns[0]
+
+	if turn.Prompt != "test-prompt-1" || turn.Response != "test-response-1" || turn.Model != "test-model" || turn.Tokens != 10 || turn.Time.IsZero() {
+		t.Fatalf("expected the prompt, final response and metadata to be exported. got %+v", turn)
+	}
+
+	if len(turn.Attachments) != 1 || turn.Attachments[0].Name != "test-file" || turn.Attachments[0].URI != "test-uri" {
+		t.Fatalf("expected the attachment to be exported. got %+v", turn.Attachments)
+	}
+
+	compact := func(data json.RawMessage) string { return strings.Join(strings.Fields(string(data)), "") } // session files are indented
+
+	if len(turn.ToolCalls) != 1 || compact(turn.ToolCalls[0].Args) != `{"id":1}` || compact(turn.ToolCalls[0].Response) != `{"output":"test-output"}` {
+		t.Fatalf("expected the tool call and its response to be exported together. got %+v", turn.ToolCalls)
+	}
+
+	if len(turn.Sources) != 1 || turn.Sources[0].URI != "test-source-uri" {
+		t.Fatalf("expected the grounding sources to be exported. got %+v", turn.Sources)
+	}
+
+	if err := session.New(testDir, "test-name"); err != nil {
+		t.Fatalf("expected no error starting new session. got %v", err)
+	}
+
+	transcripts, err := session.ExportAll(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error exporting all sessions. got %v", err)
+	}
+
+	if len(transcripts) != 2 || transcripts[0].ID != 1 || transcripts[1].Name != "test-name" || len(transcripts[1].Turns) != 0 {
+		t.Fatalf("expected both sessions to be exported in order of id. got %+v", transcripts)
+	}
+}
+
+func TestSessionImport(t *testing.T) {
+	testDir := "./test-import"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if err := session.Write(testDir, "", session.Entry{Prompt: "test-prompt", Response: "test-response"}); err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	transcripts := []session.Transcript{
+		{ID: 7, Name: "test-name", Turns: []session.Turn{{Prompt: "test-import-prompt", Response: "test-import-response", Model: "test-model"}}},
+		{ID: 8, Archived: []session.Turn{{Prompt: "test-archived-prompt", Response: "test-archived-response"}}, Turns: []session.Turn{{Prompt: "test-prompt-2", Response: "test-response-2"}}},
+	}
+
+	records, err := session.Import(testDir, transcripts)
+
+	if err != nil {
+		t.Fatalf("expected no error importing sessions. got %v", err)
+	}
+
+	if len(records) != 2 || records[0].ID != 2 || records[0].Name != "test-name" || records[1].ID != 3 {
+		t.Fatalf("expected imported sessions to be assigned new ids. got %+v", records)
+	}
+
+	if _, err := session.Import(testDir, transcripts[:1]); err == nil {
+		t.Fatalf("expected an error importing a session with a name already in use")
+	}
+
+	if _, err := session.Import(testDir, []session.Transcript{{}}); err == nil {
+		t.Fatalf("expected an error importing a transcript without turns")
+	}
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil || len(messages) != 2 || messages[0].Text != "test-prompt" {
+		t.Fatalf("expected the active session to be unchanged by the import. got %+v (%v)", messages, err)
+	}
+
+	if messages, err = session.Read(testDir, "test-name"); err != nil {
+		t.Fatalf("expected no error reading imported session. got %v", err)
+	}
+
+	if len(messages) != 2 || messages[0].Role != llm.RoleUser || messages[0].Text != "test-import-prompt" || messages[1].Role != llm.RoleModel || messages[1].Model != "test-model" {
+		t.Fatalf("expected the imported turn to be a prompt and response. got %+v", messages)
+	}
+
+	exported, err := session.Export(testDir, "3")
+
+	if err != nil {
+		t.Fatalf("expected no error exporting imported session. got %v", err)
+	}
+
+	if exported.Active || len(exported.Archived) != 1 || len(exported.Turns) != 1 || exported.Turns[0].Prompt != "test-prompt-2" {
+		t.Fatalf("expected the imported session to be stashed with its archive. got %+v", exported)
+	}
+}
+
+func TestSessionFork(t *testing.T) {
+	testDir := "./test-fork"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if _, err := session.Fork(testDir, "", 0, ""); err == nil {
+		t.Fatalf("expected an error forking without an active session")
+	}
+
+	for _, prompt := range []string{"test-prompt-1", "test-prompt-2", "test-prompt-3"} {
+		if err := session.Write(testDir, "", session.Entry{Prompt: prompt, Response: "test-response"}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	record, err := session.Fork(testDir, "", 0, "test-fork")
+
+	if err != nil {
+		t.Fatalf("expected no error forking session. got %v", err)
+	}
+
+	if record.ID != 2 || record.Parent != 1 || record.Name != "test-fork" || !record.Active {
+		t.Fatalf("expected the fork to be the active child of the session. got %+v", record)
+	}
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil || len(messages) != 6 {
+		t.Fatalf("expected the active session to be a full copy. got %v messages (%v)", len(messages), err)
+	}
+
+	if _, err := session.Fork(testDir, "1", 4, ""); err == nil {
+		t.Fatalf("expected an error forking at a turn beyond the end of the session")
+	}
+
+	if record, err = session.Fork(testDir, "1", 2, ""); err != nil {
+		t.Fatalf("expected no error forking session at a turn. got %v", err)
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil || len(messages) != 4 || messages[2].Text != "test-prompt-2" {
+		t.Fatalf("expected the fork to be truncated after the second turn. got %+v (%v)", messages, err)
+	}
+
+	if err := session.Write(testDir, "", session.Entry{Prompt: "test-prompt-fork", Response: "test-response"}); err != nil {
+		t.Fatalf("expected no error writing forked session. got %v", err)
+	}
+
+	if messages, err = session.Read(testDir, "1"); err != nil || len(messages) != 6 || messages[4].Text != "test-prompt-3" {
+		t.Fatalf("expected the parent to be unchanged by writes to the fork. got %+v (%v)", messages, err)
+	}
+
+	records, err := session.List(testDir)
+
+	if err != nil {
+		t.Fatalf("expected no error listing sessions. got %v", err)
+	}
+
+	if len(records) != 3 || records[0].Parent != 0 || records[1].Parent != 1 || records[2].Parent != 1 || !records[2].Active {
+		t.Fatalf("expected both forks to be listed as children of the first session. got %+v", records)
+	}
+
+	if err := session.New(testDir, "test-compacted"); err != nil {
+		t.Fatalf("expected no error starting new session. got %v", err)
+	}
+
+	for _, prompt := range []string{"test-compacted-prompt-1", "test-compacted-prompt-2", "test-compacted-prompt-3"} {
+		if err := session.Write(testDir, "", session.Entry{Prompt: prompt, Response: "test-response"}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	err = session.Write(testDir, "", session.Entry{ // the first two turns are archived and replaced by a summary
+		Prompt:   "test-compacted-prompt-4",
+		Response: "test-response",
+		History:  append([]llm.Message{{Role: llm.RoleUser, Text: "test-summary"}, {Role: llm.RoleModel, Text: "test-acknowledge"}}, messages[4:]...),
+		Read:     len(messages),
+		Archived: messages[:4],
+	})
+
+	if err != nil {
+		t.Fatalf("expected no error writing compacted session. got %v", err)
+	}
+
+	matches, err := session.Search(testDir, session.Query{Pattern: regexp.MustCompile("test-compacted-prompt-3")})
+
+	if err != nil || len(matches) != 1 || matches[0].Turn != 4 {
+		t.Fatalf("expected the third prompt to be found in the fourth turn, after the archived turns and the summary. got %+v (%v)", matches, err)
+	}
+
+	if _, err := session.Fork(testDir, "test-compacted", 6, ""); err == nil {
+		t.Fatalf("expected an error forking at a turn beyond the end of a compacted session")
+	}
+
+	for _, test := range []struct {
+		turn             int
+		expectedTurns    int
+		expectedArchived int
+		expectedPrompt   string
+	}{
+		{turn: matches[0].Turn, expectedTurns: 2, expectedArchived: 2, expectedPrompt: "test-compacted-prompt-3"},
+		{turn: 1, expectedTurns: 1, expectedArchived: 0, expectedPrompt: "test-compacted-prompt-1"},
+	} {
+		if _, err := session.Fork(testDir, "test-compacted", test.turn, ""); err != nil {
+			t.Fatalf("expected no error forking compacted session at turn %v. got %v", test.turn, err)
+		}
+
+		fork, err := session.Export(testDir, "")
+
+		if err != nil {
+			t.Fatalf("expected no error exporting fork. got %v", err)
+		}
+
+		if len(fork.Turns) != test.expectedTurns || len(fork.Archived) != test.expectedArchived {
+			t.Fatalf("expected a fork at turn %v to have %v turns and %v archived turns. got %+v", test.turn, test.expectedTurns, test.expectedArchived, fork)
+		}
+
+		if last := fork.Turns[len(fork.Turns)-1]; last.Prompt != test.expectedPrompt {
+			t.Fatalf("expected the last turn of a fork at turn %v to be %v. got %v", test.turn, test.expectedPrompt, last.Prompt)
+		}
+	}
+}
+
+func TestSessionUndo(t *testing.T) {
+	testDir := "./test-undo"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	if _, err := session.Undo(testDir, ""); err == nil {
+		t.Fatalf("expected an error undoing a turn of an empty session")
+	}
+
+	err := session.Write(testDir, "", session.Entry{Prompt: "test-prompt-1", Response: "test-response-1"})
+
+	if err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	err = session.Write(testDir, "", session.Entry{
+		Prompt: "test-prompt-2",
+		Files:  []llm.FileReference{{Label: "test-file", Path: "test-path"}},
+		Turns: []llm.Message{
+			{Role: llm.RoleModel, FunctionCalls: []llm.FunctionCall{{Name: "test-tool"}}},
+			{Role: llm.RoleUser, FunctionResponses: []llm.FunctionResponse{{Name: "test-tool", Response: json.RawMessage(`{}`)}}},
+		},
+		Response: "test-response-2",
+	})
+
+	if err != nil {
+		t.Fatalf("expected no error writing session. got %v", err)
+	}
+
+	messages, err := session.Read(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error reading session. got %v", err)
+	}
+
+	if i := session.LastTurn(messages); i != 2 {
+		t.Fatalf("expected the last turn to begin at its prompt, rather than a function response. got %v", i)
+	}
+
+	if i := session.LastTurn(nil); i != -1 {
+		t.Fatalf("expected no last turn without messages. got %v", i)
+	}
+
+	prompt, err := session.Undo(testDir, "")
+
+	if err != nil {
+		t.Fatalf("expected no error undoing turn. got %v", err)
+	}
+
+	if prompt.Text != "test-prompt-2" || len(prompt.Files) != 1 || prompt.Files[0].Path != "test-path" {
+		t.Fatalf("expected the removed prompt to be returned with its files. got %+v", prompt)
+	}
+
+	if messages, err = session.Read(testDir, ""); err != nil || len(messages) != 2 || messages[1].Text != "test-response-1" {
+		t.Fatalf("expected only the first turn to remain. got %+v (%v)", messages, err)
+	}
+}
+
+func TestSessionSearch(t *testing.T) {
+	testDir := "./test-search"
+	os.RemoveAll(testDir)
+
+	defer os.RemoveAll(testDir)
+
+	write := func(prompt, response, model string) {
+		if err := session.Write(testDir, "", session.Entry{Prompt: prompt, Response: response, Model: model}); err != nil {
+			t.Fatalf("expected no error writing session. got %v", err)
+		}
+	}
+
+	write("how do i configure the k8s ingress?", "line-1\nline-2\nuse an Ingress resource\nline-4\nline-5", "test-model-pro")
+	write("test-prompt", "test-response", "test-model-pro")
+
+	if err := session.New(testDir, "test-name"); err != nil {
+		t.Fatalf("expected no error starting new session. got %v", err)
+	}
+
+	write("what is an ingress controller?", "test-response", "test-model-flash")
+
+	search := func(query session.Query) []session.Match {
+		matches, err := session.Search(testDir, query)
+
+		if err != nil {
+			t.Fatalf("expected no error searching sessions. got %v", err)
+		}
+
+		return matches
+	}
+
+	matches := search(session.Query{Pattern: regexp.MustCompile("(?i)ingress"), Context: 1})
+
+	if len(matches) != 2 || matches[0].ID != 1 || matches[0].Turn != 1 || matches[1].ID != 2 || matches[1].Name != "test-name" {
+		t.Fatalf("expected a match in the first turn of each session. got %+v", matches)
+	}
+
+	if !slices.Equal(matches[0].Response, []string{"line-2", "use an Ingress resource", "line-4"}) || matches[0].Model != "test-model-pro" {
+		t.Fatalf("expected the matching line of the response with a line of context. got %+v", matches[0])
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("ingress"), Model: "flash"}); len(matches) != 1 || matches[0].ID != 2 {
+		t.Fatalf("expected only the turn of the matching model to match. got %+v", matches)
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("ingress"), To: time.Now().Add(-time.Hour)}); len(matches) != 0 {
+		t.Fatalf("expected no turns before the end date to match. got %+v", matches)
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("ingress"), From: time.Now().Add(-time.Hour)}); len(matches) != 2 {
+		t.Fatalf("expected all turns after the start date to match. got %+v", matches)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(testDir, "session", ".index")); err != nil || bytes.Contains(data, []byte("ingress")) {
+		t.Fatalf("expected the search index to be written without the text of the turns. got %s (%v)", data, err)
+	}
+
+	write("test-prompt", "a new ingress response", "test-model-flash")
+
+	if err := session.Delete(testDir, "1"); err != nil {
+		t.Fatalf("expected no error deleting session. got %v", err)
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("ingress")}); len(matches) != 2 || matches[0].ID != 2 || matches[1].Turn != 2 {
+		t.Fatalf("expected the index to reflect the changed and deleted sessions. got %+v", matches)
+	}
+
+	active, _ := filepath.Glob(filepath.Join(testDir, "session", "*"+session.ActiveSessionFileSuffix))
+
+	if len(active) != 1 {
+		t.Fatalf("expected one active session file. got %v", active)
+	}
+
+	info, err := os.Stat(active[0])
+
+	if err != nil {
+		t.Fatalf("expected no error reading active session file info. got %v", err)
+	}
+
+	data, err := os.ReadFile(active[0])
+
+	if err != nil {
+		t.Fatalf("expected no error reading active session file. got %v", err)
+	}
+
+	if err := os.WriteFile(active[0], bytes.Replace(data, []byte("a new ingress response"), []byte("a new INGRESS response"), 1), 0600); err != nil {
+		t.Fatalf("expected no error writing active session file. got %v", err)
+	}
+
+	if err := os.Chtimes(active[0], info.ModTime(), info.ModTime()); err != nil { // the change is not detected by size or timestamp
+		t.Fatalf("expected no error setting active session file timestamp. got %v", err)
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("INGRESS")}); len(matches) != 1 || matches[0].Turn != 2 {
+		t.Fatalf("expected the stale session to be indexed again and matched. got %+v", matches)
+	}
+
+	if matches = search(session.Query{Pattern: regexp.MustCompile("ingress")}); len(matches) != 1 || matches[0].Turn != 1 {
+		t.Fatalf("expected the session to be searched with its new index entry. got %+v", matches)
+	}
+
+	if _, err := session.Search(testDir, session.Query{}); err == nil {
+		t.Fatalf("expected an error searching without a pattern")
+	}
+}
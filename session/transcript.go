@@ -0,0 +1,249 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+type (
+	// Transcript is a normalised representation of a session, in which its messages are grouped into turns, each being a prompt and
+	// the response to it, for presentation outside of gen
+	Transcript struct {
+		ID       int       `json:"id"`
+		Name     string    `json:"name,omitempty"`
+		Active   bool      `json:"active"`
+		Parent   int       `json:"parent,omitempty"` // the id of the session from which this session was forked, if any
+		Updated  time.Time `json:"updated"`
+		Turns    []Turn    `json:"turns"`
+		Archived []Turn    `json:"archived,omitempty"` // turns removed from the history of the session by compaction
+	}
+	// Turn is a prompt, any tool calls made in response to it, and the final response
+	Turn struct {
+		Prompt      string       `json:"prompt"`
+		Attachments []Attachment `json:"attachments,omitempty"`
+		ToolCalls   []ToolCall   `json:"toolCalls,omitempty"`
+		Response    string       `json:"response"`
+		Sources     []llm.Source `json:"sources,omitempty"`
+		Model       string       `json:"model,omitempty"`
+		Tokens      int          `json:"tokens,omitempty"`
+		Time        time.Time    `json:"time,omitzero"`
+	}
+	// Attachment describes a file attached to a prompt
+	Attachment struct {
+		Name     string `json:"name"`
+		MIMEType string `json:"mimeType"`
+		Path     string `json:"path,omitempty"`
+		URI      string `json:"uri,omitempty"`
+	}
+	// ToolCall is a call to a tool made by the model and the result returned to it
+	ToolCall struct {
+		Name     string          `json:"name"`
+		Args     json.RawMessage `json:"args,omitempty"`
+		Response json.RawMessage `json:"response,omitempty"`
+	}
+)
+
+// Export returns the transcript of the session with the specified id or name or, if none is specified, the active session
+func Export(appDir, ref string) (Transcript, error) {
+	return locked(appDir, func(sessionDir string) (Transcript, error) {
+		if ref == "" {
+			records, err := list(sessionDir)
+
+			if err != nil {
+				return Transcript{}, err
+			}
+
+			i := slices.IndexFunc(records, func(r Record) bool { return r.Active })
+
+			if i == -1 {
+				return Transcript{}, fmt.Errorf("invalid session. there is no active session to export")
+			}
+
+			return transcript(sessionDir, records[i])
+		}
+
+		record, err := find(sessionDir, ref)
+
+		if err != nil {
+			return Transcript{}, err
+		}
+
+		return transcript(sessionDir, record)
+	})
+}
+
+// ExportAll returns the transcripts of all sessions, ordered by id
+func ExportAll(appDir string) ([]Transcript, error) {
+	return locked(appDir, func(sessionDir string) ([]Transcript, error) {
+		records, err := list(sessionDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transcripts := make([]Transcript, 0, len(records))
+
+		for _, record := range records {
+			t, err := transcript(sessionDir, record)
+
+			if err != nil {
+				return nil, err
+			}
+
+			transcripts = append(transcripts, t)
+		}
+
+		return transcripts, nil
+	})
+}
+
+func transcript(sessionDir string, record Record) (Transcript, error) {
+	doc, err := readSessionFile(path.Join(sessionDir, record.file))
+
+	if err != nil {
+		return Transcript{}, err
+	}
+
+	return Transcript{
+		ID:       record.ID,
+		Name:     record.Name,
+		Active:   record.Active,
+		Parent:   record.Parent,
+		Updated:  record.TimeStamp,
+		Turns:    turns(doc.Messages),
+		Archived: turns(doc.Archive),
+	}, nil
+}
+
+// turns groups the specified messages into turns. each turn begins with a prompt from the user, with the model messages that follow it
+// providing the tool calls and response of the turn
+func turns(messages []llm.Message) []Turn {
+	turns := []Turn{}
+
+	for _, message := range messages {
+		if len(turns) == 0 || startsTurn(message) {
+			turns = append(turns, Turn{})
+		}
+
+		turn := &turns[len(turns)-1]
+
+		switch {
+		case len(message.FunctionResponses) > 0:
+			for _, functionResponse := range message.FunctionResponses {
+				i := slices.IndexFunc(turn.ToolCalls, func(c ToolCall) bool { return c.Name == functionResponse.Name && c.Response == nil })
+
+				if i == -1 {
+					turn.ToolCalls, i = append(turn.ToolCalls, ToolCall{Name: functionResponse.Name}), len(turn.ToolCalls)
+				}
+
+				turn.ToolCalls[i].Response = functionResponse.Response
+			}
+		case message.Role == llm.RoleUser:
+			turn.Prompt, turn.Time = message.Text, message.Time
+
+			for _, file := range message.Files {
+				turn.Attachments = append(turn.Attachments, Attachment{Name: file.Label, MIMEType: file.MIMEType, Path: file.Path, URI: file.URI})
+			}
+		default:
+			for _, functionCall := range message.FunctionCalls {
+				turn.ToolCalls = append(turn.ToolCalls, ToolCall{Name: functionCall.Name, Args: functionCall.Args})
+			}
+
+			if len(message.FunctionCalls) == 0 { // text accompanying function calls is not part of the final response
+				turn.Response, turn.Model, turn.Tokens = message.Text, message.Model, message.Tokens
+
+				if message.Grounding != nil {
+					turn.Sources = message.Grounding.Sources
+				}
+			}
+		}
+	}
+
+	return turns
+}
+
+// Import creates a stashed session from each of the specified transcripts and returns their records. Only the prompts and responses of
+// each turn, and their metadata, are imported, as the content of attached files and the tools that were called are not available. The
+// names of the transcripts are retained, so all must be valid and not already in use
+func Import(appDir string, transcripts []Transcript) ([]Record, error) {
+	return locked(appDir, func(sessionDir string) ([]Record, error) {
+		names := map[string]bool{}
+
+		for _, t := range transcripts {
+			if len(t.Turns) == 0 && len(t.Archived) == 0 {
+				return nil, fmt.Errorf("invalid transcript. a transcript with no turns cannot be imported")
+			}
+
+			if t.Name == "" {
+				continue
+			}
+
+			if err := checkName(sessionDir, t.Name); err != nil {
+				return nil, err
+			}
+
+			if names[t.Name] {
+				return nil, fmt.Errorf("invalid session name '%v'. more than one transcript has that name", t.Name)
+			}
+
+			names[t.Name] = true
+		}
+
+		records := make([]Record, 0, len(transcripts))
+
+		for _, t := range transcripts {
+			existing, err := list(sessionDir)
+
+			if err != nil {
+				return nil, err
+			}
+
+			id, err := nextID(sessionDir, existing)
+
+			if err != nil {
+				return nil, err
+			}
+
+			sessionFile := newSessionFileName()
+
+			if err := writeSessionFile(path.Join(sessionDir, sessionFile), document{ID: id, Name: t.Name, Messages: messages(t.Turns), Archive: messages(t.Archived)}); err != nil {
+				return nil, err
+			}
+
+			records = append(records, Record{ID: id, Name: t.Name, file: sessionFile})
+		}
+
+		return records, nil
+	})
+}
+
+// startsTurn reports whether the specified message begins a turn, being a prompt from the user, rather than the result of a tool call
+func startsTurn(message llm.Message) bool {
+	return message.Role == llm.RoleUser && len(message.FunctionResponses) == 0
+}
+
+// messages returns the prompt and response of each of the specified turns as a pair of messages, being the inverse of turns, other than
+// for any attachments and tool calls, which are omitted
+func messages(turns []Turn) []llm.Message {
+	messages := make([]llm.Message, 0, len(turns)*2)
+
+	for _, turn := range turns {
+		var grounding *llm.Grounding
+
+		if len(turn.Sources) > 0 {
+			grounding = &llm.Grounding{Sources: turn.Sources}
+		}
+
+		messages = append(messages,
+			llm.Message{Role: llm.RoleUser, Text: turn.Prompt, Time: turn.Time},
+			llm.Message{Role: llm.RoleModel, Text: turn.Response, Grounding: grounding, Model: turn.Model, Tokens: turn.Tokens, Time: turn.Time},
+		)
+	}
+
+	return messages
+}
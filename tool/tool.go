@@ -0,0 +1,157 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/comradequinn/gen/llm"
+)
+
+type (
+	// Declaration describes a tool, and the command that implements it, in the form it is defined in a json file
+	Declaration struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters,omitempty"`
+		Command     []string        `json:"command,omitempty"`
+	}
+)
+
+const (
+	DescribeArg = "--describe"
+)
+
+// Load returns the tools declared in the specified json files and those provided by the executables found in
+// the specified tool path. The tool path is a list of directories in the same form as $PATH.
+//
+// A json declaration must specify the command that implements the tool. Executables in the tool path must
+// describe themselves by writing their json declaration to stdout when invoked with the --describe argument.
+//
+// In either case, when the tool is called, the arguments supplied by the llm are written to the command's stdin
+// as a json object and its stdout is returned as the result. The command is killed if the context is done before it exits
+func Load(files []string, toolPath string) ([]llm.Tool, error) {
+	tools := []llm.Tool{}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tool declaration file '%v'. %w", file, err)
+		}
+
+		declaration := Declaration{}
+
+		if err := json.Unmarshal(data, &declaration); err != nil {
+			return nil, fmt.Errorf("unable to parse tool declaration file '%v'. %w", file, err)
+		}
+
+		if len(declaration.Command) == 0 {
+			return nil, fmt.Errorf("invalid tool declaration file '%v'. no command specified", file)
+		}
+
+		if strings.ContainsRune(declaration.Command[0], os.PathSeparator) && !filepath.IsAbs(declaration.Command[0]) {
+			declaration.Command[0] = filepath.Join(filepath.Dir(file), declaration.Command[0]) // relative commands are resolved from the location of the declaration
+		}
+
+		tool, err := build(declaration)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool declaration file '%v'. %w", file, err)
+		}
+
+		tools = append(tools, tool)
+	}
+
+	for _, dir := range filepath.SplitList(toolPath) {
+		if dir == "" {
+			continue
+		}
+
+		entries, err := os.ReadDir(dir)
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tool path directory '%v'. %w", dir, err)
+		}
+
+		for _, entry := range entries {
+			info, err := entry.Info()
+
+			if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+				continue
+			}
+
+			executable := filepath.Join(dir, entry.Name())
+
+			output, err := exec.Command(executable, DescribeArg).Output()
+
+			if err != nil {
+				return nil, fmt.Errorf("unable to describe tool '%v'. %w", executable, err)
+			}
+
+			declaration := Declaration{}
+
+			if err := json.Unmarshal(output, &declaration); err != nil {
+				return nil, fmt.Errorf("unable to parse description of tool '%v'. %w", executable, err)
+			}
+
+			declaration.Command = []string{executable}
+
+			tool, err := build(declaration)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid description of tool '%v'. %w", executable, err)
+			}
+
+			tools = append(tools, tool)
+		}
+	}
+
+	names := map[string]bool{}
+
+	for _, tool := range tools {
+		if names[tool.Name] {
+			return nil, fmt.Errorf("duplicate tool name '%v'", tool.Name)
+		}
+		names[tool.Name] = true
+	}
+
+	return tools, nil
+}
+
+func build(declaration Declaration) (llm.Tool, error) {
+	if declaration.Name == "" {
+		return llm.Tool{}, fmt.Errorf("no tool name specified")
+	}
+
+	command := declaration.Command
+
+	return llm.Tool{
+		Name:        declaration.Name,
+		Description: declaration.Description,
+		Parameters:  declaration.Parameters,
+		Call: func(ctx context.Context, args json.RawMessage) (json.RawMessage, error) {
+			if len(args) == 0 {
+				args = json.RawMessage("{}")
+			}
+
+			stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+
+			cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+			cmd.Stdin = bytes.NewReader(args)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+
+			if err := cmd.Run(); err != nil {
+				return nil, fmt.Errorf("tool '%v' failed. %v. %v", declaration.Name, err, strings.TrimSpace(stderr.String()))
+			}
+
+			return stdout.Bytes(), nil
+		},
+	}, nil
+}
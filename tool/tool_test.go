@@ -0,0 +1,66 @@
+package tool_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/comradequinn/gen/tool"
+)
+
+func TestLoad(t *testing.T) {
+	testDir := t.TempDir()
+	toolDir := filepath.Join(testDir, "tools")
+
+	if err := os.MkdirAll(toolDir, 0755); err != nil {
+		t.Fatalf("expected no error creating tool directory. got %v", err)
+	}
+
+	writeFile := func(name, content string, perm os.FileMode) string {
+		if err := os.WriteFile(name, []byte(content), perm); err != nil {
+			t.Fatalf("expected no error writing %v. got %v", name, err)
+		}
+		return name
+	}
+
+	declarationFile := writeFile(filepath.Join(testDir, "echo.json"), `{"name":"echo","description":"echoes its arguments","command":["sh","-c","cat"]}`, 0644)
+
+	writeFile(filepath.Join(toolDir, "greet"), `#!/bin/sh
+if [ "$1" = "--describe" ]; then
+	echo '{"name":"greet","description":"greets the user","parameters":{"type":"object","properties":{"name":{"type":"string"}}}}'
+	exit 0
+fi
+echo "hello"
+`, 0755)
+	writeFile(filepath.Join(toolDir, "README"), "not a tool", 0644)
+
+	assert := func(t *testing.T, condition bool, format string, v ...any) {
+		if !condition {
+			t.Fatalf(format, v...)
+		}
+	}
+
+	tools, err := tool.Load([]string{declarationFile}, toolDir)
+
+	assert(t, err == nil, "expected no error loading tools. got %v", err)
+	assert(t, len(tools) == 2, "expected 2 tools. got %v", len(tools))
+	assert(t, tools[0].Name == "echo", "expected first tool to be echo. got %v", tools[0].Name)
+	assert(t, tools[1].Name == "greet", "expected second tool to be greet. got %v", tools[1].Name)
+	assert(t, json.Valid(tools[1].Parameters), "expected greet parameters to be valid json. got %s", tools[1].Parameters)
+
+	result, err := tools[0].Call(context.Background(), json.RawMessage(`{"value":1}`))
+
+	assert(t, err == nil, "expected no error calling echo tool. got %v", err)
+	assert(t, string(result) == `{"value":1}`, "expected echo tool to return its arguments. got %s", result)
+
+	result, err = tools[1].Call(context.Background(), nil)
+
+	assert(t, err == nil, "expected no error calling greet tool. got %v", err)
+	assert(t, string(result) == "hello\n", "expected greet tool to return hello. got %q", result)
+
+	_, err = tool.Load([]string{declarationFile, declarationFile}, "")
+
+	assert(t, err != nil, "expected an error loading duplicate tools")
+}
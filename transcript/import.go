@@ -0,0 +1,389 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/llm"
+	"github.com/comradequinn/gen/session"
+)
+
+type (
+	// message is a single prompt or response read from a transcript that is not already grouped into turns
+	message struct {
+		role string
+		text string
+		meta session.Turn // the time, model and tokens of the turn, for a prompt, or its sources, for a response, where read from an export
+	}
+	// markdownSession is a session read from a markdown transcript, the messages of which are not yet grouped into turns
+	markdownSession struct {
+		name     string
+		archived []message
+		current  []message
+	}
+	// openAIMessage is an entry of an openai-style messages array. its content is either a string or an array of content parts
+	openAIMessage struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+)
+
+const (
+	// FormatOpenAI is an openai-style messages array, either alone or as the messages of a request body. It can be read, but not written
+	FormatOpenAI = "openai"
+)
+
+const systemAcknowledge = "Understood. I will follow those instructions for the rest of our conversation."
+
+// ImportFormats lists the formats from which transcripts can be read
+var ImportFormats = []string{FormatJSON, FormatMarkdown, FormatOpenAI}
+
+var (
+	// markdownRole matches a line that begins a message of a markdown transcript, such as 'User:' or '**Model:**', capturing the role and
+	// any text that follows it on the same line
+	markdownRole = regexp.MustCompile(`^\s*(?:\*\*)?(User|Model|Assistant)(?::\*\*|\*\*:|:)\s*(.*)$`)
+	// markdownHeading matches the heading of a session in a markdown export, capturing its name, if any
+	markdownHeading = regexp.MustCompile(`^# Session #\d+(?: (.+))?$`)
+	// markdownTurn matches the heading of a turn in a markdown export
+	markdownTurn = regexp.MustCompile(`^### Turn \d+$`)
+	// markdownMetadata matches the description of a turn that follows its heading in a markdown export, capturing the description
+	markdownMetadata = regexp.MustCompile(`^_(.+)_$`)
+	// markdownSource matches a source listed after a response in a markdown export, capturing its title and uri
+	markdownSource = regexp.MustCompile(`^- \[(.*)\]\((.*)\)$`)
+)
+
+// Read returns the transcripts read from r in the specified format, being one of ImportFormats. When no format is specified, it is
+// determined from the content; a json object with a 'sessions' field is a json Document, a json array or object with a 'messages' field
+// is an openai-style messages array and anything else is markdown
+func Read(r io.Reader, format string) ([]session.Transcript, error) {
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read transcript. %w", err)
+	}
+
+	data = bytes.TrimSpace(data)
+
+	if format == "" {
+		format = detect(data)
+	}
+
+	switch format {
+	case FormatJSON:
+		doc := Document{}
+
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse json transcript. %w", err)
+		}
+
+		if len(doc.Sessions) == 0 {
+			return nil, fmt.Errorf("invalid json transcript. no sessions were found")
+		}
+
+		return doc.Sessions, nil
+	case FormatMarkdown, "markdown":
+		return readMarkdown(data)
+	case FormatOpenAI:
+		return readOpenAI(data)
+	default:
+		return nil, fmt.Errorf("invalid import format '%v'. expected one of %v", format, strings.Join(ImportFormats, ", "))
+	}
+}
+
+// detect returns the format of the specified transcript, as determined from its content
+func detect(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		return FormatOpenAI
+	case bytes.HasPrefix(data, []byte("{")):
+		fields := map[string]json.RawMessage{}
+
+		if json.Unmarshal(data, &fields) == nil && fields["messages"] != nil && fields["sessions"] == nil {
+			return FormatOpenAI
+		}
+
+		return FormatJSON
+	default:
+		return FormatMarkdown
+	}
+}
+
+// readMarkdown reads a transcript in which each message begins with a line starting 'User:' or 'Model:', optionally in bold, and continues
+// until the next. 'Assistant:' may be used in place of 'Model:'. Any text before the first message is ignored. A markdown export written
+// by gen is read as one transcript per session, with the headings, descriptions and lists it adds to each turn read as its metadata
+func readMarkdown(data []byte) ([]session.Transcript, error) {
+	sessions := []markdownSession{{}}
+	export, archived, describe, list := false, false, false, ""
+	meta := session.Turn{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+
+	messages := func() *[]message {
+		if archived {
+			return &sessions[len(sessions)-1].archived
+		}
+		return &sessions[len(sessions)-1].current
+	}
+
+	last := func() *message {
+		if m := messages(); len(*m) > 0 {
+			return &(*m)[len(*m)-1]
+		}
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if match := markdownHeading.FindStringSubmatch(line); match != nil {
+			if m := last(); m != nil { // sessions are separated by a horizontal rule, which is not part of the last response
+				m.text = strings.TrimSuffix(strings.TrimSpace(m.text), "---")
+			}
+
+			sessions = append(sessions, markdownSession{name: match[1]})
+			export, archived, describe, list = true, false, false, ""
+			continue
+		}
+
+		if export {
+			switch {
+			case line == "## Archived":
+				archived = true
+				continue
+			case line == "## Current":
+				archived = false
+				continue
+			case line == markdownArchivedNote:
+				continue
+			case markdownTurn.MatchString(line):
+				describe, list, meta = true, "", session.Turn{}
+				continue
+			case describe && strings.TrimSpace(line) == "":
+				continue
+			case describe && markdownMetadata.MatchString(line):
+				describe, meta = false, metadataOf(markdownMetadata.FindStringSubmatch(line)[1])
+				continue
+			case line == "Attachments:", line == "Tool calls:", line == "Sources:":
+				list = line
+				continue
+			case list != "" && (strings.TrimSpace(line) == "" || strings.HasPrefix(line, "- ")):
+				if match := markdownSource.FindStringSubmatch(line); match != nil && list == "Sources:" {
+					if m := last(); m != nil {
+						m.meta.Sources = append(m.meta.Sources, llm.Source{Title: match[1], URI: match[2]})
+					}
+				}
+				continue
+			}
+
+			describe, list = false, ""
+		}
+
+		if match := markdownRole.FindStringSubmatch(line); match != nil {
+			m := message{role: llm.RoleUser, text: match[2], meta: meta}
+
+			if match[1] != "User" {
+				m = message{role: llm.RoleModel, text: match[2]}
+			}
+
+			*messages() = append(*messages(), m)
+			continue
+		}
+
+		if m := last(); m != nil {
+			m.text += "\n" + line
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read markdown transcript. %w", err)
+	}
+
+	transcripts := []session.Transcript{}
+
+	for _, s := range sessions {
+		if len(s.archived) == 0 && len(s.current) == 0 {
+			continue
+		}
+
+		t, err := session.Transcript{Name: s.name}, error(nil)
+
+		if len(s.archived) > 0 {
+			if t.Archived, err = pair(s.archived); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(s.current) > 0 {
+			if t.Turns, err = pair(s.current); err != nil {
+				return nil, err
+			}
+		}
+
+		transcripts = append(transcripts, t)
+	}
+
+	if len(transcripts) == 0 {
+		return nil, fmt.Errorf("invalid markdown transcript. no lines beginning 'User:' or 'Model:' were found")
+	}
+
+	return transcripts, nil
+}
+
+// metadataOf returns the time, model and tokens of a turn from the description written after its heading in a markdown export
+func metadataOf(description string) session.Turn {
+	turn := session.Turn{}
+
+	for detail := range strings.SplitSeq(description, ", ") {
+		if t, err := time.ParseInLocation(time.DateTime, detail, time.Local); err == nil {
+			turn.Time = t
+			continue
+		}
+
+		if tokens, found := strings.CutSuffix(detail, " tokens"); found {
+			if n, err := strconv.Atoi(tokens); err == nil {
+				turn.Tokens = n
+				continue
+			}
+		}
+
+		turn.Model = detail
+	}
+
+	return turn
+}
+
+// readOpenAI reads an openai-style messages array. system messages are imported as a prompt, acknowledged by the model, as sessions do not
+// hold a system prompt
+func readOpenAI(data []byte) ([]session.Transcript, error) {
+	if bytes.HasPrefix(data, []byte("{")) {
+		body := struct {
+			Messages json.RawMessage `json:"messages"`
+		}{}
+
+		if err := json.Unmarshal(data, &body); err != nil {
+			return nil, fmt.Errorf("unable to parse openai messages. %w", err)
+		}
+
+		data = body.Messages
+	}
+
+	entries := []openAIMessage{}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse openai messages. %w", err)
+	}
+
+	messages := []message{}
+
+	for i, entry := range entries {
+		text, err := openAIText(entry.Content)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid openai message %v. %w", i+1, err)
+		}
+
+		switch entry.Role {
+		case "system", "developer":
+			messages = append(messages, message{role: llm.RoleUser, text: text}, message{role: llm.RoleModel, text: systemAcknowledge})
+		case "user":
+			messages = append(messages, message{role: llm.RoleUser, text: text})
+		case "assistant":
+			messages = append(messages, message{role: llm.RoleModel, text: text})
+		default:
+			return nil, fmt.Errorf("invalid openai message %v. unsupported role '%v'. expected 'system', 'user' or 'assistant'", i+1, entry.Role)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("invalid openai messages. no messages were found")
+	}
+
+	turns, err := pair(messages)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []session.Transcript{{Turns: turns}}, nil
+}
+
+// openAIText returns the text of the specified openai message content, being either a string or an array of content parts, of which only
+// text parts are supported
+func openAIText(content json.RawMessage) (string, error) {
+	text := ""
+
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text, nil
+	}
+
+	parts := []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}{}
+
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return "", fmt.Errorf("content must be a string or an array of content parts")
+	}
+
+	texts := []string{}
+
+	for _, part := range parts {
+		if part.Type != "text" {
+			return "", fmt.Errorf("unsupported content part type '%v'. only text parts can be imported", part.Type)
+		}
+
+		texts = append(texts, part.Text)
+	}
+
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// pair groups the specified messages into turns. consecutive messages with the same role are joined and the first message must be a
+// prompt and the last a response
+func pair(messages []message) ([]session.Turn, error) {
+	joined := []message{}
+
+	for _, m := range messages {
+		m.text = strings.TrimSpace(m.text)
+
+		if len(joined) > 0 && joined[len(joined)-1].role == m.role {
+			joined[len(joined)-1].text += "\n\n" + m.text
+			joined[len(joined)-1].meta.Sources = append(joined[len(joined)-1].meta.Sources, m.meta.Sources...)
+			continue
+		}
+
+		joined = append(joined, m)
+	}
+
+	if joined[0].role != llm.RoleUser {
+		return nil, fmt.Errorf("invalid transcript. the first message must be from the user")
+	}
+
+	if joined[len(joined)-1].role != llm.RoleModel {
+		return nil, fmt.Errorf("invalid transcript. the last message must be from the model, so that every prompt has a response")
+	}
+
+	turns := []session.Turn{}
+
+	for i := 0; i < len(joined); i += 2 {
+		prompt, response := joined[i], joined[i+1]
+
+		turns = append(turns, session.Turn{
+			Prompt:   prompt.text,
+			Response: response.text,
+			Sources:  response.meta.Sources,
+			Model:    prompt.meta.Model,
+			Tokens:   prompt.meta.Tokens,
+			Time:     prompt.meta.Time,
+		})
+	}
+
+	return turns, nil
+}
@@ -0,0 +1,238 @@
+package transcript
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/comradequinn/gen/session"
+)
+
+type (
+	// Document is the json form of an export, holding the transcripts of one or more sessions
+	Document struct {
+		Sessions []session.Transcript `json:"sessions"`
+	}
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatHTML     = "html"
+	FormatJSON     = "json"
+)
+
+// Formats lists the formats in which transcripts can be written
+var Formats = []string{FormatMarkdown, FormatHTML, FormatJSON}
+
+// markdownArchivedNote follows the heading of the archived turns of a markdown transcript
+const markdownArchivedNote = "_These turns were compacted and are no longer sent with prompts._"
+
+// Write writes the specified transcripts to w in the specified format; either a markdown document, a self-contained html page or a json Document
+func Write(w io.Writer, format string, transcripts []session.Transcript) error {
+	switch format {
+	case FormatMarkdown, "markdown":
+		return writeMarkdown(w, transcripts)
+	case FormatHTML:
+		return writeHTML(w, transcripts)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(Document{Sessions: transcripts}); err != nil {
+			return fmt.Errorf("unable to write json transcript. %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("invalid export format '%v'. expected one of %v", format, strings.Join(Formats, ", "))
+	}
+}
+
+// title returns the heading of the specified transcript
+func title(t session.Transcript) string {
+	if t.Name != "" {
+		return fmt.Sprintf("Session #%v %v", t.ID, t.Name)
+	}
+
+	return fmt.Sprintf("Session #%v", t.ID)
+}
+
+// metadata returns a description of when the specified turn took place and the model and tokens that produced its response, where recorded
+func metadata(turn session.Turn) string {
+	details := []string{}
+
+	if !turn.Time.IsZero() {
+		details = append(details, turn.Time.Local().Format(time.DateTime))
+	}
+
+	if turn.Model != "" {
+		details = append(details, turn.Model)
+	}
+
+	if turn.Tokens > 0 {
+		details = append(details, fmt.Sprintf("%v tokens", turn.Tokens))
+	}
+
+	return strings.Join(details, ", ")
+}
+
+func writeMarkdown(w io.Writer, transcripts []session.Transcript) error {
+	b := strings.Builder{}
+
+	writeTurns := func(turns []session.Turn, offset int) {
+		for i, turn := range turns {
+			fmt.Fprintf(&b, "### Turn %v\n\n", i+offset+1)
+
+			if meta := metadata(turn); meta != "" {
+				fmt.Fprintf(&b, "_%v_\n\n", meta)
+			}
+
+			fmt.Fprintf(&b, "**User:**\n\n%v\n\n", turn.Prompt)
+
+			if len(turn.Attachments) > 0 {
+				b.WriteString("Attachments:\n\n")
+				for _, a := range turn.Attachments {
+					fmt.Fprintf(&b, "- `%v` (%v)\n", a.Name, a.MIMEType)
+				}
+				b.WriteString("\n")
+			}
+
+			if len(turn.ToolCalls) > 0 {
+				b.WriteString("Tool calls:\n\n")
+				for _, c := range turn.ToolCalls {
+					fmt.Fprintf(&b, "- `%v(%s)` returned `%s`\n", c.Name, c.Args, c.Response)
+				}
+				b.WriteString("\n")
+			}
+
+			fmt.Fprintf(&b, "**Model:**\n\n%v\n\n", turn.Response)
+
+			if len(turn.Sources) > 0 {
+				b.WriteString("Sources:\n\n")
+				for _, s := range turn.Sources {
+					fmt.Fprintf(&b, "- [%v](%v)\n", s.Title, s.URI)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+
+	for i, t := range transcripts {
+		if i > 0 {
+			b.WriteString("---\n\n")
+		}
+
+		fmt.Fprintf(&b, "# %v\n\n", title(t))
+
+		if len(t.Archived) > 0 {
+			fmt.Fprintf(&b, "## Archived\n\n%v\n\n", markdownArchivedNote)
+			writeTurns(t.Archived, 0)
+			b.WriteString("## Current\n\n")
+		}
+
+		writeTurns(t.Turns, len(t.Archived))
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("unable to write markdown transcript. %w", err)
+	}
+
+	return nil
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 60em; margin: 2em auto; padding: 0 1em; color: #1f2328; }
+h1 { border-bottom: 1px solid #d0d7de; padding-bottom: .3em; }
+.turn { border: 1px solid #d0d7de; border-radius: 6px; margin: 1em 0; padding: 0 1em; }
+.archived { opacity: .7; }
+.meta { color: #656d76; font-size: .85em; }
+.user, .model { white-space: pre-wrap; }
+.user { background: #f6f8fa; padding: .5em; border-radius: 6px; }
+code { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: .9em; }
+</style>
+</head>
+<body>
+{{- range .Sessions}}
+<section>
+<h1>{{.Title}}</h1>
+{{- range .Turns}}
+<div class="turn{{if .Archived}} archived{{end}}">
+<h3>Turn {{.Number}}{{if .Archived}} (archived){{end}}</h3>
+{{- with .Metadata}}
+<p class="meta">{{.}}</p>
+{{- end}}
+<p><strong>User</strong></p>
+<div class="user">{{.Prompt}}</div>
+{{- with .Attachments}}
+<p>Attachments:</p>
+<ul>{{range .}}<li><code>{{.Name}}</code> ({{.MIMEType}})</li>{{end}}</ul>
+{{- end}}
+{{- with .ToolCalls}}
+<p>Tool calls:</p>
+<ul>{{range .}}<li><code>{{.Name}}({{printf "%s" .Args}})</code> returned <code>{{printf "%s" .Response}}</code></li>{{end}}</ul>
+{{- end}}
+<p><strong>Model</strong></p>
+<div class="model">{{.Response}}</div>
+{{- with .Sources}}
+<p>Sources:</p>
+<ul>{{range .}}<li><a href="{{.URI}}">{{.Title}}</a></li>{{end}}</ul>
+{{- end}}
+</div>
+{{- end}}
+</section>
+{{- end}}
+</body>
+</html>
+`))
+
+func writeHTML(w io.Writer, transcripts []session.Transcript) error {
+	type (
+		turn struct {
+			session.Turn
+			Number   int
+			Archived bool
+			Metadata string
+		}
+		section struct {
+			Title string
+			Turns []turn
+		}
+	)
+
+	page := struct {
+		Title    string
+		Sessions []section
+	}{Title: "Sessions"}
+
+	for _, t := range transcripts {
+		s := section{Title: title(t)}
+
+		for i, archived := range t.Archived {
+			s.Turns = append(s.Turns, turn{Turn: archived, Number: i + 1, Archived: true, Metadata: metadata(archived)})
+		}
+
+		for i, current := range t.Turns {
+			s.Turns = append(s.Turns, turn{Turn: current, Number: len(t.Archived) + i + 1, Metadata: metadata(current)})
+		}
+
+		page.Sessions = append(page.Sessions, s)
+	}
+
+	if len(page.Sessions) == 1 {
+		page.Title = page.Sessions[0].Title
+	}
+
+	if err := htmlTemplate.Execute(w, page); err != nil {
+		return fmt.Errorf("unable to write html transcript. %w", err)
+	}
+
+	return nil
+}
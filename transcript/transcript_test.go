@@ -0,0 +1,211 @@
+package transcript_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/comradequinn/gen/llm"
+	"github.com/comradequinn/gen/session"
+	"github.com/comradequinn/gen/transcript"
+)
+
+func TestWrite(t *testing.T) {
+	transcripts := []session.Transcript{
+		{
+			ID:   1,
+			Name: "test-name",
+			Archived: []session.Turn{
+				{Prompt: "test-archived-prompt", Response: "test-archived-response"},
+			},
+			Turns: []session.Turn{
+				{
+					Prompt:      "test-prompt <b>",
+					Attachments: []session.Attachment{{Name: "test-file", MIMEType: "text/plain"}},
+					ToolCalls:   []session.ToolCall{{Name: "test-tool", Args: json.RawMessage(`{"id":1}`), Response: json.RawMessage(`{"output":"test-output"}`)}},
+					Response:    "test-response",
+					Model:       "test-model",
+					Tokens:      10,
+					Time:        time.Now(),
+				},
+			},
+		},
+		{ID: 2},
+	}
+
+	tests := []struct {
+		format   string
+		expected []string
+	}{
+		{
+			format:   transcript.FormatMarkdown,
+			expected: []string{"# Session #1 test-name", "## Archived", "### Turn 1", "test-archived-prompt", "### Turn 2", "**User:**\n\ntest-prompt <b>", "- `test-file` (text/plain)", "`test-tool({\"id\":1})`", "**Model:**\n\ntest-response", "test-model, 10 tokens", "---\n\n# Session #2"},
+		},
+		{
+			format:   transcript.FormatHTML,
+			expected: []string{"<!DOCTYPE html>", "<title>Sessions</title>", "<h1>Session #1 test-name</h1>", "Turn 1 (archived)", "test-prompt &lt;b&gt;", "<code>test-file</code>", "test-model, 10 tokens", "<h1>Session #2</h1>"},
+		},
+		{
+			format:   transcript.FormatJSON,
+			expected: []string{`"sessions": [`, `"name": "test-name"`, `"prompt": "test-archived-prompt"`, `"model": "test-model"`, `"tokens": 10`, `"toolCalls": [`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+
+			if err := transcript.Write(&buffer, test.format, transcripts); err != nil {
+				t.Fatalf("expected no error writing transcript. got %v", err)
+			}
+
+			for _, expected := range test.expected {
+				if !strings.Contains(buffer.String(), expected) {
+					t.Fatalf("expected transcript to contain %q. got\n%v", expected, buffer.String())
+				}
+			}
+		})
+	}
+
+	if err := transcript.Write(&bytes.Buffer{}, "test-invalid-format", transcripts); err == nil {
+		t.Fatalf("expected an error for an invalid format")
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		input         string
+		expectedTurns [][2]string
+		expectedError bool
+	}{
+		{
+			name:          "markdown",
+			input:         "A few-shot example\n\nUser: test-prompt-1\n\nModel:\ntest-response-1\nsecond line\n\n**User:** test-prompt-2\n**Assistant:** test-response-2\n",
+			expectedTurns: [][2]string{{"test-prompt-1", "test-response-1\nsecond line"}, {"test-prompt-2", "test-response-2"}},
+		},
+		{
+			name:          "markdown without a response",
+			input:         "User: test-prompt-1\nModel: test-response-1\nUser: test-prompt-2",
+			expectedError: true,
+		},
+		{
+			name:          "markdown without messages",
+			input:         "test-text",
+			expectedError: true,
+		},
+		{
+			name:          "openai array",
+			input:         `[{"role":"system","content":"test-system"},{"role":"user","content":"test-prompt"},{"role":"assistant","content":[{"type":"text","text":"test-response"}]}]`,
+			expectedTurns: [][2]string{{"test-system", "Understood. I will follow those instructions for the rest of our conversation."}, {"test-prompt", "test-response"}},
+		},
+		{
+			name:          "openai request body",
+			input:         `{"model":"test-model","messages":[{"role":"user","content":"test-prompt"},{"role":"assistant","content":"test-response"}]}`,
+			expectedTurns: [][2]string{{"test-prompt", "test-response"}},
+		},
+		{
+			name:          "openai unsupported role",
+			input:         `[{"role":"tool","content":"test-output"}]`,
+			expectedError: true,
+		},
+		{
+			name:          "json",
+			input:         `{"sessions":[{"id":7,"name":"test-name","turns":[{"prompt":"test-prompt","response":"test-response","model":"test-model"}]}]}`,
+			expectedTurns: [][2]string{{"test-prompt", "test-response"}},
+		},
+		{
+			name:          "explicit format",
+			format:        transcript.FormatMarkdown,
+			input:         `[User: test-prompt]`,
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transcripts, err := transcript.Read(strings.NewReader(test.input), test.format)
+
+			if test.expectedError {
+				if err == nil {
+					t.Fatalf("expected an error reading transcript. got %+v", transcripts)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error reading transcript. got %v", err)
+			}
+
+			if len(transcripts) != 1 || len(transcripts[0].Turns) != len(test.expectedTurns) {
+				t.Fatalf("expected 1 transcript with %v turns. got %+v", len(test.expectedTurns), transcripts)
+			}
+
+			for i, turn := range transcripts[0].Turns {
+				if turn.Prompt != test.expectedTurns[i][0] || turn.Response != test.expectedTurns[i][1] {
+					t.Fatalf("expected turn %v to be %q. got %q, %q", i+1, test.expectedTurns[i], turn.Prompt, turn.Response)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	expected := []session.Transcript{
+		{
+			ID:       1,
+			Name:     "test-name",
+			Archived: []session.Turn{{Prompt: "test-archived-prompt", Response: "test-archived-response"}},
+			Turns: []session.Turn{
+				{
+					Prompt:      "test-prompt-1",
+					Attachments: []session.Attachment{{Name: "test-file", MIMEType: "text/plain"}},
+					ToolCalls:   []session.ToolCall{{Name: "test-tool", Args: json.RawMessage(`{"id":1}`), Response: json.RawMessage(`{"output":"test-output"}`)}},
+					Response:    "test-response-1\n\n---\n\nsecond section",
+					Sources:     []llm.Source{{Title: "test-title", URI: "https://test-uri"}},
+					Model:       "test-model",
+					Tokens:      10,
+					Time:        time.Date(2025, 4, 15, 10, 30, 0, 0, time.Local),
+				},
+				{Prompt: "test-prompt-2", Response: "test-response-2"},
+			},
+		},
+		{ID: 2, Turns: []session.Turn{{Prompt: "test-prompt-3", Response: "test-response-3", Model: "test-model"}}},
+	}
+
+	for _, format := range []string{transcript.FormatJSON, transcript.FormatMarkdown} {
+		buffer := bytes.Buffer{}
+
+		if err := transcript.Write(&buffer, format, expected); err != nil {
+			t.Fatalf("expected no error writing %v transcript. got %v", format, err)
+		}
+
+		actual, err := transcript.Read(&buffer, "")
+
+		if err != nil {
+			t.Fatalf("expected no error reading %v transcript. got %v", format, err)
+		}
+
+		if len(actual) != len(expected) {
+			t.Fatalf("expected %v sessions to be imported from the %v transcript. got %+v", len(expected), format, actual)
+		}
+
+		for i := range expected {
+			if actual[i].Name != expected[i].Name || len(actual[i].Turns) != len(expected[i].Turns) || len(actual[i].Archived) != len(expected[i].Archived) {
+				t.Fatalf("expected session %v of the %v transcript to be %+v. got %+v", i+1, format, expected[i], actual[i])
+			}
+
+			for j, turn := range slices.Concat(actual[i].Archived, actual[i].Turns) {
+				e := slices.Concat(expected[i].Archived, expected[i].Turns)[j]
+
+				if turn.Prompt != e.Prompt || turn.Response != e.Response || turn.Model != e.Model || turn.Tokens != e.Tokens || !turn.Time.Equal(e.Time) || !slices.Equal(turn.Sources, e.Sources) {
+					t.Fatalf("expected turn %v of session %v of the %v transcript to be %+v. got %+v", j+1, i+1, format, e, turn)
+				}
+			}
+		}
+	}
+}